@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"io/ioutil"
 	stdLog "log"
 	"net/http"
@@ -63,10 +64,19 @@ func main() {
 		baseLogger.Fatalf("Failed to initialize config: %v\n", err)
 	}
 
-	var (
-		l      = getLogger(cfg, baseLogger)
-		server = app.New(l.(logrus.FieldLogger), cfg)
-	)
+	l := getLogger(cfg, baseLogger)
+
+	if args := flag.Args(); len(args) > 0 && args[0] == "migrate" {
+		if err := migrate(cfg, l, args[1:]); err != nil {
+			l.Fatalf("Failed to migrate: %v", err)
+		}
+		return
+	}
+
+	server, err := app.New(l.(logrus.FieldLogger), cfg)
+	if err != nil {
+		l.Fatalf("Failed to initialize api server: %v", err)
+	}
 
 	// start HTTP API server
 	go func() {
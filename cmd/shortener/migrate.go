@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/bigbag/go-musthave-shortener/internal/config"
+	"github.com/bigbag/go-musthave-shortener/internal/storage/repository"
+)
+
+const migrateUsage = "usage: shortener [flags] migrate up|down [steps]|status|dedup global|user|none"
+
+// migrate applies, rolls back or shows migrations of pg storage
+// and changes the scope of deduplication without starting of api server
+func migrate(cfg *config.Config, l logrus.StdLogger, args []string) error {
+	if cfg.Storage.DatabaseDSN == "" {
+		return errors.New("database dsn is not set")
+	}
+	if len(args) == 0 {
+		return errors.New(migrateUsage)
+	}
+
+	conn, err := sql.Open("postgres", cfg.Storage.DatabaseDSN)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	m, err := repository.NewMigrator(conn)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	switch args[0] {
+	case "up":
+		total, err := m.Up(ctx)
+		if err != nil {
+			return err
+		}
+		l.Printf("Applied %d migrations", total)
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				return fmt.Errorf("bad number of steps: %s", args[1])
+			}
+		}
+
+		total, err := m.Down(ctx, steps)
+		if err != nil {
+			return err
+		}
+		l.Printf("Rolled back %d migrations", total)
+	case "status":
+		statuses, err := m.Status(ctx)
+		if err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			appliedAt := "pending"
+			if status.AppliedAt != nil {
+				appliedAt = status.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			l.Printf("%04d_%s\t%s", status.Version, status.Name, appliedAt)
+		}
+
+		scopes, err := m.DedupScopes(ctx)
+		if err != nil {
+			return err
+		}
+		l.Printf("dedup scope\t%s", strings.Join(scopes, ","))
+	case "dedup":
+		if len(args) < 2 {
+			return errors.New(migrateUsage)
+		}
+
+		changed, err := m.SetDedupScope(ctx, args[1])
+		if err != nil {
+			return err
+		}
+		if changed {
+			l.Printf("Changed dedup scope to %s", args[1])
+		} else {
+			l.Printf("Dedup scope is already %s", args[1])
+		}
+	default:
+		return errors.New(migrateUsage)
+	}
+	return nil
+}
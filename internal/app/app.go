@@ -2,6 +2,7 @@ package app
 
 import (
 	"context"
+	"errors"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
@@ -11,33 +12,47 @@ import (
 	"github.com/sirupsen/logrus"
 
 	"github.com/bigbag/go-musthave-shortener/internal/config"
+	"github.com/bigbag/go-musthave-shortener/internal/metrics"
+	"github.com/bigbag/go-musthave-shortener/internal/middleware/reqctx"
 	"github.com/bigbag/go-musthave-shortener/internal/middleware/userid"
 	"github.com/bigbag/go-musthave-shortener/internal/storage"
+	"github.com/bigbag/go-musthave-shortener/internal/storage/repository"
+	"github.com/bigbag/go-musthave-shortener/internal/tracing"
 	"github.com/bigbag/go-musthave-shortener/internal/url"
 	"github.com/bigbag/go-musthave-shortener/internal/utils"
 )
 
 type Server struct {
-	l logrus.FieldLogger
-	f *fiber.App
-	p *url.TaskPool
+	l  logrus.FieldLogger
+	f  *fiber.App
+	p  *url.TaskPool
+	r  *url.Reaper
+	c  *url.ClickCollector
+	st storage.StorageService
+	t  *tracing.Provider
 }
 
-func New(l logrus.FieldLogger, cfg *config.Config) *Server {
+func New(l logrus.FieldLogger, cfg *config.Config) (*Server, error) {
 	fiberCfg := fiber.Config{
-		ReadTimeout: time.Second * cfg.Server.ReadTimeout,
-		IdleTimeout: time.Second * cfg.Server.IdleTimeout,
-		Immutable:   true,
-		ErrorHandler: func(ctx *fiber.Ctx, err error) error {
-			l.WithError(err).Error("Unexpected API error")
-			return utils.SendJSONError(ctx, fiber.StatusInternalServerError, err.Error())
-		},
+		ReadTimeout:  time.Second * cfg.Server.ReadTimeout,
+		IdleTimeout:  time.Second * cfg.Server.IdleTimeout,
+		Immutable:    true,
+		ErrorHandler: newErrorHandler(l),
+	}
+
+	ctxBg := context.Background()
+	tracer, err := tracing.New(ctxBg, cfg.ServiceName, cfg.Tracing)
+	if err != nil {
+		return nil, err
 	}
 
 	f := fiber.New(fiberCfg)
 
 	f.Use(recover.New())
 
+	m := metrics.New("shortener")
+	f.Use(m.Middleware())
+
 	f.Use(logger.New(logger.Config{
 		Output: l.(*logrus.Logger).Writer(),
 	}))
@@ -46,28 +61,122 @@ func New(l logrus.FieldLogger, cfg *config.Config) *Server {
 		Level: compress.LevelBestCompression,
 	}))
 
+	f.Use(reqctx.New(reqctx.Config{
+		Timeout: cfg.Server.RequestTimeout,
+	}))
+
+	f.Use(tracing.Middleware())
+
 	f.Use(userid.New(userid.Config{
 		Secret:     cfg.UserCookieSecret,
 		ContextKey: cfg.UserContextKey,
 	}))
 
-	ctxBg := context.Background()
-	urlStorage, _ := storage.NewStorageService(ctxBg, cfg.Storage)
+	urlStorage, err := storage.NewStorageService(ctxBg, l, cfg.Storage, m)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Storage.CacheSize > 0 {
+		m.RegisterCache(func() (uint64, uint64) {
+			stats := urlStorage.Stats()
+			return stats.CacheHits, stats.CacheMisses
+		})
+	}
 
-	urlRepository := url.NewURLRepository(urlStorage)
+	urlGenerator, err := url.NewShortIDGenerator(cfg.ShortID, urlStorage)
+	if err != nil {
+		return nil, err
+	}
 
-	urlPool := url.NewTaskPool(ctxBg, l, urlRepository)
-	urlService := url.NewURLService(l, urlRepository, urlPool)
-	url.NewURLHandler(f.Group(""), urlService, cfg, l)
+	urlRepository := url.NewURLRepository(urlStorage, urlGenerator)
 
-	return &Server{l: l, f: f, p: urlPool}
+	urlPool, err := url.NewTaskPool(ctxBg, l, urlRepository, m, cfg.DeleteQueue)
+	if err != nil {
+		return nil, err
+	}
+	m.RegisterQueue(urlPool.Len)
+	urlReaper := url.NewReaper(
+		ctxBg, l, urlRepository, cfg.ReaperInterval, cfg.Storage.RemovedRetention,
+	)
+	urlCollector := url.NewClickCollector(l, urlRepository, cfg.Analytics)
+	m.RegisterDroppedClicks(urlCollector.Dropped)
+	urlService := url.NewURLService(l, urlRepository, urlPool, urlCollector)
+
+	f.Get("/metrics", m.Handler())
+	url.NewURLHandler(f.Group(""), urlService, cfg, l, m)
+
+	return &Server{
+		l:  l,
+		f:  f,
+		p:  urlPool,
+		r:  urlReaper,
+		c:  urlCollector,
+		st: urlStorage,
+		t:  tracer,
+	}, nil
+}
+
+// statusClientClosedRequest is a non-standard status of requests
+// canceled by the client before the response
+const statusClientClosedRequest = 499
+
+// errorStatus maps errors of the storage, storage service and url
+// layers to http status codes
+func errorStatus(err error) int {
+	var fe *fiber.Error
+	if errors.As(err, &fe) {
+		return fe.Code
+	}
+
+	switch {
+	case errors.Is(err, context.Canceled):
+		return statusClientClosedRequest
+	case errors.Is(err, context.DeadlineExceeded):
+		return fiber.StatusGatewayTimeout
+	case errors.Is(err, repository.ErrNotFound):
+		return fiber.StatusNotFound
+	case errors.Is(err, repository.ErrConflict):
+		return fiber.StatusConflict
+	case errors.Is(err, repository.ErrForbidden):
+		return fiber.StatusForbidden
+	case errors.Is(err, repository.ErrUnavailable):
+		return fiber.StatusServiceUnavailable
+	default:
+		return fiber.StatusInternalServerError
+	}
+}
+
+func newErrorHandler(l logrus.FieldLogger) fiber.ErrorHandler {
+	return func(ctx *fiber.Ctx, err error) error {
+		code := errorStatus(err)
+		switch {
+		case code == statusClientClosedRequest:
+		case code == fiber.StatusGatewayTimeout:
+			l.WithError(err).Warn("API request timed out")
+		case code >= fiber.StatusInternalServerError:
+			l.WithError(err).Error("Unexpected API error")
+		}
+		return utils.SendJSONError(ctx, code, err.Error())
+	}
 }
 
 func (s *Server) Start(addr string) error {
 	return s.f.Listen(addr)
 }
 
+// Stop stops accepting of requests first, so accepted deletions
+// are drained by the task pool, and closes the storage after all
+// writers, so buffered writes are flushed
 func (s *Server) Stop() error {
+	err := s.f.Shutdown()
 	s.p.Close()
-	return s.f.Shutdown()
+	s.r.Close()
+	s.c.Close()
+	if storageErr := s.st.Shutdown(); err == nil {
+		err = storageErr
+	}
+	if tracerErr := s.t.Shutdown(context.Background()); err == nil {
+		err = tracerErr
+	}
+	return err
 }
@@ -1,20 +1,28 @@
 package app
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/gofiber/fiber/v2"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 
 	"github.com/bigbag/go-musthave-shortener/internal/config"
+	"github.com/bigbag/go-musthave-shortener/internal/storage"
+	"github.com/bigbag/go-musthave-shortener/internal/storage/repository"
 )
 
+const testAdminToken = "admin"
+
 var (
 	testServer *Server
 )
@@ -33,7 +41,8 @@ type TestCase struct {
 func getNewTestServer() *Server {
 	if testServer == nil {
 		cfg, _ := config.New()
-		testServer = New(logrus.New(), cfg)
+		cfg.AdminToken = testAdminToken
+		testServer, _ = New(logrus.New(), cfg)
 	}
 
 	return testServer
@@ -71,6 +80,55 @@ func checkResponse(t *testing.T, test TestCase, res *http.Response, err error) {
 	assert.Equalf(t, test.expectedBody, string(body), test.description)
 }
 
+// testWaitTimeout limits polling of results of background processing
+const testWaitTimeout = 5 * time.Second
+
+// waitForResponse repeats the request until it returns the expected code
+// and body, so tests don't depend on timing of background processing
+func waitForResponse(t *testing.T, server *Server, test TestCase) {
+	assert.Eventuallyf(t, func() bool {
+		test := test
+		test.requestHeaders = http.Header(test.requestHeaders).Clone()
+
+		res, err := makeTestRequest(server, test)
+		if err != nil || res.StatusCode != test.expectedCode {
+			return false
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		return err == nil && (test.expectedBody == "" || test.expectedBody == string(body))
+	}, testWaitTimeout, 10*time.Millisecond, test.description)
+}
+
+type testUserURL struct {
+	FullURL   string     `json:"original_url"`
+	ShortURL  string     `json:"short_url"`
+	CreatedAt *time.Time `json:"created_at"`
+	UpdatedAt *time.Time `json:"updated_at"`
+	DeletedAt *time.Time `json:"deleted_at"`
+}
+
+func fetchUserURLs(t *testing.T, server *Server, route string, cookie string) (*http.Response, []*testUserURL) {
+	res, err := makeTestRequest(server, TestCase{
+		requestRoute:   route,
+		requestMethod:  http.MethodGet,
+		requestHeaders: http.Header{"Cookie": []string{cookie}},
+	})
+	assert.Nil(t, err)
+	assert.Equalf(t, http.StatusOK, res.StatusCode, route)
+
+	var urls []*testUserURL
+	assert.Nil(t, json.NewDecoder(res.Body).Decode(&urls))
+	return res, urls
+}
+
+func shortURLs(urls []*testUserURL) []string {
+	result := make([]string, 0, len(urls))
+	for _, item := range urls {
+		result = append(result, item.ShortURL)
+	}
+	return result
+}
+
 func TestGetStatusHandler(t *testing.T) {
 	tests := []TestCase{
 		{
@@ -97,8 +155,8 @@ func TestCreateURLHandler(t *testing.T) {
 			requestRoute:  "/",
 			requestMethod: http.MethodGet,
 			expectedError: false,
-			expectedCode:  http.StatusInternalServerError,
-			expectedBody:  `{"code":500,"message":"Method Not Allowed"}`,
+			expectedCode:  http.StatusMethodNotAllowed,
+			expectedBody:  `{"code":405,"message":"Method Not Allowed"}`,
 		},
 		{
 			description:   "empty payload",
@@ -178,8 +236,8 @@ func TestCreateURLJsonHandler(t *testing.T) {
 			requestRoute:  "/api/shorten",
 			requestMethod: http.MethodGet,
 			expectedError: false,
-			expectedCode:  http.StatusInternalServerError,
-			expectedBody:  `{"code":500,"message":"Method Not Allowed"}`,
+			expectedCode:  http.StatusMethodNotAllowed,
+			expectedBody:  `{"code":405,"message":"Method Not Allowed"}`,
 		},
 		{
 			description:   "empty payload",
@@ -333,3 +391,945 @@ func TestCreateBatchOfShortURLHandler(t *testing.T) {
 	assert.Equalf(t, originFullURL, fullURL, test.description)
 
 }
+
+func TestCreateBatchOfShortURLOrderHandler(t *testing.T) {
+	type ShorterItem struct {
+		ShortURL      string `json:"short_url"`
+		CorrelationID string `json:"correlation_id"`
+	}
+
+	server := getNewTestServer()
+
+	test := TestCase{
+		description:   "batch with duplicates",
+		requestRoute:  "/api/shorten/batch",
+		requestMethod: http.MethodPost,
+		requestBody: `[
+			{"original_url":"https://github.com/batch_order_1", "correlation_id": "1"},
+			{"original_url":"https://github.com/batch_order_2", "correlation_id": "2"},
+			{"original_url":"https://github.com/batch_order_1", "correlation_id": "3"}
+		]`,
+		requestHeaders: http.Header{
+			"Content-Type": []string{"application/json"},
+		},
+		expectedError: false,
+		expectedCode:  http.StatusCreated,
+		expectedBody:  "",
+	}
+	res, err := makeTestRequest(server, test)
+
+	var result []*ShorterItem
+	json.NewDecoder(res.Body).Decode(&result)
+
+	checkResponse(t, test, res, err)
+
+	assert.Len(t, result, 3)
+	assert.Equal(t, "1", result[0].CorrelationID)
+	assert.Equal(t, "2", result[1].CorrelationID)
+	assert.Equal(t, "3", result[2].CorrelationID)
+	assert.Equal(t, result[0].ShortURL, result[2].ShortURL)
+	assert.NotEqual(t, result[0].ShortURL, result[1].ShortURL)
+}
+
+func TestCreateURLWithAliasHandler(t *testing.T) {
+	tests := []TestCase{
+		{
+			description:   "success",
+			requestRoute:  "/api/shorten",
+			requestMethod: http.MethodPost,
+			requestBody:   `{"url":"https://github.com/alias","alias":"spring-sale"}`,
+			requestHeaders: http.Header{
+				"Content-Type": []string{"application/json"},
+			},
+			expectedError: false,
+			expectedCode:  http.StatusCreated,
+			expectedBody:  "",
+		},
+		{
+			description:   "redirect by alias",
+			requestRoute:  "/spring-sale",
+			requestMethod: http.MethodGet,
+			expectedError: false,
+			expectedCode:  http.StatusTemporaryRedirect,
+			expectedBody:  "",
+		},
+		{
+			description:   "alias already taken",
+			requestRoute:  "/api/shorten",
+			requestMethod: http.MethodPost,
+			requestBody:   `{"url":"https://github.com/alias_other","alias":"spring-sale"}`,
+			requestHeaders: http.Header{
+				"Content-Type": []string{"application/json"},
+			},
+			expectedError: false,
+			expectedCode:  http.StatusConflict,
+			expectedBody:  `{"code":409,"message":"alias already taken"}`,
+		},
+		{
+			description:   "reserved alias",
+			requestRoute:  "/api/shorten",
+			requestMethod: http.MethodPost,
+			requestBody:   `{"url":"https://github.com/alias_reserved","alias":"Ping"}`,
+			requestHeaders: http.Header{
+				"Content-Type": []string{"application/json"},
+			},
+			expectedError: false,
+			expectedCode:  http.StatusBadRequest,
+			expectedBody:  `{"code":400,"message":"invalid alias: alias is reserved"}`,
+		},
+		{
+			description:   "not valid alias",
+			requestRoute:  "/api/shorten",
+			requestMethod: http.MethodPost,
+			requestBody:   `{"url":"https://github.com/alias_invalid","alias":"spring/sale"}`,
+			requestHeaders: http.Header{
+				"Content-Type": []string{"application/json"},
+			},
+			expectedError: false,
+			expectedCode:  http.StatusBadRequest,
+			expectedBody:  "",
+		},
+		{
+			description:   "batch alias already taken",
+			requestRoute:  "/api/shorten/batch",
+			requestMethod: http.MethodPost,
+			requestBody: `[
+				{
+					"original_url":"https://github.com/alias_batch",
+					"correlation_id": "1",
+					"alias": "spring-sale"
+				}
+			]`,
+			requestHeaders: http.Header{
+				"Content-Type": []string{"application/json"},
+			},
+			expectedError: false,
+			expectedCode:  http.StatusConflict,
+			expectedBody:  `{"code":409,"message":"alias already taken"}`,
+		},
+		{
+			description:   "batch with alias",
+			requestRoute:  "/api/shorten/batch",
+			requestMethod: http.MethodPost,
+			requestBody: `[
+				{
+					"original_url":"https://github.com/alias_batch",
+					"correlation_id": "1",
+					"alias": "autumn-sale"
+				}
+			]`,
+			requestHeaders: http.Header{
+				"Content-Type": []string{"application/json"},
+			},
+			expectedError: false,
+			expectedCode:  http.StatusCreated,
+			expectedBody:  "",
+		},
+		{
+			description:   "redirect by batch alias",
+			requestRoute:  "/autumn-sale",
+			requestMethod: http.MethodGet,
+			expectedError: false,
+			expectedCode:  http.StatusTemporaryRedirect,
+			expectedBody:  "",
+		},
+	}
+
+	server := getNewTestServer()
+	for _, test := range tests {
+		res, err := makeTestRequest(server, test)
+		checkResponse(t, test, res, err)
+	}
+}
+
+func TestURLExpirationHandler(t *testing.T) {
+	tests := []TestCase{
+		{
+			description:   "expires_at in the past",
+			requestRoute:  "/api/shorten",
+			requestMethod: http.MethodPost,
+			requestBody:   `{"url":"https://github.com/expired","expires_at":"2020-01-01T00:00:00Z"}`,
+			requestHeaders: http.Header{
+				"Content-Type": []string{"application/json"},
+			},
+			expectedError: false,
+			expectedCode:  http.StatusBadRequest,
+			expectedBody:  `{"code":400,"message":"invalid expiration: expires_at must be in the future"}`,
+		},
+		{
+			description:   "expires_at with ttl",
+			requestRoute:  "/api/shorten",
+			requestMethod: http.MethodPost,
+			requestBody:   `{"url":"https://github.com/expired","expires_at":"2100-01-01T00:00:00Z","ttl":60}`,
+			requestHeaders: http.Header{
+				"Content-Type": []string{"application/json"},
+			},
+			expectedError: false,
+			expectedCode:  http.StatusBadRequest,
+			expectedBody:  "",
+		},
+		{
+			description:   "success",
+			requestRoute:  "/api/shorten",
+			requestMethod: http.MethodPost,
+			requestBody:   `{"url":"https://github.com/expired","alias":"expired","ttl":1}`,
+			requestHeaders: http.Header{
+				"Content-Type": []string{"application/json"},
+			},
+			expectedError: false,
+			expectedCode:  http.StatusCreated,
+			expectedBody:  "",
+		},
+		{
+			description:   "not expired yet",
+			requestRoute:  "/expired",
+			requestMethod: http.MethodGet,
+			expectedError: false,
+			expectedCode:  http.StatusTemporaryRedirect,
+			expectedBody:  "",
+		},
+	}
+
+	server := getNewTestServer()
+	for _, test := range tests {
+		res, err := makeTestRequest(server, test)
+		checkResponse(t, test, res, err)
+	}
+
+	test := TestCase{
+		description:   "expired",
+		requestRoute:  "/expired",
+		requestMethod: http.MethodGet,
+		expectedError: false,
+		expectedCode:  http.StatusGone,
+		expectedBody:  `{"code":410,"message":"url was expired"}`,
+	}
+	waitForResponse(t, server, test)
+
+	res, err := makeTestRequest(server, test)
+	checkResponse(t, test, res, err)
+}
+
+func TestURLStatsHandler(t *testing.T) {
+	server := getNewTestServer()
+
+	test := TestCase{
+		description:   "create url",
+		requestRoute:  "/api/shorten",
+		requestMethod: http.MethodPost,
+		requestBody:   `{"url":"https://github.com/stats","alias":"stats-link"}`,
+		requestHeaders: http.Header{
+			"Content-Type": []string{"application/json"},
+		},
+		expectedError: false,
+		expectedCode:  http.StatusCreated,
+		expectedBody:  "",
+	}
+	res, err := makeTestRequest(server, test)
+	checkResponse(t, test, res, err)
+
+	cookie := strings.Split(res.Header.Get("Set-Cookie"), ";")[0]
+
+	for i := 0; i < 2; i++ {
+		test = TestCase{
+			description:   "get full url",
+			requestRoute:  "/stats-link",
+			requestMethod: http.MethodGet,
+			requestHeaders: http.Header{
+				"Referer": []string{"https://twitter.com"},
+			},
+			expectedError: false,
+			expectedCode:  http.StatusTemporaryRedirect,
+			expectedBody:  "",
+		}
+		res, err = makeTestRequest(server, test)
+		checkResponse(t, test, res, err)
+	}
+
+	today := time.Now().UTC().Format("2006-01-02")
+	tests := []TestCase{
+		{
+			description:   "owner stats",
+			requestRoute:  "/api/user/urls/stats-link/stats",
+			requestMethod: http.MethodGet,
+			requestHeaders: http.Header{
+				"Cookie": []string{cookie},
+			},
+			expectedError: false,
+			expectedCode:  http.StatusOK,
+			expectedBody: fmt.Sprintf(
+				`{"short_id":"stats-link","total":2,"daily":[{"date":"%s","clicks":2}],`+
+					`"top_referrers":[{"referer":"https://twitter.com","clicks":2}]}`,
+				today,
+			),
+		},
+		{
+			description:   "not owner",
+			requestRoute:  "/api/user/urls/stats-link/stats",
+			requestMethod: http.MethodGet,
+			expectedError: false,
+			expectedCode:  http.StatusForbidden,
+			expectedBody:  `{"code":403,"message":"url belongs to another user"}`,
+		},
+		{
+			description:   "not found",
+			requestRoute:  "/api/user/urls/unknown-link/stats",
+			requestMethod: http.MethodGet,
+			expectedError: false,
+			expectedCode:  http.StatusNotFound,
+			expectedBody:  `{"code":404,"message":"url not found"}`,
+		},
+	}
+
+	// clicks are saved by the collector in background
+	waitForResponse(t, server, tests[0])
+
+	for _, test := range tests {
+		res, err := makeTestRequest(server, test)
+		checkResponse(t, test, res, err)
+	}
+}
+
+func TestPurgeURLsHandler(t *testing.T) {
+	server := getNewTestServer()
+
+	test := TestCase{
+		description:   "create url",
+		requestRoute:  "/api/shorten",
+		requestMethod: http.MethodPost,
+		requestBody:   `{"url":"https://github.com/purge","alias":"purge-link"}`,
+		requestHeaders: http.Header{
+			"Content-Type": []string{"application/json"},
+		},
+		expectedError: false,
+		expectedCode:  http.StatusCreated,
+		expectedBody:  "",
+	}
+	res, err := makeTestRequest(server, test)
+	checkResponse(t, test, res, err)
+
+	cookie := strings.Split(res.Header.Get("Set-Cookie"), ";")[0]
+	userID := strings.Split(strings.TrimPrefix(cookie, "SHORTENER_UID="), ":")[0]
+
+	test = TestCase{
+		description:   "delete url",
+		requestRoute:  "/api/user/urls",
+		requestMethod: http.MethodDelete,
+		requestBody:   `["purge-link"]`,
+		requestHeaders: http.Header{
+			"Content-Type": []string{"application/json"},
+			"Cookie":       []string{cookie},
+		},
+		expectedError: false,
+		expectedCode:  http.StatusAccepted,
+		expectedBody:  "",
+	}
+	res, err = makeTestRequest(server, test)
+	checkResponse(t, test, res, err)
+
+	tests := []TestCase{
+		{
+			description:   "removed url",
+			requestRoute:  "/purge-link",
+			requestMethod: http.MethodGet,
+			expectedError: false,
+			expectedCode:  http.StatusGone,
+			expectedBody:  "",
+		},
+		{
+			description:   "unauthorized purge",
+			requestRoute:  "/api/admin/purge",
+			requestMethod: http.MethodPost,
+			expectedError: false,
+			expectedCode:  http.StatusUnauthorized,
+			expectedBody:  `{"code":401,"message":"unauthorized"}`,
+		},
+		{
+			description:   "purge",
+			requestRoute:  "/api/admin/purge",
+			requestMethod: http.MethodPost,
+			requestBody:   fmt.Sprintf(`{"user_id":"%s"}`, userID),
+			requestHeaders: http.Header{
+				"Content-Type":  []string{"application/json"},
+				"Authorization": []string{"Bearer " + testAdminToken},
+			},
+			expectedError: false,
+			expectedCode:  http.StatusOK,
+			expectedBody:  `{"result":1}`,
+		},
+		{
+			description:   "purged url",
+			requestRoute:  "/purge-link",
+			requestMethod: http.MethodGet,
+			expectedError: false,
+			expectedCode:  http.StatusNotFound,
+			expectedBody:  "",
+		},
+	}
+
+	// urls are deleted by workers in background
+	waitForResponse(t, server, tests[0])
+
+	for _, test := range tests {
+		res, err := makeTestRequest(server, test)
+		checkResponse(t, test, res, err)
+	}
+}
+
+func TestErrorStatus(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected int
+	}{
+		{err: repository.ErrNotFound, expected: http.StatusNotFound},
+		{err: &repository.NotUniqueKeyError{}, expected: http.StatusConflict},
+		{err: &storage.NotUniqueError{}, expected: http.StatusConflict},
+		{err: fmt.Errorf("fetch stats: %w", repository.ErrForbidden), expected: http.StatusForbidden},
+		{err: &repository.UnavailableError{Err: errors.New("connection refused")}, expected: http.StatusServiceUnavailable},
+		{err: fiber.ErrRequestEntityTooLarge, expected: http.StatusRequestEntityTooLarge},
+		{err: fmt.Errorf("fetch urls: %w", context.Canceled), expected: statusClientClosedRequest},
+		{err: fmt.Errorf("fetch urls: %w", context.DeadlineExceeded), expected: http.StatusGatewayTimeout},
+		{err: errors.New("unknown"), expected: http.StatusInternalServerError},
+	}
+
+	for _, test := range tests {
+		assert.Equalf(t, test.expected, errorStatus(test.err), test.err.Error())
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	server := getNewTestServer()
+
+	_, err := makeTestRequest(server, TestCase{
+		requestRoute:  "/",
+		requestMethod: "POST",
+		requestBody:   "https://github.com/metrics",
+	})
+	assert.Nil(t, err)
+
+	res, err := makeTestRequest(server, TestCase{
+		requestRoute:  "/metrics",
+		requestMethod: "GET",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	body, err := ioutil.ReadAll(res.Body)
+	assert.Nil(t, err)
+
+	for _, name := range []string{
+		`shortener_http_requests_total{method="POST",route="/"`,
+		`shortener_created_links_total{source="text"}`,
+		`shortener_storage_operation_duration_seconds_count{backend="memory"`,
+		`shortener_delete_queue_depth 0`,
+	} {
+		assert.Contains(t, string(body), name)
+	}
+}
+
+func TestDeadTasksHandler(t *testing.T) {
+	server := getNewTestServer()
+
+	tests := []TestCase{
+		{
+			description:   "unauthorized dead tasks",
+			requestRoute:  "/api/admin/tasks/dead",
+			requestMethod: http.MethodGet,
+			expectedError: false,
+			expectedCode:  http.StatusUnauthorized,
+			expectedBody:  `{"code":401,"message":"unauthorized"}`,
+		},
+		{
+			description:   "dead tasks",
+			requestRoute:  "/api/admin/tasks/dead",
+			requestMethod: http.MethodGet,
+			requestHeaders: http.Header{
+				"Authorization": []string{"Bearer " + testAdminToken},
+			},
+			expectedError: false,
+			expectedCode:  http.StatusOK,
+			expectedBody:  `[]`,
+		},
+	}
+
+	for _, test := range tests {
+		res, err := makeTestRequest(server, test)
+		checkResponse(t, test, res, err)
+	}
+}
+
+func TestDeleteJobHandler(t *testing.T) {
+	server := getNewTestServer()
+
+	test := TestCase{
+		description:   "create url",
+		requestRoute:  "/api/shorten",
+		requestMethod: http.MethodPost,
+		requestBody:   `{"url":"https://github.com/job","alias":"job-link"}`,
+		requestHeaders: http.Header{
+			"Content-Type": []string{"application/json"},
+		},
+		expectedError: false,
+		expectedCode:  http.StatusCreated,
+		expectedBody:  "",
+	}
+	res, err := makeTestRequest(server, test)
+	checkResponse(t, test, res, err)
+
+	cookie := strings.Split(res.Header.Get("Set-Cookie"), ";")[0]
+
+	res, err = makeTestRequest(server, TestCase{
+		requestRoute:  "/api/user/urls",
+		requestMethod: http.MethodDelete,
+		requestBody:   `["job-link","unknown-link"]`,
+		requestHeaders: http.Header{
+			"Content-Type": []string{"application/json"},
+			"Cookie":       []string{cookie},
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusAccepted, res.StatusCode)
+
+	var accepted struct {
+		JobID string `json:"job_id"`
+	}
+	assert.Nil(t, json.NewDecoder(res.Body).Decode(&accepted))
+	assert.NotEmpty(t, accepted.JobID)
+
+	var job struct {
+		ID       string            `json:"id"`
+		Status   string            `json:"status"`
+		Outcomes map[string]string `json:"outcomes"`
+	}
+	assert.Eventually(t, func() bool {
+		res, err = makeTestRequest(server, TestCase{
+			requestRoute:   "/api/user/jobs/" + accepted.JobID,
+			requestMethod:  http.MethodGet,
+			requestHeaders: http.Header{"Cookie": []string{cookie}},
+		})
+		if err != nil || res.StatusCode != http.StatusOK {
+			return false
+		}
+		return json.NewDecoder(res.Body).Decode(&job) == nil && job.Status != "queued" && job.Status != "running"
+	}, testWaitTimeout, 10*time.Millisecond)
+	assert.Equal(t, accepted.JobID, job.ID)
+	assert.Equal(t, "done", job.Status)
+	assert.Equal(t, map[string]string{
+		"job-link":     "deleted",
+		"unknown-link": "not_found",
+	}, job.Outcomes)
+
+	tests := []TestCase{
+		{
+			description:   "job of another user",
+			requestRoute:  "/api/user/jobs/" + accepted.JobID,
+			requestMethod: http.MethodGet,
+			expectedError: false,
+			expectedCode:  http.StatusNotFound,
+			expectedBody:  `{"code":404,"message":"job not found"}`,
+		},
+		{
+			description:    "unknown job",
+			requestRoute:   "/api/user/jobs/unknown",
+			requestMethod:  http.MethodGet,
+			requestHeaders: http.Header{"Cookie": []string{cookie}},
+			expectedError:  false,
+			expectedCode:   http.StatusNotFound,
+			expectedBody:   `{"code":404,"message":"job not found"}`,
+		},
+	}
+
+	for _, test := range tests {
+		res, err := makeTestRequest(server, test)
+		checkResponse(t, test, res, err)
+	}
+}
+
+func TestRestoreURLsHandler(t *testing.T) {
+	server := getNewTestServer()
+
+	test := TestCase{
+		description:   "create url",
+		requestRoute:  "/api/shorten",
+		requestMethod: http.MethodPost,
+		requestBody:   `{"url":"https://github.com/restore","alias":"restore-link"}`,
+		requestHeaders: http.Header{
+			"Content-Type": []string{"application/json"},
+		},
+		expectedError: false,
+		expectedCode:  http.StatusCreated,
+		expectedBody:  "",
+	}
+	res, err := makeTestRequest(server, test)
+	checkResponse(t, test, res, err)
+
+	cookie := strings.Split(res.Header.Get("Set-Cookie"), ";")[0]
+	headers := func() http.Header {
+		return http.Header{
+			"Content-Type": []string{"application/json"},
+			"Cookie":       []string{cookie},
+		}
+	}
+
+	test = TestCase{
+		description:    "create kept url",
+		requestRoute:   "/api/shorten",
+		requestMethod:  http.MethodPost,
+		requestBody:    `{"url":"https://github.com/kept","alias":"kept-link"}`,
+		requestHeaders: headers(),
+		expectedError:  false,
+		expectedCode:   http.StatusCreated,
+		expectedBody:   "",
+	}
+	res, err = makeTestRequest(server, test)
+	checkResponse(t, test, res, err)
+
+	test = TestCase{
+		description:    "delete url",
+		requestRoute:   "/api/user/urls",
+		requestMethod:  http.MethodDelete,
+		requestBody:    `["restore-link"]`,
+		requestHeaders: headers(),
+		expectedError:  false,
+		expectedCode:   http.StatusAccepted,
+		expectedBody:   "",
+	}
+	res, err = makeTestRequest(server, test)
+	checkResponse(t, test, res, err)
+
+	// urls are deleted by workers in background
+	waitForResponse(t, server, TestCase{
+		description:    "deleted urls",
+		requestRoute:   "/api/user/urls?deleted=true",
+		requestMethod:  http.MethodGet,
+		requestHeaders: http.Header{"Cookie": []string{cookie}},
+		expectedCode:   http.StatusOK,
+	})
+
+	_, urls := fetchUserURLs(t, server, "/api/user/urls", cookie)
+	if assert.Equal(t, []string{"http:///kept-link"}, shortURLs(urls)) {
+		assert.NotNil(t, urls[0].CreatedAt)
+		assert.Nil(t, urls[0].DeletedAt)
+	}
+
+	_, urls = fetchUserURLs(t, server, "/api/user/urls?deleted=true", cookie)
+	if assert.Equal(t, []string{"http:///restore-link"}, shortURLs(urls)) {
+		assert.NotNil(t, urls[0].DeletedAt)
+		assert.False(t, urls[0].UpdatedAt.Before(*urls[0].CreatedAt))
+	}
+
+	tests := []TestCase{
+		{
+			description:    "invalid deleted flag",
+			requestRoute:   "/api/user/urls?deleted=maybe",
+			requestMethod:  http.MethodGet,
+			requestHeaders: headers(),
+			expectedError:  false,
+			expectedCode:   http.StatusBadRequest,
+			expectedBody:   `{"code":400,"message":"Please specify a valid deleted flag"}`,
+		},
+		{
+			description:    "empty restore request",
+			requestRoute:   "/api/user/urls/restore",
+			requestMethod:  http.MethodPost,
+			requestBody:    `[]`,
+			requestHeaders: headers(),
+			expectedError:  false,
+			expectedCode:   http.StatusBadRequest,
+			expectedBody:   `{"code":400,"message":"Please specify a valid restore request"}`,
+		},
+		{
+			description:   "restore by another user",
+			requestRoute:  "/api/user/urls/restore",
+			requestMethod: http.MethodPost,
+			requestBody:   `["restore-link"]`,
+			requestHeaders: http.Header{
+				"Content-Type": []string{"application/json"},
+			},
+			expectedError: false,
+			expectedCode:  http.StatusOK,
+			expectedBody:  `{"result":[]}`,
+		},
+		{
+			description:    "restore",
+			requestRoute:   "/api/user/urls/restore",
+			requestMethod:  http.MethodPost,
+			requestBody:    `["restore-link","unknown-link"]`,
+			requestHeaders: headers(),
+			expectedError:  false,
+			expectedCode:   http.StatusOK,
+			expectedBody:   `{"result":["restore-link"]}`,
+		},
+		{
+			description:   "restored url",
+			requestRoute:  "/restore-link",
+			requestMethod: http.MethodGet,
+			expectedError: false,
+			expectedCode:  http.StatusTemporaryRedirect,
+			expectedBody:  "",
+		},
+	}
+
+	for _, test := range tests {
+		res, err := makeTestRequest(server, test)
+		checkResponse(t, test, res, err)
+	}
+}
+
+func TestUserURLsPaginationHandler(t *testing.T) {
+	server := getNewTestServer()
+
+	test := TestCase{
+		description:   "create url",
+		requestRoute:  "/api/shorten",
+		requestMethod: http.MethodPost,
+		requestBody:   `{"url":"https://github.com/page/1","alias":"page-1"}`,
+		requestHeaders: http.Header{
+			"Content-Type": []string{"application/json"},
+		},
+		expectedError: false,
+		expectedCode:  http.StatusCreated,
+		expectedBody:  "",
+	}
+	res, err := makeTestRequest(server, test)
+	checkResponse(t, test, res, err)
+
+	cookie := strings.Split(res.Header.Get("Set-Cookie"), ";")[0]
+	headers := func() http.Header {
+		return http.Header{
+			"Content-Type": []string{"application/json"},
+			"Cookie":       []string{cookie},
+		}
+	}
+
+	for _, item := range []string{"2", "3"} {
+		time.Sleep(time.Millisecond)
+		test = TestCase{
+			description:    "create url " + item,
+			requestRoute:   "/api/shorten",
+			requestMethod:  http.MethodPost,
+			requestBody:    fmt.Sprintf(`{"url":"https://example.com/page/%s","alias":"page-%s"}`, item, item),
+			requestHeaders: headers(),
+			expectedError:  false,
+			expectedCode:   http.StatusCreated,
+			expectedBody:   "",
+		}
+		res, err = makeTestRequest(server, test)
+		checkResponse(t, test, res, err)
+	}
+
+	res, urls := fetchUserURLs(t, server, "/api/user/urls?limit=2&sort=-created_at", cookie)
+	assert.Equal(t, []string{"http:///page-3", "http:///page-2"}, shortURLs(urls))
+	assert.Equal(t, "3", res.Header.Get("X-Total-Count"))
+
+	cursor := res.Header.Get("X-Next-Cursor")
+	assert.NotEmpty(t, cursor)
+
+	res, urls = fetchUserURLs(t, server, "/api/user/urls?limit=2&sort=-created_at&cursor="+cursor, cookie)
+	assert.Equal(t, []string{"http:///page-1"}, shortURLs(urls))
+	assert.Empty(t, res.Header.Get("X-Next-Cursor"))
+
+	_, urls = fetchUserURLs(t, server, "/api/user/urls?domain=github.com", cookie)
+	assert.Equal(t, []string{"http:///page-1"}, shortURLs(urls))
+
+	_, urls = fetchUserURLs(t, server, "/api/user/urls?q=page/2", cookie)
+	assert.Equal(t, []string{"http:///page-2"}, shortURLs(urls))
+
+	tests := []TestCase{
+		{
+			description:    "invalid limit",
+			requestRoute:   "/api/user/urls?limit=5000",
+			requestMethod:  http.MethodGet,
+			requestHeaders: headers(),
+			expectedError:  false,
+			expectedCode:   http.StatusBadRequest,
+			expectedBody:   `{"code":400,"message":"invalid list request: limit must be between 1 and 1000"}`,
+		},
+		{
+			description:    "invalid sort",
+			requestRoute:   "/api/user/urls?sort=key",
+			requestMethod:  http.MethodGet,
+			requestHeaders: headers(),
+			expectedError:  false,
+			expectedCode:   http.StatusBadRequest,
+			expectedBody:   `{"code":400,"message":"invalid list request: unknown sort key"}`,
+		},
+		{
+			description:    "invalid cursor",
+			requestRoute:   "/api/user/urls?cursor=broken",
+			requestMethod:  http.MethodGet,
+			requestHeaders: headers(),
+			expectedError:  false,
+			expectedCode:   http.StatusBadRequest,
+			expectedBody:   `{"code":400,"message":"invalid list request: malformed cursor"}`,
+		},
+	}
+
+	for _, test := range tests {
+		res, err := makeTestRequest(server, test)
+		checkResponse(t, test, res, err)
+	}
+}
+
+func TestUpdateURLHandler(t *testing.T) {
+	server := getNewTestServer()
+
+	test := TestCase{
+		description:   "create url",
+		requestRoute:  "/api/shorten",
+		requestMethod: http.MethodPost,
+		requestBody:   `{"url":"https://github.com/edit/1","alias":"edit-link"}`,
+		requestHeaders: http.Header{
+			"Content-Type": []string{"application/json"},
+		},
+		expectedError: false,
+		expectedCode:  http.StatusCreated,
+		expectedBody:  "",
+	}
+	res, err := makeTestRequest(server, test)
+	checkResponse(t, test, res, err)
+
+	cookie := strings.Split(res.Header.Get("Set-Cookie"), ";")[0]
+	headers := func() http.Header {
+		return http.Header{
+			"Content-Type": []string{"application/json"},
+			"Cookie":       []string{cookie},
+		}
+	}
+
+	tests := []TestCase{
+		{
+			description:    "create other url",
+			requestRoute:   "/api/shorten",
+			requestMethod:  http.MethodPost,
+			requestBody:    `{"url":"https://github.com/edit/other","alias":"edit-other"}`,
+			requestHeaders: headers(),
+			expectedError:  false,
+			expectedCode:   http.StatusCreated,
+			expectedBody:   "",
+		},
+		{
+			description:   "update by another user",
+			requestRoute:  "/api/user/urls/edit-link",
+			requestMethod: http.MethodPatch,
+			requestBody:   `{"url":"https://github.com/edit/2"}`,
+			requestHeaders: http.Header{
+				"Content-Type": []string{"application/json"},
+			},
+			expectedError: false,
+			expectedCode:  http.StatusForbidden,
+			expectedBody:  `{"code":403,"message":"url belongs to another user"}`,
+		},
+		{
+			description:    "update unknown url",
+			requestRoute:   "/api/user/urls/edit-unknown",
+			requestMethod:  http.MethodPatch,
+			requestBody:    `{"url":"https://github.com/edit/2"}`,
+			requestHeaders: headers(),
+			expectedError:  false,
+			expectedCode:   http.StatusNotFound,
+			expectedBody:   `{"code":404,"message":"url not found"}`,
+		},
+		{
+			description:    "empty update",
+			requestRoute:   "/api/user/urls/edit-link",
+			requestMethod:  http.MethodPatch,
+			requestBody:    `{}`,
+			requestHeaders: headers(),
+			expectedError:  false,
+			expectedCode:   http.StatusBadRequest,
+			expectedBody:   `{"code":400,"message":"Please specify a valid full url"}`,
+		},
+		{
+			description:    "update to duplicate",
+			requestRoute:   "/api/user/urls/edit-link",
+			requestMethod:  http.MethodPatch,
+			requestBody:    `{"url":"https://github.com/edit/other"}`,
+			requestHeaders: headers(),
+			expectedError:  false,
+			expectedCode:   http.StatusConflict,
+			expectedBody:   `{"result":"http:///edit-other"}`,
+		},
+		{
+			description:    "update",
+			requestRoute:   "/api/user/urls/edit-link",
+			requestMethod:  http.MethodPatch,
+			requestBody:    `{"url":"https://github.com/edit/2"}`,
+			requestHeaders: headers(),
+			expectedError:  false,
+			expectedCode:   http.StatusOK,
+			expectedBody:   `{"result":"http:///edit-link"}`,
+		},
+	}
+
+	for _, test := range tests {
+		res, err := makeTestRequest(server, test)
+		checkResponse(t, test, res, err)
+	}
+
+	res, err = makeTestRequest(server, TestCase{requestRoute: "/edit-link", requestMethod: http.MethodGet})
+	assert.Nil(t, err)
+	assert.Equal(t, "https://github.com/edit/2", res.Header.Get("Location"))
+
+	res, err = makeTestRequest(server, TestCase{
+		requestRoute:   "/api/user/urls/edit-link/revisions",
+		requestMethod:  http.MethodGet,
+		requestHeaders: headers(),
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	var revisions []struct {
+		Version int    `json:"version"`
+		FullURL string `json:"original_url"`
+	}
+	assert.Nil(t, json.NewDecoder(res.Body).Decode(&revisions))
+	if assert.Len(t, revisions, 2) {
+		assert.Equal(t, 1, revisions[0].Version)
+		assert.Equal(t, "https://github.com/edit/1", revisions[0].FullURL)
+		assert.Equal(t, 2, revisions[1].Version)
+		assert.Equal(t, "https://github.com/edit/2", revisions[1].FullURL)
+	}
+
+	tests = []TestCase{
+		{
+			description:    "rollback to unknown revision",
+			requestRoute:   "/api/user/urls/edit-link/rollback",
+			requestMethod:  http.MethodPost,
+			requestBody:    `{"version":9}`,
+			requestHeaders: headers(),
+			expectedError:  false,
+			expectedCode:   http.StatusNotFound,
+			expectedBody:   `{"code":404,"message":"revision not found"}`,
+		},
+		{
+			description:    "invalid rollback",
+			requestRoute:   "/api/user/urls/edit-link/rollback",
+			requestMethod:  http.MethodPost,
+			requestBody:    `{"version":0}`,
+			requestHeaders: headers(),
+			expectedError:  false,
+			expectedCode:   http.StatusBadRequest,
+			expectedBody:   `{"code":400,"message":"Please specify a valid rollback request"}`,
+		},
+		{
+			description:    "rollback",
+			requestRoute:   "/api/user/urls/edit-link/rollback",
+			requestMethod:  http.MethodPost,
+			requestBody:    `{"version":1}`,
+			requestHeaders: headers(),
+			expectedError:  false,
+			expectedCode:   http.StatusOK,
+			expectedBody:   `{"result":"http:///edit-link"}`,
+		},
+	}
+
+	for _, test := range tests {
+		res, err := makeTestRequest(server, test)
+		checkResponse(t, test, res, err)
+	}
+
+	res, err = makeTestRequest(server, TestCase{requestRoute: "/edit-link", requestMethod: http.MethodGet})
+	assert.Nil(t, err)
+	assert.Equal(t, "https://github.com/edit/1", res.Header.Get("Location"))
+}
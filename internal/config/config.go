@@ -2,6 +2,7 @@ package config
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
 	"time"
 
@@ -9,24 +10,80 @@ import (
 )
 
 type Storage struct {
-	FileStoragePath   string        `envconfig:"FILE_STORAGE_PATH"`
-	DatabaseDSN       string        `envconfig:"DATABASE_DSN"`
-	ConnectionTimeout time.Duration `envconfig:"STORAGE_CONNECTION_TIMEOUT" default:"3s"`
-	StopTimeout       time.Duration `envconfig:"STORAGE_STOP_TIMEOUT" default:"3s"`
+	FileStoragePath    string        `envconfig:"FILE_STORAGE_PATH"`
+	DatabaseDSN        string        `envconfig:"DATABASE_DSN"`
+	ConnectionTimeout  time.Duration `envconfig:"STORAGE_CONNECTION_TIMEOUT" default:"3s"`
+	StopTimeout        time.Duration `envconfig:"STORAGE_STOP_TIMEOUT" default:"3s"`
+	RemovedRetention   time.Duration `envconfig:"STORAGE_REMOVED_RETENTION" default:"720h"`
+	RestoreGracePeriod time.Duration `envconfig:"STORAGE_RESTORE_GRACE_PERIOD" default:"168h"`
+	DedupScope         string        `envconfig:"STORAGE_DEDUP_SCOPE" default:"global"`
+	AutoMigrate        bool          `envconfig:"STORAGE_AUTO_MIGRATE" default:"true"`
+
+	CacheSize        int           `envconfig:"STORAGE_CACHE_SIZE" default:"0"`
+	CacheTTL         time.Duration `envconfig:"STORAGE_CACHE_TTL" default:"1m"`
+	CacheNegativeTTL time.Duration `envconfig:"STORAGE_CACHE_NEGATIVE_TTL" default:"5s"`
+
+	CompactionInterval time.Duration `envconfig:"FILE_STORAGE_COMPACTION_INTERVAL" default:"10m"`
+	CompactionMinSize  int64         `envconfig:"FILE_STORAGE_COMPACTION_MIN_SIZE" default:"1048576"`
+	CompactionRatio    float64       `envconfig:"FILE_STORAGE_COMPACTION_RATIO" default:"2"`
+	SyncMode           string        `envconfig:"FILE_STORAGE_SYNC_MODE" default:"interval"`
+	SyncInterval       time.Duration `envconfig:"FILE_STORAGE_SYNC_INTERVAL" default:"1s"`
+	RecoveryMode       string        `envconfig:"FILE_STORAGE_RECOVERY_MODE" default:"truncate"`
+}
+
+type ShortID struct {
+	Generator string `envconfig:"SHORT_ID_GENERATOR" default:"random"`
+	Alphabet  string `envconfig:"SHORT_ID_ALPHABET" default:"base62"`
+	Length    int    `envconfig:"SHORT_ID_LENGTH" default:"8"`
+}
+
+type Analytics struct {
+	BufferSize    int           `envconfig:"ANALYTICS_BUFFER_SIZE" default:"1024"`
+	BatchSize     int           `envconfig:"ANALYTICS_BATCH_SIZE" default:"100"`
+	FlushInterval time.Duration `envconfig:"ANALYTICS_FLUSH_INTERVAL" default:"1s"`
+}
+
+type Tracing struct {
+	Exporter     string  `envconfig:"TRACING_EXPORTER" default:"none"`
+	FilePath     string  `envconfig:"TRACING_FILE_PATH" default:"traces.json"`
+	OTLPEndpoint string  `envconfig:"TRACING_OTLP_ENDPOINT" default:"localhost:4318"`
+	OTLPInsecure bool    `envconfig:"TRACING_OTLP_INSECURE" default:"true"`
+	SampleRatio  float64 `envconfig:"TRACING_SAMPLE_RATIO" default:"1"`
+}
+
+type DeleteQueue struct {
+	Persistent    bool          `envconfig:"DELETE_QUEUE_PERSISTENT" default:"true"`
+	DrainTimeout  time.Duration `envconfig:"DELETE_QUEUE_DRAIN_TIMEOUT" default:"10s"`
+	Workers       int           `envconfig:"DELETE_QUEUE_WORKERS" default:"0"`
+	BatchSize     int           `envconfig:"DELETE_QUEUE_BATCH_SIZE" default:"1000"`
+	FlushInterval time.Duration `envconfig:"DELETE_QUEUE_FLUSH_INTERVAL" default:"50ms"`
+
+	MaxRetries      int           `envconfig:"DELETE_QUEUE_MAX_RETRIES" default:"5"`
+	RetryBackoff    time.Duration `envconfig:"DELETE_QUEUE_RETRY_BACKOFF" default:"100ms"`
+	RetryMaxBackoff time.Duration `envconfig:"DELETE_QUEUE_RETRY_MAX_BACKOFF" default:"5s"`
+	DeadLetterSize  int           `envconfig:"DELETE_QUEUE_DEAD_LETTER_SIZE" default:"1000"`
+	JobRetention    time.Duration `envconfig:"DELETE_QUEUE_JOB_RETENTION" default:"24h"`
 }
 
 type Config struct {
-	ServiceName      string `envconfig:"SERVICE_NAME" default:"shortener"`
-	BaseURL          string `envconfig:"BASE_URL"`
-	UserCookieSecret string `envconfig:"USER_COOKIE_SECRET" default:"secret"`
-	UserContextKey   string `envconfig:"USER_CONTEXT_KEY" default:"userid"`
+	ServiceName      string        `envconfig:"SERVICE_NAME" default:"shortener"`
+	BaseURL          string        `envconfig:"BASE_URL"`
+	UserCookieSecret string        `envconfig:"USER_COOKIE_SECRET" default:"secret"`
+	UserContextKey   string        `envconfig:"USER_CONTEXT_KEY" default:"userid"`
+	AdminToken       string        `envconfig:"ADMIN_TOKEN"`
+	ReaperInterval   time.Duration `envconfig:"REAPER_INTERVAL" default:"1m"`
 	Server           struct {
-		Listen      string        `envconfig:"SERVER_ADDRESS"  default:":8080"`
-		ReadTimeout time.Duration `envconfig:"SERVER_READ_TIMEOUT" default:"5s"`
-		IdleTimeout time.Duration `envconfig:"SERVER_IDLE_TIMEOUT" default:"5s"`
+		Listen         string        `envconfig:"SERVER_ADDRESS"  default:":8080"`
+		ReadTimeout    time.Duration `envconfig:"SERVER_READ_TIMEOUT" default:"5s"`
+		IdleTimeout    time.Duration `envconfig:"SERVER_IDLE_TIMEOUT" default:"5s"`
+		RequestTimeout time.Duration `envconfig:"SERVER_REQUEST_TIMEOUT" default:"10s"`
 	}
-	Storage *Storage
-	Logger  struct {
+	Storage     *Storage
+	ShortID     *ShortID
+	Analytics   *Analytics
+	Tracing     *Tracing
+	DeleteQueue *DeleteQueue
+	Logger      struct {
 		Level  string `envconfig:"LOG_LEVEL" default:"info"`
 		Output string `envconfig:"LOG_OUTPUT" default:"stdout"`
 		Format string `envconfig:"LOG_FORMAT" default:"text"`
@@ -48,9 +105,23 @@ func New() (*Config, error) {
 	flag.StringVar(&cfg.Storage.DatabaseDSN, "d", cfg.Storage.DatabaseDSN, "database dsn. env: DATABASE_DSN")
 	flag.Parse()
 
+	if err = cfg.validate(); err != nil {
+		return nil, err
+	}
 	return cfg, nil
 }
 
+// validate checks values which would break background jobs at start
+func (c *Config) validate() error {
+	if c.ReaperInterval <= 0 {
+		return errors.New("reaper interval must be positive")
+	}
+	if c.Analytics.FlushInterval <= 0 {
+		return errors.New("analytics flush interval must be positive")
+	}
+	return nil
+}
+
 func (c *Config) String() string {
 	if out, err := json.MarshalIndent(&c, "", "  "); err == nil {
 		return string(out)
@@ -0,0 +1,193 @@
+package metrics
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/valyala/fasthttp/fasthttpadaptor"
+)
+
+// Metrics keeps prometheus collectors of the service, every instance has
+// its own registry, so several servers can live in one process
+type Metrics struct {
+	namespace string
+	registry  *prometheus.Registry
+
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	redirects       *prometheus.CounterVec
+	createdLinks    *prometheus.CounterVec
+	deletions       prometheus.Counter
+	storageDuration *prometheus.HistogramVec
+}
+
+func New(namespace string) *Metrics {
+	m := &Metrics{
+		namespace: namespace,
+		registry:  prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "http_requests_total",
+			Help:      "Number of http requests by route and status.",
+		}, []string{"method", "route", "status"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "Latency of http requests by route.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method", "route"}),
+		redirects: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "redirects_total",
+			Help:      "Number of redirects by result.",
+		}, []string{"result"}),
+		createdLinks: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "created_links_total",
+			Help:      "Number of created short links by source.",
+		}, []string{"source"}),
+		deletions: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "processed_deletions_total",
+			Help:      "Number of short ids processed by delete workers.",
+		}),
+		storageDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "storage_operation_duration_seconds",
+			Help:      "Latency of storage operations by backend and operation.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"backend", "operation", "status"}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.requests,
+		m.requestDuration,
+		m.redirects,
+		m.createdLinks,
+		m.deletions,
+		m.storageDuration,
+	)
+	return m
+}
+
+// Register adds collectors of other components, e.g. gauges
+// which read their values on scrape
+func (m *Metrics) Register(cs ...prometheus.Collector) {
+	m.registry.MustRegister(cs...)
+}
+
+// Middleware counts requests and observes their latency,
+// route label is the registered path, so ids don't blow up cardinality
+func (m *Metrics) Middleware() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		start := time.Now()
+		err := c.Next()
+
+		status := c.Response().StatusCode()
+		if err != nil {
+			if e, ok := err.(*fiber.Error); ok {
+				status = e.Code
+			} else {
+				status = fiber.StatusInternalServerError
+			}
+		}
+
+		route := c.Route().Path
+		m.requests.WithLabelValues(c.Method(), route, strconv.Itoa(status)).Inc()
+		m.requestDuration.WithLabelValues(c.Method(), route).Observe(time.Since(start).Seconds())
+		return err
+	}
+}
+
+// Handler serves metrics in prometheus text format
+func (m *Metrics) Handler() fiber.Handler {
+	handler := fasthttpadaptor.NewFastHTTPHandler(
+		promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}),
+	)
+	return func(c *fiber.Ctx) error {
+		handler(c.Context())
+		return nil
+	}
+}
+
+func (m *Metrics) IncRedirect(result string) {
+	m.redirects.WithLabelValues(result).Inc()
+}
+
+func (m *Metrics) AddCreatedLinks(source string, total int) {
+	m.createdLinks.WithLabelValues(source).Add(float64(total))
+}
+
+func (m *Metrics) AddDeletions(total int) {
+	m.deletions.Add(float64(total))
+}
+
+func (m *Metrics) ObserveOperation(backend string, operation string, duration time.Duration, err error) {
+	status := "ok"
+	if err != nil {
+		status = "error"
+	}
+	m.storageDuration.WithLabelValues(backend, operation, status).Observe(duration.Seconds())
+}
+
+// RegisterCache exposes hits and misses of the storage cache,
+// values are read from the stats on every scrape
+func (m *Metrics) RegisterCache(stats func() (hits uint64, misses uint64)) {
+	m.Register(
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: m.namespace,
+			Name:      "cache_hits_total",
+			Help:      "Number of storage cache hits.",
+		}, func() float64 {
+			hits, _ := stats()
+			return float64(hits)
+		}),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: m.namespace,
+			Name:      "cache_misses_total",
+			Help:      "Number of storage cache misses.",
+		}, func() float64 {
+			_, misses := stats()
+			return float64(misses)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: m.namespace,
+			Name:      "cache_hit_ratio",
+			Help:      "Ratio of storage cache hits to all lookups.",
+		}, func() float64 {
+			hits, misses := stats()
+			if hits+misses == 0 {
+				return 0
+			}
+			return float64(hits) / float64(hits+misses)
+		}),
+	)
+}
+
+// RegisterQueue exposes number of tasks waiting in the delete queue
+func (m *Metrics) RegisterQueue(depth func() int) {
+	m.Register(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: m.namespace,
+		Name:      "delete_queue_depth",
+		Help:      "Number of delete tasks waiting in the queue.",
+	}, func() float64 {
+		return float64(depth())
+	}))
+}
+
+// RegisterDroppedClicks exposes number of clicks dropped by the collector
+func (m *Metrics) RegisterDroppedClicks(dropped func() uint64) {
+	m.Register(prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: m.namespace,
+		Name:      "dropped_clicks_total",
+		Help:      "Number of clicks dropped because of the full buffer.",
+	}, func() float64 {
+		return float64(dropped())
+	}))
+}
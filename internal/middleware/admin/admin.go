@@ -0,0 +1,36 @@
+package admin
+
+import (
+	"crypto/subtle"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const bearerPrefix = "Bearer "
+
+// New creates a new middleware handler, all requests are rejected
+// when token is not configured
+func New(config ...Config) fiber.Handler {
+	// Set default config
+	cfg := configDefault(config...)
+
+	// Return new handler
+	return func(c *fiber.Ctx) error {
+		// Don't execute middleware if Next returns true
+		if cfg.Next != nil && cfg.Next(c) {
+			return c.Next()
+		}
+
+		if cfg.Token == "" {
+			return cfg.Unauthorized(c)
+		}
+
+		expected := []byte(bearerPrefix + cfg.Token)
+		if subtle.ConstantTimeCompare([]byte(c.Get(cfg.Header)), expected) != 1 {
+			return cfg.Unauthorized(c)
+		}
+
+		// Continue stack
+		return c.Next()
+	}
+}
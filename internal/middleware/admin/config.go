@@ -0,0 +1,46 @@
+package admin
+
+import (
+	"github.com/gofiber/fiber/v2"
+)
+
+type Config struct {
+	Next         func(c *fiber.Ctx) bool
+	Header       string
+	Token        string
+	Unauthorized fiber.Handler
+}
+
+// ConfigDefault is the default config
+var ConfigDefault = Config{
+	Next:         nil,
+	Header:       fiber.HeaderAuthorization,
+	Token:        "",
+	Unauthorized: unauthorized,
+}
+
+func unauthorized(c *fiber.Ctx) error {
+	return c.SendStatus(fiber.StatusUnauthorized)
+}
+
+// Helper function to set default values
+func configDefault(config ...Config) Config {
+	// Return default config if nothing provided
+	if len(config) < 1 {
+		return ConfigDefault
+	}
+
+	// Override default config
+	cfg := config[0]
+
+	// Set default values
+	if cfg.Header == "" {
+		cfg.Header = ConfigDefault.Header
+	}
+
+	if cfg.Unauthorized == nil {
+		cfg.Unauthorized = ConfigDefault.Unauthorized
+	}
+
+	return cfg
+}
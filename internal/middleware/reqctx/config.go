@@ -0,0 +1,30 @@
+package reqctx
+
+import (
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type Config struct {
+	Next    func(c *fiber.Ctx) bool
+	Timeout time.Duration
+}
+
+// ConfigDefault is the default config
+var ConfigDefault = Config{
+	Next:    nil,
+	Timeout: 0,
+}
+
+func configDefault(config ...Config) Config {
+	// Return default config if nothing provided
+	if len(config) < 1 {
+		return ConfigDefault
+	}
+
+	// Override default config
+	cfg := config[0]
+
+	return cfg
+}
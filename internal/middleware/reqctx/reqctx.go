@@ -0,0 +1,40 @@
+package reqctx
+
+import (
+	"context"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// New creates a new middleware handler, which sets the user context of the
+// request to a context derived from the fasthttp request context, so it is
+// cancelled on server shutdown and after the timeout when it is set
+func New(config ...Config) fiber.Handler {
+	// Set default config
+	cfg := configDefault(config...)
+
+	// Return new handler
+	return func(c *fiber.Ctx) error {
+		// Don't execute middleware if Next returns true
+		if cfg.Next != nil && cfg.Next(c) {
+			return c.Next()
+		}
+
+		var (
+			ctx    context.Context
+			cancel context.CancelFunc
+		)
+
+		if cfg.Timeout > 0 {
+			ctx, cancel = context.WithTimeout(c.Context(), cfg.Timeout)
+		} else {
+			ctx, cancel = context.WithCancel(c.Context())
+		}
+		defer cancel()
+
+		c.SetUserContext(ctx)
+
+		// Continue stack
+		return c.Next()
+	}
+}
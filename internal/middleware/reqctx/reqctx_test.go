@@ -0,0 +1,55 @@
+package reqctx
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+)
+
+func newTestApp(config ...Config) *fiber.App {
+	app := fiber.New()
+
+	app.Use(New(config...))
+
+	app.Get("/", func(c *fiber.Ctx) error {
+		if _, ok := c.UserContext().Deadline(); !ok {
+			return c.SendString("without deadline")
+		}
+		return c.SendString("with deadline")
+	})
+	app.Get("/slow", func(c *fiber.Ctx) error {
+		<-c.UserContext().Done()
+		return c.Status(fiber.StatusServiceUnavailable).SendString(c.UserContext().Err().Error())
+	})
+	return app
+}
+
+func Test_ReqCtx_Without_Timeout(t *testing.T) {
+	app := newTestApp()
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/", nil))
+	utils.AssertEqual(t, nil, err, "app.Test(req)")
+	utils.AssertEqual(t, 200, resp.StatusCode, "Status code")
+
+	body := make([]byte, 16)
+	n, _ := resp.Body.Read(body)
+	utils.AssertEqual(t, "without deadline", string(body[:n]), "Body")
+}
+
+func Test_ReqCtx_With_Timeout(t *testing.T) {
+	app := newTestApp(Config{Timeout: 10 * time.Millisecond})
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/", nil))
+	utils.AssertEqual(t, nil, err, "app.Test(req)")
+
+	body := make([]byte, 16)
+	n, _ := resp.Body.Read(body)
+	utils.AssertEqual(t, "with deadline", string(body[:n]), "Body")
+
+	resp, err = app.Test(httptest.NewRequest("GET", "/slow", nil))
+	utils.AssertEqual(t, nil, err, "app.Test(req)")
+	utils.AssertEqual(t, 503, resp.StatusCode, "Status code")
+}
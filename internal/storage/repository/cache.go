@@ -0,0 +1,296 @@
+package repository
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type CacheOptions struct {
+	Size        int
+	TTL         time.Duration
+	NegativeTTL time.Duration
+}
+
+func (o *CacheOptions) validate() error {
+	if o.Size <= 0 {
+		return errors.New("cache size must be positive")
+	}
+	if o.TTL <= 0 {
+		return errors.New("cache ttl must be positive")
+	}
+	return nil
+}
+
+type cacheEntry struct {
+	key       string
+	record    *Record
+	expiresAt time.Time
+}
+
+// cacheLoad is a generation of the key with read-through loads in progress,
+// invalidation of the key bumps the generation, so stale loads aren't cached
+type cacheLoad struct {
+	generation uint64
+	loads      int
+}
+
+// cacheRepository is a read-through cache of records by key on top of
+// another repository, records are evicted by size (LRU) and by ttl.
+// Unknown keys are cached as well when negative ttl is set.
+type cacheRepository struct {
+	StorageRepository
+
+	opts    CacheOptions
+	mu      *sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	pending map[string]*cacheLoad
+	hits    uint64
+	misses  uint64
+}
+
+func NewCacheRepository(r StorageRepository, opts CacheOptions) (StorageRepository, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+
+	return &cacheRepository{
+		StorageRepository: r,
+		opts:              opts,
+		mu:                &sync.Mutex{},
+		entries:           make(map[string]*list.Element, opts.Size),
+		lru:               list.New(),
+		pending:           make(map[string]*cacheLoad),
+	}, nil
+}
+
+// get returns a copy of cached record, so callers can't change the cache
+func (r *cacheRepository) get(key string, now time.Time) (*Record, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	element, ok := r.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	entry := element.Value.(*cacheEntry)
+	if !entry.expiresAt.After(now) {
+		r.lru.Remove(element)
+		delete(r.entries, key)
+		return nil, false
+	}
+
+	r.lru.MoveToFront(element)
+	if entry.record == nil {
+		return nil, true
+	}
+
+	record := *entry.record
+	return &record, true
+}
+
+// load registers read-through load of the key and returns its generation
+func (r *cacheRepository) load(key string) uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	pending, ok := r.pending[key]
+	if !ok {
+		pending = &cacheLoad{}
+		r.pending[key] = pending
+	}
+	pending.loads++
+	return pending.generation
+}
+
+// fill finishes the load of the key and caches the loaded record unless
+// the key was invalidated during the load, zero ttl doesn't cache anything
+func (r *cacheRepository) fill(
+	key string,
+	generation uint64,
+	record *Record,
+	ttl time.Duration,
+	now time.Time,
+) {
+	if record != nil {
+		value := *record
+		record = &value
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	pending := r.pending[key]
+	pending.loads--
+	if pending.loads == 0 {
+		delete(r.pending, key)
+	}
+	if pending.generation != generation || ttl <= 0 {
+		return
+	}
+
+	entry := &cacheEntry{key: key, record: record, expiresAt: now.Add(ttl)}
+	if element, ok := r.entries[key]; ok {
+		element.Value = entry
+		r.lru.MoveToFront(element)
+		return
+	}
+
+	r.entries[key] = r.lru.PushFront(entry)
+	for r.lru.Len() > r.opts.Size {
+		oldest := r.lru.Back()
+		r.lru.Remove(oldest)
+		delete(r.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+func (r *cacheRepository) invalidate(keys ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, key := range keys {
+		if element, ok := r.entries[key]; ok {
+			r.lru.Remove(element)
+			delete(r.entries, key)
+		}
+		if pending, ok := r.pending[key]; ok {
+			pending.generation++
+		}
+	}
+}
+
+func (r *cacheRepository) invalidateRecords(records ...*Record) {
+	keys := make([]string, 0, len(records))
+	for _, record := range records {
+		keys = append(keys, record.Key)
+	}
+	r.invalidate(keys...)
+}
+
+func (r *cacheRepository) clear() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.entries = make(map[string]*list.Element, r.opts.Size)
+	r.lru.Init()
+	for _, pending := range r.pending {
+		pending.generation++
+	}
+}
+
+func (r *cacheRepository) GetByKey(ctx context.Context, key string) (*Record, error) {
+	now := time.Now()
+	if record, ok := r.get(key, now); ok {
+		atomic.AddUint64(&r.hits, 1)
+		if record == nil {
+			return nil, ErrNotFound
+		}
+		return record, nil
+	}
+	atomic.AddUint64(&r.misses, 1)
+
+	generation := r.load(key)
+	record, err := r.StorageRepository.GetByKey(ctx, key)
+	switch {
+	case err == nil:
+		r.fill(key, generation, record, r.opts.TTL, now)
+	case errors.Is(err, ErrNotFound):
+		r.fill(key, generation, nil, r.opts.NegativeTTL, now)
+	default:
+		r.fill(key, generation, nil, 0, now)
+	}
+	return record, err
+}
+
+// Save and other creating methods drop negative entries of new keys
+
+func (r *cacheRepository) Save(ctx context.Context, record *Record) error {
+	defer r.invalidateRecords(record)
+	return r.StorageRepository.Save(ctx, record)
+}
+
+func (r *cacheRepository) SaveOrGet(
+	ctx context.Context,
+	record *Record,
+	dedupScope string,
+) (*Record, bool, error) {
+	defer r.invalidateRecords(record)
+	return r.StorageRepository.SaveOrGet(ctx, record, dedupScope)
+}
+
+func (r *cacheRepository) SaveBatchOfURL(ctx context.Context, records []*Record) error {
+	defer r.invalidateRecords(records...)
+	return r.StorageRepository.SaveBatchOfURL(ctx, records)
+}
+
+func (r *cacheRepository) SaveOrGetBatch(
+	ctx context.Context,
+	records []*Record,
+	dedupScope string,
+) ([]*Record, error) {
+	defer r.invalidateRecords(records...)
+	return r.StorageRepository.SaveOrGetBatch(ctx, records, dedupScope)
+}
+
+func (r *cacheRepository) UpdateValue(
+	ctx context.Context,
+	userID string,
+	key string,
+	value string,
+	dedupScope string,
+	now time.Time,
+) (*Record, error) {
+	defer r.invalidate(key)
+	return r.StorageRepository.UpdateValue(ctx, userID, key, value, dedupScope, now)
+}
+
+func (r *cacheRepository) DeleteByUserID(ctx context.Context, userID string, keys []string) error {
+	defer r.invalidate(keys...)
+	return r.StorageRepository.DeleteByUserID(ctx, userID, keys)
+}
+
+func (r *cacheRepository) Restore(
+	ctx context.Context,
+	userID string,
+	keys []string,
+	deletedAfter time.Time,
+	now time.Time,
+) ([]string, error) {
+	defer r.invalidate(keys...)
+	return r.StorageRepository.Restore(ctx, userID, keys, deletedAfter, now)
+}
+
+// DeleteExpired and Purge don't report changed keys, so the whole cache is dropped
+
+func (r *cacheRepository) DeleteExpired(ctx context.Context, now time.Time) (int, error) {
+	total, err := r.StorageRepository.DeleteExpired(ctx, now)
+	if total > 0 {
+		r.clear()
+	}
+	return total, err
+}
+
+func (r *cacheRepository) Purge(ctx context.Context, userID string, before time.Time) (int, error) {
+	total, err := r.StorageRepository.Purge(ctx, userID, before)
+	if total > 0 {
+		r.clear()
+	}
+	return total, err
+}
+
+func (r *cacheRepository) Stats() *Stats {
+	stats := r.StorageRepository.Stats()
+	stats.CacheHits = atomic.LoadUint64(&r.hits)
+	stats.CacheMisses = atomic.LoadUint64(&r.misses)
+
+	r.mu.Lock()
+	stats.CacheEntries = r.lru.Len()
+	r.mu.Unlock()
+
+	return stats
+}
@@ -0,0 +1,144 @@
+package repository
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestCacheRepository(t *testing.T, opts CacheOptions) StorageRepository {
+	inner, _ := NewMemoryRepository()
+	r, err := NewCacheRepository(inner, opts)
+	assert.Nil(t, err)
+	return r
+}
+
+func TestCacheRepositoryReadThrough(t *testing.T) {
+	ctx := context.Background()
+	r := newTestCacheRepository(t, CacheOptions{Size: 10, TTL: time.Minute, NegativeTTL: time.Minute})
+
+	assert.Nil(t, r.Save(ctx, &Record{Key: "first", Value: "https://github.com/1", UserID: "user"}))
+
+	for i := 0; i < 3; i++ {
+		record, err := r.GetByKey(ctx, "first")
+		assert.Nil(t, err)
+		assert.Equal(t, "https://github.com/1", record.Value)
+	}
+
+	stats := r.Stats()
+	assert.Equal(t, uint64(2), stats.CacheHits)
+	assert.Equal(t, uint64(1), stats.CacheMisses)
+	assert.Equal(t, 1, stats.CacheEntries)
+
+	assert.Nil(t, r.DeleteByUserID(ctx, "user", []string{"first"}))
+	record, err := r.GetByKey(ctx, "first")
+	assert.Nil(t, err)
+	assert.True(t, record.Removed)
+}
+
+func TestCacheRepositoryNegative(t *testing.T) {
+	ctx := context.Background()
+	r := newTestCacheRepository(t, CacheOptions{Size: 10, TTL: time.Minute, NegativeTTL: time.Minute})
+
+	_, err := r.GetByKey(ctx, "unknown")
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = r.GetByKey(ctx, "unknown")
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.Equal(t, uint64(1), r.Stats().CacheHits)
+
+	_, _, err = r.SaveOrGet(ctx, &Record{Key: "unknown", Value: "https://github.com/1"}, DedupGlobal)
+	assert.Nil(t, err)
+
+	record, err := r.GetByKey(ctx, "unknown")
+	assert.Nil(t, err)
+	assert.Equal(t, "https://github.com/1", record.Value)
+}
+
+func TestCacheRepositoryEviction(t *testing.T) {
+	ctx := context.Background()
+	r := newTestCacheRepository(t, CacheOptions{Size: 2, TTL: time.Minute})
+
+	assert.Nil(t, r.SaveBatchOfURL(ctx, []*Record{
+		{Key: "first", Value: "https://github.com/1"},
+		{Key: "second", Value: "https://github.com/2"},
+		{Key: "third", Value: "https://github.com/3"},
+	}))
+
+	for _, key := range []string{"first", "second", "third", "first"} {
+		_, err := r.GetByKey(ctx, key)
+		assert.Nil(t, err)
+	}
+
+	stats := r.Stats()
+	assert.Equal(t, 2, stats.CacheEntries)
+	assert.Equal(t, uint64(4), stats.CacheMisses)
+}
+
+func TestCacheRepositoryTTL(t *testing.T) {
+	ctx := context.Background()
+	r := newTestCacheRepository(t, CacheOptions{Size: 10, TTL: time.Millisecond})
+
+	assert.Nil(t, r.Save(ctx, &Record{Key: "first", Value: "https://github.com/1"}))
+	_, err := r.GetByKey(ctx, "first")
+	assert.Nil(t, err)
+
+	time.Sleep(5 * time.Millisecond)
+	_, err = r.GetByKey(ctx, "first")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), r.Stats().CacheMisses)
+
+	_, err = NewCacheRepository(r, CacheOptions{})
+	assert.NotNil(t, err)
+}
+
+// blockingRepository returns snapshots of records as pg does and holds
+// loads until release, so writes happen between the load and the fill
+type blockingRepository struct {
+	StorageRepository
+	loaded  chan struct{}
+	release chan struct{}
+}
+
+func (r *blockingRepository) GetByKey(ctx context.Context, key string) (*Record, error) {
+	record, err := r.StorageRepository.GetByKey(ctx, key)
+	if record != nil {
+		value := *record
+		record = &value
+	}
+	r.loaded <- struct{}{}
+	<-r.release
+	return record, err
+}
+
+func TestCacheRepositoryConcurrentDelete(t *testing.T) {
+	ctx := context.Background()
+
+	inner, _ := NewMemoryRepository()
+	blocking := &blockingRepository{
+		StorageRepository: inner,
+		loaded:            make(chan struct{}, 1),
+		release:           make(chan struct{}),
+	}
+	r, err := NewCacheRepository(blocking, CacheOptions{Size: 10, TTL: time.Minute})
+	assert.Nil(t, err)
+
+	assert.Nil(t, r.Save(ctx, &Record{Key: "first", Value: "https://github.com/1", UserID: "user"}))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := r.GetByKey(ctx, "first")
+		assert.Nil(t, err)
+	}()
+
+	<-blocking.loaded
+	assert.Nil(t, r.DeleteByUserID(ctx, "user", []string{"first"}))
+	close(blocking.release)
+	<-done
+
+	record, err := r.GetByKey(ctx, "first")
+	assert.Nil(t, err)
+	assert.True(t, record.Removed)
+}
@@ -0,0 +1,76 @@
+package repository
+
+import (
+	"sort"
+	"time"
+)
+
+const clickDayLayout = "2006-01-02"
+
+type Click struct {
+	Key       string    `json:"key"`
+	Timestamp time.Time `json:"timestamp"`
+	Referer   string    `json:"referer"`
+	UserAgent string    `json:"user_agent"`
+	IP        string    `json:"ip"`
+	Language  string    `json:"language"`
+}
+
+type DailyClicks struct {
+	Date  string
+	Count int
+}
+
+type ReferrerClicks struct {
+	Referer string
+	Count   int
+}
+
+type ClickStats struct {
+	Total        int
+	Daily        []*DailyClicks
+	TopReferrers []*ReferrerClicks
+}
+
+// buildClickStats aggregates clicks in memory for the repositories
+// without query language
+func buildClickStats(clicks []*Click, topReferrers int) *ClickStats {
+	days := make(map[string]int)
+	referrers := make(map[string]int)
+	for _, click := range clicks {
+		days[click.Timestamp.UTC().Format(clickDayLayout)]++
+		if click.Referer != "" {
+			referrers[click.Referer]++
+		}
+	}
+
+	stats := &ClickStats{
+		Total:        len(clicks),
+		Daily:        make([]*DailyClicks, 0, len(days)),
+		TopReferrers: make([]*ReferrerClicks, 0, len(referrers)),
+	}
+
+	for date, count := range days {
+		stats.Daily = append(stats.Daily, &DailyClicks{Date: date, Count: count})
+	}
+	sort.Slice(stats.Daily, func(i, j int) bool {
+		return stats.Daily[i].Date < stats.Daily[j].Date
+	})
+
+	for referer, count := range referrers {
+		stats.TopReferrers = append(
+			stats.TopReferrers, &ReferrerClicks{Referer: referer, Count: count},
+		)
+	}
+	sort.Slice(stats.TopReferrers, func(i, j int) bool {
+		if stats.TopReferrers[i].Count == stats.TopReferrers[j].Count {
+			return stats.TopReferrers[i].Referer < stats.TopReferrers[j].Referer
+		}
+		return stats.TopReferrers[i].Count > stats.TopReferrers[j].Count
+	})
+	if len(stats.TopReferrers) > topReferrers {
+		stats.TopReferrers = stats.TopReferrers[:topReferrers]
+	}
+
+	return stats
+}
@@ -1,21 +1,179 @@
 package repository
 
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Scopes of url deduplication
+const (
+	DedupGlobal = "global"
+	DedupUser   = "user"
+	DedupNone   = "none"
+)
+
+// dedupOwner returns user id which limits lookup of duplicates
+// of the record, empty user id means records of all users
+func dedupOwner(record *Record, dedupScope string) string {
+	if dedupScope == DedupUser {
+		return record.UserID
+	}
+	return ""
+}
+
+// Kinds of storage errors, errors of every layer can be matched
+// against them with errors.Is
+var (
+	ErrNotFound    = errors.New("not found")
+	ErrConflict    = errors.New("conflict")
+	ErrUnavailable = errors.New("storage unavailable")
+	ErrForbidden   = errors.New("forbidden")
+)
+
+type NotUniqueKeyError struct{}
+
+func (e *NotUniqueKeyError) Error() string {
+	return "not unique key"
+}
+
+func (e *NotUniqueKeyError) Is(target error) bool {
+	return target == ErrConflict
+}
+
+// UnavailableError wraps errors caused by lost connection to the storage
+type UnavailableError struct {
+	Err error
+}
+
+func (e *UnavailableError) Error() string {
+	return "storage unavailable: " + e.Err.Error()
+}
+
+func (e *UnavailableError) Unwrap() error {
+	return e.Err
+}
+
+func (e *UnavailableError) Is(target error) bool {
+	return target == ErrUnavailable
+}
+
 type StorageRepository interface {
-	GetByKey(key string) (*Record, error)
-	GetByValue(value string) (*Record, error)
-	GetAllByUserID(userID string) ([]*Record, error)
-	Save(record *Record) error
-	SaveBatchOfURL(records []*Record) error
-	DeleteByUserID(userID string, keys []string) error
-	Status() error
+	GetByKey(ctx context.Context, key string) (*Record, error)
+	GetByKeys(ctx context.Context, keys []string) ([]*Record, error)
+	GetByValue(ctx context.Context, value string, userID string) (*Record, error)
+	GetAllByUserID(ctx context.Context, userID string) ([]*Record, error)
+	ListByUserID(ctx context.Context, q *ListQuery) (*Page, error)
+	Save(ctx context.Context, record *Record) error
+	SaveOrGet(ctx context.Context, record *Record, dedupScope string) (*Record, bool, error)
+	SaveBatchOfURL(ctx context.Context, records []*Record) error
+	SaveOrGetBatch(ctx context.Context, records []*Record, dedupScope string) ([]*Record, error)
+	UpdateValue(ctx context.Context, userID string, key string, value string, dedupScope string, now time.Time) (*Record, error)
+	GetRevisions(ctx context.Context, key string) ([]*Revision, error)
+	DeleteByUserID(ctx context.Context, userID string, keys []string) error
+	Restore(ctx context.Context, userID string, keys []string, deletedAfter time.Time, now time.Time) ([]string, error)
+	DeleteExpired(ctx context.Context, now time.Time) (int, error)
+	Purge(ctx context.Context, userID string, before time.Time) (int, error)
+	NextCounter(ctx context.Context) (uint64, error)
+	SaveClicks(ctx context.Context, clicks []*Click) error
+	GetClickStats(ctx context.Context, key string, topReferrers int) (*ClickStats, error)
+	SaveDeleteTask(ctx context.Context, task *DeleteTask) error
+	AckDeleteTask(ctx context.Context, id string) error
+	BuryDeleteTask(ctx context.Context, task *DeleteTask) error
+	GetDeleteTasks(ctx context.Context) ([]*DeleteTask, error)
+	Compact(ctx context.Context) error
+	Stats() *Stats
+	Status(ctx context.Context) error
 	Close() error
 }
+type Stats struct {
+	Backend        string
+	Records        int
+	LogEntries     int
+	LogSize        int64
+	ReplayDuration time.Duration
+	Compactions    int
+	CompactErrors  int
+	CacheEntries   int
+	CacheHits      uint64
+	CacheMisses    uint64
+}
+
 type Record struct {
-	Key           string `json:"key"`
-	Value         string `json:"value"`
-	UserID        string `json:"user_id"`
-	CorrelationID string `json:"correlation_id"`
-	Removed       bool   `json:"-"`
+	Key           string     `json:"key"`
+	Value         string     `json:"value"`
+	UserID        string     `json:"user_id"`
+	CorrelationID string     `json:"correlation_id"`
+	Removed       bool       `json:"removed,omitempty"`
+	ExpiresAt     *time.Time `json:"expires_at,omitempty"`
+	DeletedAt     *time.Time `json:"deleted_at,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+}
+
+// stamp sets timestamps of the new record, which weren't set by the caller
+func (r *Record) stamp(now time.Time) {
+	if r.CreatedAt.IsZero() {
+		r.CreatedAt = now
+	}
+	if r.UpdatedAt.IsZero() {
+		r.UpdatedAt = r.CreatedAt
+	}
+}
+
+// upgrade fills timestamps of entries written by older versions,
+// the creation time of them is unknown and stays zero
+func (r *Record) upgrade() {
+	if !r.UpdatedAt.IsZero() {
+		return
+	}
+
+	r.UpdatedAt = r.CreatedAt
+	if r.DeletedAt != nil {
+		r.UpdatedAt = *r.DeletedAt
+	}
+}
+
+// removedAt returns a removed copy of the record, stored records are
+// replaced by copies, so records returned to readers are never changed
+func (r Record) removedAt(now time.Time) *Record {
+	r.Removed = true
+	r.DeletedAt = &now
+	r.UpdatedAt = now
+	return &r
+}
+
+// restoredAt returns a restored copy of the record
+func (r Record) restoredAt(now time.Time) *Record {
+	r.Removed = false
+	r.DeletedAt = nil
+	r.UpdatedAt = now
+	return &r
+}
+
+// IsRestorable checks that the record of the user was removed after the time
+// and is not expired, records removed without timestamp can't be restored
+func (r Record) IsRestorable(userID string, deletedAfter time.Time, now time.Time) bool {
+	if !r.Removed || !r.IsOwner(userID) || r.IsExpired(now) {
+		return false
+	}
+	return r.DeletedAt != nil && r.DeletedAt.After(deletedAfter)
+}
+
+// IsPurgeable checks that record was removed before the time,
+// records removed without timestamp are always purgeable
+func (r Record) IsPurgeable(userID string, before time.Time) bool {
+	if !r.Removed {
+		return false
+	}
+	if userID != "" && !r.IsOwner(userID) {
+		return false
+	}
+	return r.DeletedAt == nil || !r.DeletedAt.After(before)
+}
+
+func (r Record) IsExpired(now time.Time) bool {
+	return r.ExpiresAt != nil && !r.ExpiresAt.After(now)
 }
 
 func (r Record) IsOwnerAndExists(userID string) bool {
@@ -25,3 +183,19 @@ func (r Record) IsOwnerAndExists(userID string) bool {
 func (r Record) IsOwner(userID string) bool {
 	return r.UserID == userID
 }
+
+// checkUniqueKeys checks that keys of new records are not used in db
+// and are not repeated inside of the records
+func checkUniqueKeys(db map[string]*Record, records ...*Record) error {
+	keys := make(map[string]struct{}, len(records))
+	for _, record := range records {
+		if _, ok := db[record.Key]; ok {
+			return &NotUniqueKeyError{}
+		}
+		if _, ok := keys[record.Key]; ok {
+			return &NotUniqueKeyError{}
+		}
+		keys[record.Key] = struct{}{}
+	}
+	return nil
+}
@@ -1,101 +1,335 @@
 package repository
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"os"
 	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	counterFileSuffix   = ".counter"
+	clicksFileSuffix    = ".clicks"
+	tasksFileSuffix     = ".tasks"
+	revisionsFileSuffix = ".revisions"
+)
+
+// tasksCompactionThreshold is a number of acked entries
+// after which the log of delete tasks is compacted
+const tasksCompactionThreshold = 100
+
+const (
+	SyncAlways   = "always"
+	SyncInterval = "interval"
+	SyncNone     = "none"
 )
 
+// FileOptions configures durability and compaction of the log.
+// The log is compacted when its size is not less than CompactionMinSize
+// and the number of entries is CompactionRatio times more than the number
+// of records. SyncMode defines when written entries are flushed to disk
+// and RecoveryMode defines how broken entries are handled on replay.
+type FileOptions struct {
+	CompactionInterval time.Duration
+	CompactionMinSize  int64
+	CompactionRatio    float64
+	SyncMode           string
+	SyncInterval       time.Duration
+	RecoveryMode       string
+	Logger             logrus.FieldLogger
+}
+
+func (o *FileOptions) validate() error {
+	switch o.SyncMode {
+	case "":
+		o.SyncMode = SyncNone
+	case SyncAlways, SyncNone:
+	case SyncInterval:
+		if o.SyncInterval <= 0 {
+			return errors.New("sync interval must be positive")
+		}
+	default:
+		return fmt.Errorf("unknown sync mode: %s", o.SyncMode)
+	}
+
+	switch o.RecoveryMode {
+	case "":
+		o.RecoveryMode = RecoveryStrict
+	case RecoveryStrict, RecoveryTruncate, RecoverySkip:
+	default:
+		return fmt.Errorf("unknown recovery mode: %s", o.RecoveryMode)
+	}
+
+	if o.Logger == nil {
+		o.Logger = logrus.StandardLogger()
+	}
+	return nil
+}
+
 type fileRepository struct {
-	mu       *sync.RWMutex
-	db       map[string]*Record
-	producer *producer
+	fileName          string
+	opts              FileOptions
+	mu                *sync.RWMutex
+	db                map[string]*Record
+	index             *index
+	producer          *producer
+	counter           *counter
+	clicksMu          *sync.RWMutex
+	clicks            map[string][]*Click
+	clicksProducer    *producer
+	tasksMu           *sync.Mutex
+	tasks             map[string]*DeleteTask
+	tasksProducer     *producer
+	tasksAcked        int
+	revisions         map[string][]*Revision
+	revisionsProducer *producer
+	logEntries        int
+	replayDuration    time.Duration
+	compactions       int
+	compactErrors     int
+	stop              chan struct{}
+	done              chan struct{}
 }
 
-func NewFileRepository(fileStoragePath string) (StorageRepository, error) {
+func NewFileRepository(fileStoragePath string, opts FileOptions) (_ StorageRepository, err error) {
+	if err = opts.validate(); err != nil {
+		return nil, err
+	}
+
+	// producers opened before a failure are closed, consumers
+	// are closed by their own defers
+	var producers []*producer
+	defer func() {
+		if err == nil {
+			return
+		}
+		for _, p := range producers {
+			p.Close()
+		}
+	}()
+
 	producer, err := NewProducer(fileStoragePath)
 	if err != nil {
 		return nil, err
 	}
+	producers = append(producers, producer)
 
-	consumer, err := NewConsumer(fileStoragePath)
+	consumer, err := NewConsumer(fileStoragePath, opts.RecoveryMode, opts.Logger)
 	if err != nil {
 		return nil, err
 	}
 	defer consumer.Close()
 
-	db, err := consumer.ReadAll()
+	replayStart := time.Now()
+	db, logEntries, err := consumer.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	replayDuration := time.Since(replayStart)
+
+	counter, err := NewCounter(fileStoragePath+counterFileSuffix, uint64(logEntries), opts.Logger)
+	if err != nil {
+		return nil, err
+	}
+
+	clicksProducer, err := NewProducer(fileStoragePath + clicksFileSuffix)
+	if err != nil {
+		return nil, err
+	}
+	producers = append(producers, clicksProducer)
+
+	clicksConsumer, err := NewConsumer(
+		fileStoragePath+clicksFileSuffix, opts.RecoveryMode, opts.Logger,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer clicksConsumer.Close()
+
+	clicks, err := clicksConsumer.ReadAllClicks()
+	if err != nil {
+		return nil, err
+	}
+
+	tasksProducer, err := NewProducer(fileStoragePath + tasksFileSuffix)
+	if err != nil {
+		return nil, err
+	}
+	producers = append(producers, tasksProducer)
+
+	tasksConsumer, err := NewConsumer(
+		fileStoragePath+tasksFileSuffix, opts.RecoveryMode, opts.Logger,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer tasksConsumer.Close()
+
+	tasks, tasksAcked, err := tasksConsumer.ReadAllTasks()
+	if err != nil {
+		return nil, err
+	}
+
+	revisionsProducer, err := NewProducer(fileStoragePath + revisionsFileSuffix)
+	if err != nil {
+		return nil, err
+	}
+	producers = append(producers, revisionsProducer)
+
+	revisionsConsumer, err := NewConsumer(
+		fileStoragePath+revisionsFileSuffix, opts.RecoveryMode, opts.Logger,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer revisionsConsumer.Close()
+
+	revisions, err := revisionsConsumer.ReadAllRevisions()
 	if err != nil {
 		return nil, err
 	}
 
 	repo := &fileRepository{
-		mu:       &sync.RWMutex{},
-		db:       db,
-		producer: producer,
+		fileName:          fileStoragePath,
+		opts:              opts,
+		mu:                &sync.RWMutex{},
+		db:                db,
+		index:             newIndex(db),
+		producer:          producer,
+		counter:           counter,
+		clicksMu:          &sync.RWMutex{},
+		clicks:            clicks,
+		clicksProducer:    clicksProducer,
+		tasksMu:           &sync.Mutex{},
+		tasks:             tasks,
+		tasksProducer:     tasksProducer,
+		tasksAcked:        tasksAcked,
+		revisions:         revisions,
+		revisionsProducer: revisionsProducer,
+		logEntries:        logEntries,
+		replayDuration:    replayDuration,
+		stop:              make(chan struct{}),
+		done:              make(chan struct{}),
 	}
 
+	go repo.loop()
+
 	return repo, nil
 }
 
-func (r *fileRepository) GetByKey(key string) (*Record, error) {
+func (r *fileRepository) GetByKey(_ context.Context, key string) (*Record, error) {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 
 	record, ok := r.db[key]
 	if !ok {
-		return record, errors.New("NOT FOUND URL")
+		return nil, ErrNotFound
 	}
 	return record, nil
 }
 
-func (r *fileRepository) GetByValue(value string) (*Record, error) {
+// GetByKeys returns found records, unknown keys are skipped
+func (r *fileRepository) GetByKeys(_ context.Context, keys []string) ([]*Record, error) {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 
-	for _, record := range r.db {
-		if record.Value == value {
-			return record, nil
+	result := make([]*Record, 0, len(keys))
+	for _, key := range keys {
+		if record, ok := r.db[key]; ok {
+			result = append(result, record)
 		}
 	}
-	return nil, nil
+	return result, nil
 }
 
-func (r *fileRepository) GetAllByUserID(userID string) ([]*Record, error) {
+// GetByValue returns any record with the value,
+// records of all users are used when user id is empty
+func (r *fileRepository) GetByValue(_ context.Context, value string, userID string) (*Record, error) {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 
-	result := make([]*Record, 0, 100)
-	for _, record := range r.db {
-		if record.UserID == userID {
-			result = append(result, record)
-		}
+	return r.index.findByValue(r.db, value, userID), nil
+}
+
+func (r *fileRepository) GetAllByUserID(_ context.Context, userID string) ([]*Record, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	keys := r.index.keysByUser(userID)
+	result := make([]*Record, 0, len(keys))
+	for key := range keys {
+		result = append(result, r.db[key])
 	}
 	return result, nil
 }
 
+// write writes the entry to the log and flushes it to disk
+// when every write must be synced
+func (r *fileRepository) write(p *producer, v interface{}) error {
+	if err := p.Write(v); err != nil {
+		return err
+	}
+
+	if r.opts.SyncMode == SyncAlways {
+		return p.Sync()
+	}
+	return nil
+}
+
 func (r *fileRepository) dump(record *Record) error {
-	if err := r.producer.Write(record); err != nil {
+	if err := r.write(r.producer, record); err != nil {
 		return err
 	}
+	r.logEntries++
 	return nil
 }
 
-func (r *fileRepository) Save(record *Record) error {
+func (r *fileRepository) ListByUserID(_ context.Context, q *ListQuery) (*Page, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	keys := r.index.keysByUser(q.UserID)
+	records := make([]*Record, 0, len(keys))
+	for key := range keys {
+		if record := r.db[key]; q.match(record) {
+			records = append(records, record)
+		}
+	}
+	return paginate(records, q), nil
+}
+
+func (r *fileRepository) Save(_ context.Context, record *Record) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
+	if err := checkUniqueKeys(r.db, record); err != nil {
+		return err
+	}
+
+	record.stamp(time.Now().UTC())
 	r.db[record.Key] = record
+	r.index.add(record)
 	return r.dump(record)
 }
 
-func (r *fileRepository) SaveBatchOfURL(records []*Record) error {
+func (r *fileRepository) SaveBatchOfURL(_ context.Context, records []*Record) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	var err error
+	err := checkUniqueKeys(r.db, records...)
+	if err != nil {
+		return err
+	}
 
+	now := time.Now().UTC()
 	for _, record := range records {
+		record.stamp(now)
 		r.db[record.Key] = record
+		r.index.add(record)
 		if err = r.dump(record); err != nil {
 			return err
 		}
@@ -104,21 +338,98 @@ func (r *fileRepository) SaveBatchOfURL(records []*Record) error {
 	return nil
 }
 
-func (r *fileRepository) DeleteByUserID(userID string, keys []string) error {
+// saveOrGet saves records which have no duplicates and returns a stored
+// record for every record and the saved ones, the caller must hold the lock
+func (r *fileRepository) saveOrGet(records []*Record, dedupScope string) ([]*Record, []*Record, error) {
+	result, newRecords, err := r.index.splitBatch(r.db, records, dedupScope)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now().UTC()
+	for _, record := range newRecords {
+		record.stamp(now)
+		r.db[record.Key] = record
+		r.index.add(record)
+		if err = r.dump(record); err != nil {
+			return nil, nil, err
+		}
+	}
+	return result, newRecords, nil
+}
+
+// SaveOrGet saves the record or returns already stored duplicate of it,
+// the flag reports whether the record was saved
+func (r *fileRepository) SaveOrGet(_ context.Context, record *Record, dedupScope string) (*Record, bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	result, newRecords, err := r.saveOrGet([]*Record{record}, dedupScope)
+	if err != nil {
+		return nil, false, err
+	}
+	return result[0], len(newRecords) > 0, nil
+}
+
+// SaveOrGetBatch saves new records of the batch and returns a stored
+// record for every record of the batch in the same order
+func (r *fileRepository) SaveOrGetBatch(_ context.Context, records []*Record, dedupScope string) ([]*Record, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	result, _, err := r.saveOrGet(records, dedupScope)
+	return result, err
+}
+
+// UpdateValue changes the value of the record of the user, revisions
+// are written to their log before the new state of the record
+func (r *fileRepository) UpdateValue(
+	_ context.Context,
+	userID string,
+	key string,
+	value string,
+	dedupScope string,
+	now time.Time,
+) (*Record, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	record, added, err := changeValue(r.db, r.index, r.revisions, userID, key, value, dedupScope, now)
+	if err != nil || len(added) == 0 {
+		return record, err
+	}
+
+	for _, revision := range added {
+		if err = r.write(r.revisionsProducer, revision); err != nil {
+			return nil, err
+		}
+	}
+	return record, r.dump(record)
+}
+
+func (r *fileRepository) GetRevisions(_ context.Context, key string) ([]*Revision, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return copyRevisions(r.revisions[key]), nil
+}
+
+func (r *fileRepository) DeleteByUserID(_ context.Context, userID string, keys []string) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
 	var err error
 
+	now := time.Now().UTC()
 	for _, key := range keys {
 		record, ok := r.db[key]
 		if !ok {
 			continue
 		}
-		if !record.IsOwner(userID) {
+		if !record.IsOwnerAndExists(userID) {
 			continue
 		}
-		record.Removed = true
+		record = record.removedAt(now)
 		r.db[key] = record
 
 		if err = r.dump(record); err != nil {
@@ -129,10 +440,408 @@ func (r *fileRepository) DeleteByUserID(userID string, keys []string) error {
 	return nil
 }
 
-func (r *fileRepository) Status() error {
+// Restore brings back removed records and returns their keys,
+// the new state of every record is appended to the log
+func (r *fileRepository) Restore(
+	_ context.Context,
+	userID string,
+	keys []string,
+	deletedAfter time.Time,
+	now time.Time,
+) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	restored := make([]string, 0, len(keys))
+	for _, key := range keys {
+		record, ok := r.db[key]
+		if !ok || !record.IsRestorable(userID, deletedAfter, now) {
+			continue
+		}
+		record = record.restoredAt(now)
+		r.db[key] = record
+
+		if err := r.dump(record); err != nil {
+			return restored, err
+		}
+		restored = append(restored, key)
+	}
+	return restored, nil
+}
+
+func (r *fileRepository) DeleteExpired(_ context.Context, now time.Time) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	total := 0
+	for _, record := range r.db {
+		if record.Removed || !record.IsExpired(now) {
+			continue
+		}
+		record = record.removedAt(now)
+		r.db[record.Key] = record
+		total++
+
+		if err := r.dump(record); err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+func (r *fileRepository) Purge(_ context.Context, userID string, before time.Time) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.clicksMu.Lock()
+	defer r.clicksMu.Unlock()
+
+	total := 0
+	for key, record := range r.db {
+		if !record.IsPurgeable(userID, before) {
+			continue
+		}
+		delete(r.db, key)
+		r.index.remove(record)
+		delete(r.revisions, key)
+		delete(r.clicks, key)
+		total++
+	}
+
+	if total == 0 {
+		return 0, nil
+	}
+
+	if err := r.compact(); err != nil {
+		return total, err
+	}
+	if err := r.compactRevisions(); err != nil {
+		return total, err
+	}
+	return total, r.compactClicks()
+}
+
+// compact rewrites the log with the current state of records,
+// caller must hold the write lock
+func (r *fileRepository) compact() error {
+	if err := r.producer.Close(); err != nil {
+		return err
+	}
+
+	err := rewriteFile(r.fileName, func(p *producer) error {
+		for _, record := range r.db {
+			if err := p.Write(record); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	producer, openErr := NewProducer(r.fileName)
+	if openErr != nil {
+		return openErr
+	}
+	r.producer = producer
+	if err != nil {
+		return err
+	}
+
+	r.logEntries = len(r.db)
+	r.compactions++
+	return nil
+}
+
+// needCompaction checks the thresholds of the log,
+// caller must hold the lock
+func (r *fileRepository) needCompaction() bool {
+	if r.logEntries <= len(r.db) {
+		return false
+	}
+
+	info, err := os.Stat(r.fileName)
+	if err != nil || info.Size() < r.opts.CompactionMinSize {
+		return false
+	}
+
+	records := len(r.db)
+	if records == 0 {
+		records = 1
+	}
+	return float64(r.logEntries)/float64(records) >= r.opts.CompactionRatio
+}
+
+func (r *fileRepository) loop() {
+	defer close(r.done)
+
+	var compactionC, syncC <-chan time.Time
+
+	if r.opts.CompactionInterval > 0 {
+		compactionTicker := time.NewTicker(r.opts.CompactionInterval)
+		defer compactionTicker.Stop()
+		compactionC = compactionTicker.C
+	}
+
+	if r.opts.SyncMode == SyncInterval {
+		syncTicker := time.NewTicker(r.opts.SyncInterval)
+		defer syncTicker.Stop()
+		syncC = syncTicker.C
+	}
+
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-compactionC:
+			r.mu.Lock()
+			if r.needCompaction() {
+				if err := r.compact(); err != nil {
+					r.compactErrors++
+					r.opts.Logger.Warnf("storage: failed to compact %s: %v", r.fileName, err)
+				}
+			}
+			r.mu.Unlock()
+		case <-syncC:
+			r.sync()
+		}
+	}
+}
+
+// sync flushes written entries of all logs to disk
+func (r *fileRepository) sync() {
+	r.mu.RLock()
+	if err := r.producer.Sync(); err != nil {
+		r.opts.Logger.Warnf("storage: failed to sync %s: %v", r.fileName, err)
+	}
+	if err := r.revisionsProducer.Sync(); err != nil {
+		r.opts.Logger.Warnf("storage: failed to sync revisions of %s: %v", r.fileName, err)
+	}
+	r.mu.RUnlock()
+
+	r.clicksMu.RLock()
+	if err := r.clicksProducer.Sync(); err != nil {
+		r.opts.Logger.Warnf("storage: failed to sync clicks of %s: %v", r.fileName, err)
+	}
+	r.clicksMu.RUnlock()
+
+	r.tasksMu.Lock()
+	if err := r.tasksProducer.Sync(); err != nil {
+		r.opts.Logger.Warnf("storage: failed to sync tasks of %s: %v", r.fileName, err)
+	}
+	r.tasksMu.Unlock()
+}
+
+// Compact rewrites the log into the snapshot of records without thresholds
+func (r *fileRepository) Compact(_ context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.compact()
+}
+
+func (r *fileRepository) Stats() *Stats {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	stats := &Stats{
+		Backend:        "file",
+		Records:        len(r.db),
+		LogEntries:     r.logEntries,
+		ReplayDuration: r.replayDuration,
+		Compactions:    r.compactions,
+		CompactErrors:  r.compactErrors,
+	}
+	if info, err := os.Stat(r.fileName); err == nil {
+		stats.LogSize = info.Size()
+	}
+	return stats
+}
+
+// compactRevisions rewrites the log of revisions with revisions
+// of the current records, caller must hold the write lock
+func (r *fileRepository) compactRevisions() error {
+	fileName := r.fileName + revisionsFileSuffix
+	if err := r.revisionsProducer.Close(); err != nil {
+		return err
+	}
+
+	err := rewriteFile(fileName, func(p *producer) error {
+		for _, revisions := range r.revisions {
+			for _, revision := range revisions {
+				if err := p.Write(revision); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+
+	producer, openErr := NewProducer(fileName)
+	if openErr != nil {
+		return openErr
+	}
+	r.revisionsProducer = producer
+	return err
+}
+
+// compactClicks rewrites the clicks log with the current clicks,
+// caller must hold the clicks write lock
+func (r *fileRepository) compactClicks() error {
+	fileName := r.fileName + clicksFileSuffix
+	if err := r.clicksProducer.Close(); err != nil {
+		return err
+	}
+
+	err := rewriteFile(fileName, func(p *producer) error {
+		for _, clicks := range r.clicks {
+			for _, click := range clicks {
+				if err := p.Write(click); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+
+	producer, openErr := NewProducer(fileName)
+	if openErr != nil {
+		return openErr
+	}
+	r.clicksProducer = producer
+	return err
+}
+
+// NextCounter doesn't hold the lock of records,
+// the counter is guarded by its own one
+func (r *fileRepository) NextCounter(_ context.Context) (uint64, error) {
+	return r.counter.Next()
+}
+
+func (r *fileRepository) SaveClicks(_ context.Context, clicks []*Click) error {
+	r.clicksMu.Lock()
+	defer r.clicksMu.Unlock()
+
+	for _, click := range clicks {
+		r.clicks[click.Key] = append(r.clicks[click.Key], click)
+		if err := r.write(r.clicksProducer, click); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *fileRepository) GetClickStats(_ context.Context, key string, topReferrers int) (*ClickStats, error) {
+	r.clicksMu.RLock()
+	defer r.clicksMu.RUnlock()
+
+	return buildClickStats(r.clicks[key], topReferrers), nil
+}
+
+func (r *fileRepository) SaveDeleteTask(_ context.Context, task *DeleteTask) error {
+	r.tasksMu.Lock()
+	defer r.tasksMu.Unlock()
+
+	if err := r.write(r.tasksProducer, task); err != nil {
+		return err
+	}
+	r.tasks[task.ID] = task
+	return nil
+}
+
+// AckDeleteTask marks the task as done in the log, the log is compacted
+// when the number of acked entries reaches tasksCompactionThreshold
+func (r *fileRepository) AckDeleteTask(_ context.Context, id string) error {
+	r.tasksMu.Lock()
+	defer r.tasksMu.Unlock()
+
+	if _, ok := r.tasks[id]; !ok {
+		return nil
+	}
+	if err := r.write(r.tasksProducer, &DeleteTask{ID: id, Done: true}); err != nil {
+		return err
+	}
+	delete(r.tasks, id)
+	r.tasksAcked++
+
+	if r.tasksAcked < tasksCompactionThreshold {
+		return nil
+	}
+	return r.compactTasks()
+}
+
+// BuryDeleteTask writes the failure of the task to the log,
+// so the task is kept as a dead letter and isn't replayed
+func (r *fileRepository) BuryDeleteTask(_ context.Context, task *DeleteTask) error {
+	r.tasksMu.Lock()
+	defer r.tasksMu.Unlock()
+
+	stored, ok := r.tasks[task.ID]
+	if !ok {
+		return nil
+	}
+
+	stored = stored.bury(task)
+	if err := r.write(r.tasksProducer, stored); err != nil {
+		return err
+	}
+	r.tasks[task.ID] = stored
+	return nil
+}
+
+// compactTasks rewrites the log of delete tasks with pending and dead tasks,
+// caller must hold the tasks lock
+func (r *fileRepository) compactTasks() error {
+	fileName := r.fileName + tasksFileSuffix
+	if err := r.tasksProducer.Close(); err != nil {
+		return err
+	}
+
+	err := rewriteFile(fileName, func(p *producer) error {
+		for _, task := range sortDeleteTasks(r.tasks) {
+			if err := p.Write(task); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	producer, openErr := NewProducer(fileName)
+	if openErr != nil {
+		return openErr
+	}
+	r.tasksProducer = producer
+	if err == nil {
+		r.tasksAcked = 0
+	}
+	return err
+}
+
+func (r *fileRepository) GetDeleteTasks(_ context.Context) ([]*DeleteTask, error) {
+	r.tasksMu.Lock()
+	defer r.tasksMu.Unlock()
+
+	return sortDeleteTasks(r.tasks), nil
+}
+
+func (r *fileRepository) Status(_ context.Context) error {
 	return nil
 }
 
 func (r *fileRepository) Close() error {
+	close(r.stop)
+	<-r.done
+
+	if r.opts.SyncMode != SyncNone {
+		r.sync()
+	}
+
+	if err := r.clicksProducer.Close(); err != nil {
+		return err
+	}
+	if err := r.tasksProducer.Close(); err != nil {
+		return err
+	}
+	if err := r.revisionsProducer.Close(); err != nil {
+		return err
+	}
 	return r.producer.Close()
 }
@@ -0,0 +1,420 @@
+package repository
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestFileRepository(t *testing.T, fileName string) StorageRepository {
+	r, err := NewFileRepository(fileName, FileOptions{})
+	assert.Nil(t, err)
+	return r
+}
+
+func writeTestLog(t *testing.T, fileName string, data string) {
+	err := os.WriteFile(fileName, []byte(data), 0777)
+	assert.Nil(t, err)
+}
+
+const (
+	firstTestEntry  = `{"key":"first","value":"https://github.com/1","user_id":"user"}` + "\n"
+	secondTestEntry = `{"key":"second","value":"https://github.com/2","user_id":"user"}` + "\n"
+	brokenTestEntry = `{"key":"broken","value":"https://gi`
+)
+
+func countLines(t *testing.T, fileName string) int {
+	file, err := os.Open(fileName)
+	assert.Nil(t, err)
+	defer file.Close()
+
+	lines := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lines++
+	}
+	return lines
+}
+
+func TestFileRepositoryCompact(t *testing.T) {
+	ctx := context.Background()
+
+	fileName := filepath.Join(t.TempDir(), "storage.json")
+	r := newTestFileRepository(t, fileName)
+
+	assert.Nil(t, r.Save(ctx, &Record{Key: "first", Value: "https://github.com/1", UserID: "user"}))
+	assert.Nil(t, r.Save(ctx, &Record{Key: "second", Value: "https://github.com/2", UserID: "user"}))
+	assert.Nil(t, r.DeleteByUserID(ctx, "user", []string{"first", "second"}))
+	assert.Equal(t, 4, countLines(t, fileName))
+
+	assert.Nil(t, r.Compact(ctx))
+	assert.Equal(t, 2, countLines(t, fileName))
+
+	stats := r.Stats()
+	assert.Equal(t, 2, stats.Records)
+	assert.Equal(t, 2, stats.LogEntries)
+	assert.Equal(t, 1, stats.Compactions)
+
+	assert.Nil(t, r.Save(ctx, &Record{Key: "third", Value: "https://github.com/3", UserID: "user"}))
+	assert.Nil(t, r.Close())
+
+	r = newTestFileRepository(t, fileName)
+	defer r.Close()
+
+	record, err := r.GetByKey(ctx, "first")
+	assert.Nil(t, err)
+	assert.True(t, record.Removed)
+
+	record, err = r.GetByKey(ctx, "third")
+	assert.Nil(t, err)
+	assert.Equal(t, "https://github.com/3", record.Value)
+	assert.Equal(t, 3, r.Stats().LogEntries)
+}
+
+func TestFileRepositoryStrictRecovery(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "storage.json")
+	writeTestLog(t, fileName, firstTestEntry+brokenTestEntry)
+
+	_, err := NewFileRepository(fileName, FileOptions{RecoveryMode: RecoveryStrict})
+	assert.NotNil(t, err)
+}
+
+func TestFileRepositoryClosesFilesOnError(t *testing.T) {
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skip("open files can't be counted: ", err)
+	}
+
+	// the log of revisions is broken, so all other files are opened before
+	fileName := filepath.Join(t.TempDir(), "storage.json")
+	writeTestLog(t, fileName+revisionsFileSuffix, brokenTestEntry)
+
+	_, err = NewFileRepository(fileName, FileOptions{RecoveryMode: RecoveryStrict})
+	assert.NotNil(t, err)
+
+	left, err := os.ReadDir("/proc/self/fd")
+	assert.Nil(t, err)
+	assert.Equal(t, len(fds), len(left))
+}
+
+func TestFileRepositoryTruncateRecovery(t *testing.T) {
+	ctx := context.Background()
+
+	fileName := filepath.Join(t.TempDir(), "storage.json")
+	writeTestLog(t, fileName, firstTestEntry+brokenTestEntry)
+
+	r, err := NewFileRepository(fileName, FileOptions{RecoveryMode: RecoveryTruncate})
+	assert.Nil(t, err)
+
+	data, err := os.ReadFile(fileName)
+	assert.Nil(t, err)
+	assert.Equal(t, firstTestEntry, string(data))
+
+	record, err := r.GetByKey(ctx, "first")
+	assert.Nil(t, err)
+	assert.Equal(t, "https://github.com/1", record.Value)
+
+	assert.Nil(t, r.Save(ctx, &Record{Key: "third", Value: "https://github.com/3", UserID: "user"}))
+	assert.Nil(t, r.Close())
+
+	r, err = NewFileRepository(fileName, FileOptions{RecoveryMode: RecoveryStrict})
+	assert.Nil(t, err)
+	defer r.Close()
+
+	assert.Equal(t, 2, r.Stats().Records)
+}
+
+func TestFileRepositoryTruncateRecoveryBrokenMiddle(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "storage.json")
+	log := firstTestEntry + "{broken}\n" + secondTestEntry
+	writeTestLog(t, fileName, log)
+
+	_, err := NewFileRepository(fileName, FileOptions{RecoveryMode: RecoveryTruncate})
+	assert.NotNil(t, err)
+
+	data, err := os.ReadFile(fileName)
+	assert.Nil(t, err)
+	assert.Equal(t, log, string(data))
+}
+
+func TestFileRepositorySkipRecovery(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "storage.json")
+	writeTestLog(
+		t, fileName, firstTestEntry+"{broken}\n"+secondTestEntry+brokenTestEntry,
+	)
+
+	r, err := NewFileRepository(fileName, FileOptions{RecoveryMode: RecoverySkip})
+	assert.Nil(t, err)
+	defer r.Close()
+
+	assert.Equal(t, 2, r.Stats().Records)
+
+	data, err := os.ReadFile(fileName)
+	assert.Nil(t, err)
+	assert.Equal(t, firstTestEntry+"{broken}\n"+secondTestEntry, string(data))
+}
+
+func TestFileRepositoryEntryWithoutLineBreak(t *testing.T) {
+	ctx := context.Background()
+
+	fileName := filepath.Join(t.TempDir(), "storage.json")
+	writeTestLog(t, fileName, firstTestEntry+strings.TrimSuffix(secondTestEntry, "\n"))
+
+	r, err := NewFileRepository(fileName, FileOptions{RecoveryMode: RecoveryStrict})
+	assert.Nil(t, err)
+
+	assert.Nil(t, r.Save(ctx, &Record{Key: "third", Value: "https://github.com/3", UserID: "user"}))
+	assert.Nil(t, r.Close())
+
+	assert.Equal(t, 3, countLines(t, fileName))
+}
+
+func TestFileRepositorySyncAlways(t *testing.T) {
+	ctx := context.Background()
+
+	fileName := filepath.Join(t.TempDir(), "storage.json")
+
+	r, err := NewFileRepository(fileName, FileOptions{SyncMode: SyncAlways})
+	assert.Nil(t, err)
+	defer r.Close()
+
+	assert.Nil(t, r.Save(ctx, &Record{Key: "first", Value: "https://github.com/1", UserID: "user"}))
+	assert.Equal(t, 1, countLines(t, fileName))
+}
+
+func TestFileRepositoryUnknownModes(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "storage.json")
+
+	_, err := NewFileRepository(fileName, FileOptions{SyncMode: "sometimes"})
+	assert.NotNil(t, err)
+
+	_, err = NewFileRepository(fileName, FileOptions{RecoveryMode: "ignore"})
+	assert.NotNil(t, err)
+}
+
+func TestFileRepositoryDeleteTasks(t *testing.T) {
+	ctx := context.Background()
+
+	fileName := filepath.Join(t.TempDir(), "storage.json")
+	r := newTestFileRepository(t, fileName)
+
+	now := time.Now().UTC()
+	assert.Nil(t, r.SaveDeleteTask(ctx, &DeleteTask{
+		ID: "first", UserID: "user", Keys: []string{"a"}, CreatedAt: now,
+	}))
+	assert.Nil(t, r.SaveDeleteTask(ctx, &DeleteTask{
+		ID: "second", UserID: "user", Keys: []string{"b", "c"}, CreatedAt: now.Add(time.Second),
+	}))
+	assert.Nil(t, r.AckDeleteTask(ctx, "first"))
+	assert.Nil(t, r.Close())
+
+	r = newTestFileRepository(t, fileName)
+	tasks, err := r.GetDeleteTasks(ctx)
+	assert.Nil(t, err)
+	assert.Len(t, tasks, 1)
+	assert.Equal(t, "second", tasks[0].ID)
+	assert.Equal(t, []string{"b", "c"}, tasks[0].Keys)
+
+	// the log isn't compacted until enough tasks are acked
+	assert.Nil(t, r.AckDeleteTask(ctx, "second"))
+	assert.Equal(t, 4, countLines(t, fileName+tasksFileSuffix))
+	assert.Nil(t, r.Close())
+}
+
+func TestFileRepositoryCompactDeleteTasks(t *testing.T) {
+	ctx := context.Background()
+
+	fileName := filepath.Join(t.TempDir(), "storage.json")
+	r := newTestFileRepository(t, fileName)
+	defer r.Close()
+
+	now := time.Now().UTC()
+	assert.Nil(t, r.SaveDeleteTask(ctx, &DeleteTask{
+		ID: "pending", UserID: "user", Keys: []string{"a"}, CreatedAt: now,
+	}))
+	for i := 0; i < tasksCompactionThreshold; i++ {
+		id := fmt.Sprintf("task-%d", i)
+		assert.Nil(t, r.SaveDeleteTask(ctx, &DeleteTask{
+			ID: id, UserID: "user", Keys: []string{"b"}, CreatedAt: now,
+		}))
+		assert.Nil(t, r.AckDeleteTask(ctx, id))
+	}
+
+	assert.Equal(t, 1, countLines(t, fileName+tasksFileSuffix))
+
+	tasks, err := r.GetDeleteTasks(ctx)
+	assert.Nil(t, err)
+	assert.Len(t, tasks, 1)
+	assert.Equal(t, "pending", tasks[0].ID)
+}
+
+func TestFileRepositoryDeadDeleteTasks(t *testing.T) {
+	ctx := context.Background()
+
+	fileName := filepath.Join(t.TempDir(), "storage.json")
+	r := newTestFileRepository(t, fileName)
+
+	now := time.Now().UTC()
+	assert.Nil(t, r.SaveDeleteTask(ctx, &DeleteTask{
+		ID: "first", UserID: "user", Keys: []string{"a"}, CreatedAt: now,
+	}))
+	assert.Nil(t, r.SaveDeleteTask(ctx, &DeleteTask{
+		ID: "second", UserID: "user", Keys: []string{"b"}, CreatedAt: now.Add(time.Second),
+	}))
+	assert.Nil(t, r.BuryDeleteTask(ctx, &DeleteTask{
+		ID: "first", Attempts: 3, Error: "connection refused", FailedAt: &now,
+	}))
+
+	assert.Nil(t, r.AckDeleteTask(ctx, "second"))
+	assert.Nil(t, r.Close())
+
+	r = newTestFileRepository(t, fileName)
+	defer r.Close()
+
+	tasks, err := r.GetDeleteTasks(ctx)
+	assert.Nil(t, err)
+	assert.Len(t, tasks, 1)
+	assert.True(t, tasks[0].IsDead())
+	assert.Equal(t, []string{"a"}, tasks[0].Keys)
+	assert.Equal(t, 3, tasks[0].Attempts)
+	assert.Equal(t, "connection refused", tasks[0].Error)
+}
+
+func TestFileRepositoryRestore(t *testing.T) {
+	ctx := context.Background()
+
+	fileName := filepath.Join(t.TempDir(), "storage.json")
+	writeTestLog(t, fileName, firstTestEntry+secondTestEntry)
+
+	r := newTestFileRepository(t, fileName)
+	assert.Nil(t, r.DeleteByUserID(ctx, "user", []string{"first", "second"}))
+
+	now := time.Now()
+	restored, err := r.Restore(ctx, "user", []string{"first"}, now.Add(-time.Minute), now)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"first"}, restored)
+	assert.Nil(t, r.Close())
+
+	r = newTestFileRepository(t, fileName)
+	record, err := r.GetByKey(ctx, "first")
+	assert.Nil(t, err)
+	assert.False(t, record.Removed)
+
+	record, err = r.GetByKey(ctx, "second")
+	assert.Nil(t, err)
+	assert.True(t, record.Removed)
+	assert.Nil(t, r.Close())
+}
+
+func TestFileRepositoryTimestamps(t *testing.T) {
+	ctx := context.Background()
+
+	fileName := filepath.Join(t.TempDir(), "storage.json")
+	deletedEntry := `{"key":"second","value":"https://github.com/2","user_id":"user",` +
+		`"removed":true,"deleted_at":"2023-01-02T03:04:05Z"}` + "\n"
+	writeTestLog(t, fileName, firstTestEntry+deletedEntry)
+
+	r := newTestFileRepository(t, fileName)
+
+	record, err := r.GetByKey(ctx, "first")
+	assert.Nil(t, err)
+	assert.True(t, record.CreatedAt.IsZero())
+	assert.True(t, record.UpdatedAt.IsZero())
+
+	record, err = r.GetByKey(ctx, "second")
+	assert.Nil(t, err)
+	assert.True(t, record.CreatedAt.IsZero())
+	assert.Equal(t, time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC), record.UpdatedAt)
+
+	assert.Nil(t, r.Save(ctx, &Record{Key: "third", Value: "https://github.com/3", UserID: "user"}))
+	assert.Nil(t, r.DeleteByUserID(ctx, "user", []string{"third"}))
+	assert.Nil(t, r.Close())
+
+	r = newTestFileRepository(t, fileName)
+	record, err = r.GetByKey(ctx, "third")
+	assert.Nil(t, err)
+	assert.False(t, record.CreatedAt.IsZero())
+	assert.Equal(t, *record.DeletedAt, record.UpdatedAt)
+	assert.False(t, record.UpdatedAt.Before(record.CreatedAt))
+	assert.Nil(t, r.Close())
+}
+
+func TestFileRepositoryRevisions(t *testing.T) {
+	ctx := context.Background()
+
+	fileName := filepath.Join(t.TempDir(), "storage.json")
+	writeTestLog(t, fileName, firstTestEntry+secondTestEntry)
+
+	r := newTestFileRepository(t, fileName)
+	_, err := r.UpdateValue(ctx, "user", "first", "https://github.com/3", DedupGlobal, time.Now().UTC())
+	assert.Nil(t, err)
+	assert.Nil(t, r.Close())
+
+	r = newTestFileRepository(t, fileName)
+	record, err := r.GetByKey(ctx, "first")
+	assert.Nil(t, err)
+	assert.Equal(t, "https://github.com/3", record.Value)
+
+	revisions, err := r.GetRevisions(ctx, "first")
+	assert.Nil(t, err)
+	assert.Len(t, revisions, 2)
+	assert.Equal(t, "https://github.com/1", revisions[0].Value)
+
+	assert.Nil(t, r.DeleteByUserID(ctx, "user", []string{"first"}))
+	total, err := r.Purge(ctx, "", time.Now())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, total)
+	assert.Equal(t, 0, countLines(t, fileName+revisionsFileSuffix))
+	assert.Nil(t, r.Close())
+}
+
+func TestFileRepositoryCounter(t *testing.T) {
+	ctx := context.Background()
+
+	fileName := filepath.Join(t.TempDir(), "storage.json")
+	r := newTestFileRepository(t, fileName)
+
+	for expected := uint64(1); expected <= 3; expected++ {
+		value, err := r.NextCounter(ctx)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, value)
+	}
+	assert.Nil(t, r.Close())
+
+	_, err := os.Stat(fileName + counterFileSuffix + ".tmp")
+	assert.True(t, os.IsNotExist(err))
+
+	// the file keeps the end of the reserved block
+	data, err := os.ReadFile(fileName + counterFileSuffix)
+	assert.Nil(t, err)
+	assert.Equal(t, "1000", strings.TrimSpace(string(data)))
+
+	r = newTestFileRepository(t, fileName)
+	value, err := r.NextCounter(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(counterBlockSize+1), value)
+	assert.Nil(t, r.Close())
+}
+
+func TestFileRepositoryBrokenCounter(t *testing.T) {
+	ctx := context.Background()
+
+	for _, data := range []string{"", "12ab"} {
+		fileName := filepath.Join(t.TempDir(), "storage.json")
+		writeTestLog(t, fileName, firstTestEntry+secondTestEntry)
+		writeTestLog(t, fileName+counterFileSuffix, data)
+
+		r := newTestFileRepository(t, fileName)
+		value, err := r.NextCounter(ctx)
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(3), value)
+		assert.Nil(t, r.Close())
+	}
+}
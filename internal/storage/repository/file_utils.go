@@ -1,10 +1,19 @@
 package repository
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
 )
 
 type producer struct {
@@ -23,54 +32,304 @@ func NewProducer(fileName string) (*producer, error) {
 	}, nil
 }
 
-func (p *producer) Write(record *Record) error {
-	return p.encoder.Encode(&record)
+func (p *producer) Write(v interface{}) error {
+	return p.encoder.Encode(v)
+}
+
+func (p *producer) Sync() error {
+	return p.file.Sync()
 }
 
 func (p *producer) Close() error {
 	return p.file.Close()
 }
 
+// rewriteFile atomically replaces the file with content written by write
+func rewriteFile(fileName string, write func(p *producer) error) error {
+	tmpFileName := fileName + ".tmp"
+	if err := os.Remove(tmpFileName); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	p, err := NewProducer(tmpFileName)
+	if err != nil {
+		return err
+	}
+
+	if err = write(p); err != nil {
+		p.Close()
+		return err
+	}
+
+	if err = p.Sync(); err != nil {
+		p.Close()
+		return err
+	}
+
+	if err = p.Close(); err != nil {
+		return err
+	}
+
+	if err = os.Rename(tmpFileName, fileName); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(fileName))
+}
+
+func syncDir(dirName string) error {
+	dir, err := os.Open(dirName)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	return dir.Sync()
+}
+
+// RecoveryStrict fails on any broken entry, RecoveryTruncate drops the
+// incomplete last entry and RecoverySkip also skips broken complete entries
+const (
+	RecoveryStrict   = "strict"
+	RecoveryTruncate = "truncate"
+	RecoverySkip     = "skip"
+)
+
 type consumer struct {
-	file    *os.File
-	decoder *json.Decoder
+	fileName string
+	file     *os.File
+	reader   *bufio.Reader
+	recovery string
+	l        logrus.FieldLogger
 }
 
-func NewConsumer(fileName string) (*consumer, error) {
+func NewConsumer(fileName string, recovery string, l logrus.FieldLogger) (*consumer, error) {
 	file, err := os.OpenFile(fileName, os.O_RDONLY|os.O_CREATE, 0777)
 	if err != nil {
 		return nil, err
 	}
 	return &consumer{
-		file:    file,
-		decoder: json.NewDecoder(file),
+		fileName: fileName,
+		file:     file,
+		reader:   bufio.NewReader(file),
+		recovery: recovery,
+		l:        l,
 	}, nil
 }
 
-func (c *consumer) Read() (*Record, error) {
-	record := &Record{}
-	if err := c.decoder.Decode(&record); err != nil {
-		return nil, err
+// replay passes every line of the log to decode and returns the number of
+// decoded entries, broken lines are handled according to the recovery mode
+func (c *consumer) replay(decode func(data []byte) error) (int, error) {
+	var (
+		entries int
+		offset  int64
+	)
+
+	for {
+		line, err := c.reader.ReadBytes('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return entries, err
+		}
+		if len(line) == 0 {
+			return entries, nil
+		}
+
+		complete := line[len(line)-1] == '\n'
+		data := bytes.TrimSpace(line)
+		if len(data) == 0 {
+			offset += int64(len(line))
+			continue
+		}
+
+		decodeErr := decode(data)
+		if decodeErr == nil {
+			entries++
+			offset += int64(len(line))
+			if !complete {
+				return entries, c.appendLineBreak()
+			}
+			continue
+		}
+
+		// only the last entry without line break is an interrupted write,
+		// a complete broken entry in the middle of the log is never truncated
+		switch {
+		case c.recovery != RecoveryStrict && !complete:
+			return entries, c.truncate(offset)
+		case c.recovery == RecoverySkip:
+			c.l.Warnf("storage: skip broken entry in %s at offset %d: %v", c.fileName, offset, decodeErr)
+			offset += int64(len(line))
+		default:
+			return entries, fmt.Errorf("broken entry in %s at offset %d: %w", c.fileName, offset, decodeErr)
+		}
 	}
-	return record, nil
 }
 
-func (c *consumer) ReadAll() (map[string]*Record, error) {
+func (c *consumer) truncate(offset int64) error {
+	info, err := c.file.Stat()
+	if err != nil {
+		return err
+	}
+
+	c.l.Warnf(
+		"storage: truncate broken tail of %s at offset %d, %d bytes dropped",
+		c.fileName, offset, info.Size()-offset,
+	)
+	return os.Truncate(c.fileName, offset)
+}
+
+// appendLineBreak finishes the last entry written without line break,
+// so next entries are not glued to it
+func (c *consumer) appendLineBreak() error {
+	file, err := os.OpenFile(c.fileName, os.O_WRONLY|os.O_APPEND, 0777)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.Write([]byte("\n"))
+	return err
+}
+
+// ReadAll replays the log and returns the last state of every record
+// and the number of replayed entries
+func (c *consumer) ReadAll() (map[string]*Record, int, error) {
 	db := make(map[string]*Record)
-	for {
+	entries, err := c.replay(func(data []byte) error {
 		record := &Record{}
-		if err := c.decoder.Decode(&record); err != nil {
-			if errors.Is(err, io.EOF) {
-				break
-			}
-			return nil, err
+		if err := json.Unmarshal(data, record); err != nil {
+			return err
 		}
+		record.upgrade()
 		db[record.Key] = record
+		return nil
+	})
+	if err != nil {
+		return nil, entries, err
+	}
+
+	return db, entries, nil
+}
+
+func (c *consumer) ReadAllClicks() (map[string][]*Click, error) {
+	clicks := make(map[string][]*Click)
+	_, err := c.replay(func(data []byte) error {
+		click := &Click{}
+		if err := json.Unmarshal(data, click); err != nil {
+			return err
+		}
+		clicks[click.Key] = append(clicks[click.Key], click)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	return db, nil
+	return clicks, nil
+}
+
+// ReadAllTasks replays the log of delete tasks and returns pending ones
+// and the number of acked entries in the log
+func (c *consumer) ReadAllTasks() (map[string]*DeleteTask, int, error) {
+	tasks := make(map[string]*DeleteTask)
+	acked := 0
+	_, err := c.replay(func(data []byte) error {
+		task := &DeleteTask{}
+		if err := json.Unmarshal(data, task); err != nil {
+			return err
+		}
+		if task.Done {
+			delete(tasks, task.ID)
+			acked++
+		} else {
+			tasks[task.ID] = task
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, acked, err
+	}
+
+	return tasks, acked, nil
+}
+
+// ReadAllRevisions replays the log of revisions and returns
+// revisions of every record in order of versions
+func (c *consumer) ReadAllRevisions() (map[string][]*Revision, error) {
+	revisions := make(map[string][]*Revision)
+	_, err := c.replay(func(data []byte) error {
+		revision := &Revision{}
+		if err := json.Unmarshal(data, revision); err != nil {
+			return err
+		}
+		revisions[revision.Key] = append(revisions[revision.Key], revision)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return revisions, nil
 }
 
 func (c *consumer) Close() error {
 	return c.file.Close()
 }
+
+// counterBlockSize is a number of values reserved by a single write,
+// so generation of ids doesn't sync the file every time
+const counterBlockSize = 1000
+
+// counter hands out values from the reserved block, the file keeps the upper
+// bound of the block, so values are never reused after restart
+type counter struct {
+	mu       *sync.Mutex
+	fileName string
+	value    uint64
+	limit    uint64
+}
+
+// NewCounter loads the counter, an empty or broken file is replaced by
+// the fallback value rebuilt from the number of log entries, ids which
+// were already issued are found taken and skipped by the generator
+func NewCounter(fileName string, fallback uint64, l logrus.FieldLogger) (*counter, error) {
+	c := &counter{mu: &sync.Mutex{}, fileName: fileName, value: fallback}
+
+	data, err := os.ReadFile(fileName)
+	if errors.Is(err, os.ErrNotExist) {
+		c.limit = c.value
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		l.Warnf("storage: rebuild broken counter %s from %d log entries: %v", fileName, fallback, err)
+	} else {
+		c.value = value
+	}
+	c.limit = c.value
+	return c, nil
+}
+
+// Next returns the next value, a new block is reserved by atomic
+// replace of the file when the current one is over
+func (c *counter) Next() (uint64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.value == c.limit {
+		limit := c.limit + counterBlockSize
+		err := rewriteFile(c.fileName, func(p *producer) error {
+			return p.Write(limit)
+		})
+		if err != nil {
+			return 0, err
+		}
+		c.limit = limit
+	}
+
+	c.value++
+	return c.value, nil
+}
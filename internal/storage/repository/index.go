@@ -0,0 +1,102 @@
+package repository
+
+// index keeps keys of records grouped by value and by user id,
+// so lookups don't need a full scan of the records.
+// It isn't safe for concurrent use, repositories guard it with their lock.
+type index struct {
+	byValue map[string]map[string]struct{}
+	byUser  map[string]map[string]struct{}
+}
+
+func newIndex(db map[string]*Record) *index {
+	i := &index{
+		byValue: make(map[string]map[string]struct{}, len(db)),
+		byUser:  make(map[string]map[string]struct{}),
+	}
+	for _, record := range db {
+		i.add(record)
+	}
+	return i
+}
+
+func addKey(keys map[string]map[string]struct{}, name string, key string) {
+	if _, ok := keys[name]; !ok {
+		keys[name] = make(map[string]struct{}, 1)
+	}
+	keys[name][key] = struct{}{}
+}
+
+func removeKey(keys map[string]map[string]struct{}, name string, key string) {
+	delete(keys[name], key)
+	if len(keys[name]) == 0 {
+		delete(keys, name)
+	}
+}
+
+func (i *index) add(record *Record) {
+	addKey(i.byValue, record.Value, record.Key)
+	addKey(i.byUser, record.UserID, record.Key)
+}
+
+func (i *index) remove(record *Record) {
+	removeKey(i.byValue, record.Value, record.Key)
+	removeKey(i.byUser, record.UserID, record.Key)
+}
+
+// findByValue returns any record with the value,
+// records of all users are used when user id is empty
+func (i *index) findByValue(db map[string]*Record, value string, userID string) *Record {
+	for key := range i.byValue[value] {
+		record := db[key]
+		if userID == "" || record.IsOwner(userID) {
+			return record
+		}
+	}
+	return nil
+}
+
+// splitBatch returns a stored record for every record of the batch in the
+// same order and records which must be inserted, duplicates inside of the
+// batch are resolved to the first of them
+func (i *index) splitBatch(
+	db map[string]*Record,
+	records []*Record,
+	dedupScope string,
+) ([]*Record, []*Record, error) {
+	result := make([]*Record, 0, len(records))
+	newRecords := make([]*Record, 0, len(records))
+	pending := make(map[string]*Record, len(records))
+
+	for _, record := range records {
+		if dedupScope == DedupNone {
+			result = append(result, record)
+			newRecords = append(newRecords, record)
+			continue
+		}
+
+		userID := dedupOwner(record, dedupScope)
+		if oldRecord := i.findByValue(db, record.Value, userID); oldRecord != nil {
+			result = append(result, oldRecord)
+			continue
+		}
+
+		name := userID + "\x00" + record.Value
+		if oldRecord, ok := pending[name]; ok {
+			result = append(result, oldRecord)
+			continue
+		}
+
+		pending[name] = record
+		result = append(result, record)
+		newRecords = append(newRecords, record)
+	}
+
+	if err := checkUniqueKeys(db, newRecords...); err != nil {
+		return nil, nil, err
+	}
+	return result, newRecords, nil
+}
+
+func (i *index) keysByUser(userID string) map[string]struct{} {
+	return i.byUser[userID]
+}
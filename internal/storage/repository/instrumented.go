@@ -0,0 +1,228 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// OperationObserver receives latency of every storage operation
+type OperationObserver interface {
+	ObserveOperation(backend string, operation string, duration time.Duration, err error)
+}
+
+// instrumentedRepository reports latency of operations of another
+// repository to the observer
+type instrumentedRepository struct {
+	StorageRepository
+
+	backend string
+	o       OperationObserver
+}
+
+func NewInstrumentedRepository(r StorageRepository, o OperationObserver) StorageRepository {
+	return &instrumentedRepository{
+		StorageRepository: r,
+		backend:           r.Stats().Backend,
+		o:                 o,
+	}
+}
+
+// observe reports the operation, missing and duplicated records
+// are expected results, so they aren't reported as errors
+func (r *instrumentedRepository) observe(operation string, start time.Time, err error) {
+	if errors.Is(err, ErrNotFound) || errors.Is(err, ErrConflict) {
+		err = nil
+	}
+	r.o.ObserveOperation(r.backend, operation, time.Since(start), err)
+}
+
+func (r *instrumentedRepository) GetByKey(ctx context.Context, key string) (*Record, error) {
+	start := time.Now()
+	record, err := r.StorageRepository.GetByKey(ctx, key)
+	r.observe("get_by_key", start, err)
+	return record, err
+}
+
+func (r *instrumentedRepository) GetByKeys(ctx context.Context, keys []string) ([]*Record, error) {
+	start := time.Now()
+	records, err := r.StorageRepository.GetByKeys(ctx, keys)
+	r.observe("get_by_keys", start, err)
+	return records, err
+}
+
+func (r *instrumentedRepository) GetByValue(
+	ctx context.Context,
+	value string,
+	userID string,
+) (*Record, error) {
+	start := time.Now()
+	record, err := r.StorageRepository.GetByValue(ctx, value, userID)
+	r.observe("get_by_value", start, err)
+	return record, err
+}
+
+func (r *instrumentedRepository) GetAllByUserID(ctx context.Context, userID string) ([]*Record, error) {
+	start := time.Now()
+	records, err := r.StorageRepository.GetAllByUserID(ctx, userID)
+	r.observe("get_all_by_user_id", start, err)
+	return records, err
+}
+
+func (r *instrumentedRepository) ListByUserID(ctx context.Context, q *ListQuery) (*Page, error) {
+	start := time.Now()
+	page, err := r.StorageRepository.ListByUserID(ctx, q)
+	r.observe("list_by_user_id", start, err)
+	return page, err
+}
+
+func (r *instrumentedRepository) Save(ctx context.Context, record *Record) error {
+	start := time.Now()
+	err := r.StorageRepository.Save(ctx, record)
+	r.observe("save", start, err)
+	return err
+}
+
+func (r *instrumentedRepository) SaveOrGet(
+	ctx context.Context,
+	record *Record,
+	dedupScope string,
+) (*Record, bool, error) {
+	start := time.Now()
+	stored, created, err := r.StorageRepository.SaveOrGet(ctx, record, dedupScope)
+	r.observe("save_or_get", start, err)
+	return stored, created, err
+}
+
+func (r *instrumentedRepository) SaveBatchOfURL(ctx context.Context, records []*Record) error {
+	start := time.Now()
+	err := r.StorageRepository.SaveBatchOfURL(ctx, records)
+	r.observe("save_batch", start, err)
+	return err
+}
+
+func (r *instrumentedRepository) SaveOrGetBatch(
+	ctx context.Context,
+	records []*Record,
+	dedupScope string,
+) ([]*Record, error) {
+	start := time.Now()
+	result, err := r.StorageRepository.SaveOrGetBatch(ctx, records, dedupScope)
+	r.observe("save_or_get_batch", start, err)
+	return result, err
+}
+
+func (r *instrumentedRepository) UpdateValue(
+	ctx context.Context,
+	userID string,
+	key string,
+	value string,
+	dedupScope string,
+	now time.Time,
+) (*Record, error) {
+	start := time.Now()
+	record, err := r.StorageRepository.UpdateValue(ctx, userID, key, value, dedupScope, now)
+	r.observe("update_value", start, err)
+	return record, err
+}
+
+func (r *instrumentedRepository) GetRevisions(ctx context.Context, key string) ([]*Revision, error) {
+	start := time.Now()
+	revisions, err := r.StorageRepository.GetRevisions(ctx, key)
+	r.observe("get_revisions", start, err)
+	return revisions, err
+}
+
+func (r *instrumentedRepository) DeleteByUserID(ctx context.Context, userID string, keys []string) error {
+	start := time.Now()
+	err := r.StorageRepository.DeleteByUserID(ctx, userID, keys)
+	r.observe("delete_by_user_id", start, err)
+	return err
+}
+
+func (r *instrumentedRepository) Restore(
+	ctx context.Context,
+	userID string,
+	keys []string,
+	deletedAfter time.Time,
+	now time.Time,
+) ([]string, error) {
+	start := time.Now()
+	restored, err := r.StorageRepository.Restore(ctx, userID, keys, deletedAfter, now)
+	r.observe("restore", start, err)
+	return restored, err
+}
+
+func (r *instrumentedRepository) DeleteExpired(ctx context.Context, now time.Time) (int, error) {
+	start := time.Now()
+	total, err := r.StorageRepository.DeleteExpired(ctx, now)
+	r.observe("delete_expired", start, err)
+	return total, err
+}
+
+func (r *instrumentedRepository) Purge(ctx context.Context, userID string, before time.Time) (int, error) {
+	start := time.Now()
+	total, err := r.StorageRepository.Purge(ctx, userID, before)
+	r.observe("purge", start, err)
+	return total, err
+}
+
+func (r *instrumentedRepository) NextCounter(ctx context.Context) (uint64, error) {
+	start := time.Now()
+	value, err := r.StorageRepository.NextCounter(ctx)
+	r.observe("next_counter", start, err)
+	return value, err
+}
+
+func (r *instrumentedRepository) SaveClicks(ctx context.Context, clicks []*Click) error {
+	start := time.Now()
+	err := r.StorageRepository.SaveClicks(ctx, clicks)
+	r.observe("save_clicks", start, err)
+	return err
+}
+
+func (r *instrumentedRepository) GetClickStats(
+	ctx context.Context,
+	key string,
+	topReferrers int,
+) (*ClickStats, error) {
+	start := time.Now()
+	stats, err := r.StorageRepository.GetClickStats(ctx, key, topReferrers)
+	r.observe("get_click_stats", start, err)
+	return stats, err
+}
+
+func (r *instrumentedRepository) SaveDeleteTask(ctx context.Context, task *DeleteTask) error {
+	start := time.Now()
+	err := r.StorageRepository.SaveDeleteTask(ctx, task)
+	r.observe("save_delete_task", start, err)
+	return err
+}
+
+func (r *instrumentedRepository) AckDeleteTask(ctx context.Context, id string) error {
+	start := time.Now()
+	err := r.StorageRepository.AckDeleteTask(ctx, id)
+	r.observe("ack_delete_task", start, err)
+	return err
+}
+
+func (r *instrumentedRepository) BuryDeleteTask(ctx context.Context, task *DeleteTask) error {
+	start := time.Now()
+	err := r.StorageRepository.BuryDeleteTask(ctx, task)
+	r.observe("bury_delete_task", start, err)
+	return err
+}
+
+func (r *instrumentedRepository) GetDeleteTasks(ctx context.Context) ([]*DeleteTask, error) {
+	start := time.Now()
+	tasks, err := r.StorageRepository.GetDeleteTasks(ctx)
+	r.observe("get_delete_tasks", start, err)
+	return tasks, err
+}
+
+func (r *instrumentedRepository) Compact(ctx context.Context) error {
+	start := time.Now()
+	err := r.StorageRepository.Compact(ctx)
+	r.observe("compact", start, err)
+	return err
+}
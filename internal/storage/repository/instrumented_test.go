@@ -0,0 +1,39 @@
+package repository
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testObservation struct {
+	backend   string
+	operation string
+	err       error
+}
+
+type testObserver struct {
+	observations []testObservation
+}
+
+func (o *testObserver) ObserveOperation(backend string, operation string, _ time.Duration, err error) {
+	o.observations = append(o.observations, testObservation{backend, operation, err})
+}
+
+func TestInstrumentedRepository(t *testing.T) {
+	ctx := context.Background()
+	o := &testObserver{}
+	inner, _ := NewMemoryRepository()
+	r := NewInstrumentedRepository(inner, o)
+
+	assert.Nil(t, r.Save(ctx, &Record{Key: "first", Value: "https://github.com/1"}))
+	_, err := r.GetByKey(ctx, "unknown")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	assert.Equal(t, []testObservation{
+		{backend: "memory", operation: "save"},
+		{backend: "memory", operation: "get_by_key"},
+	}, o.observations)
+}
@@ -0,0 +1,114 @@
+package repository
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	SortCreatedAsc  = "created_at"
+	SortCreatedDesc = "-created_at"
+)
+
+// Cursor points to the last record of the previous page
+type Cursor struct {
+	CreatedAt time.Time `json:"created_at"`
+	Key       string    `json:"key"`
+}
+
+// ListQuery describes a page of records of the user, records are ordered
+// by creation time and key, so pages are stable while records are added
+type ListQuery struct {
+	UserID  string
+	Removed bool
+	Search  string
+	Domain  string
+	Sort    string
+	Cursor  *Cursor
+	Limit   int
+}
+
+// Page is a part of the records matched by the query, total is
+// a number of all matched records and next is empty on the last page
+type Page struct {
+	Records []*Record
+	Total   int
+	Next    *Cursor
+}
+
+func (q *ListQuery) isDesc() bool {
+	return q.Sort == SortCreatedDesc
+}
+
+// match checks the filters of the query for the repositories
+// without query language, the owner is checked by the caller
+func (q *ListQuery) match(record *Record) bool {
+	if record.Removed != q.Removed {
+		return false
+	}
+
+	if q.Search != "" && !strings.Contains(strings.ToLower(record.Value), strings.ToLower(q.Search)) {
+		return false
+	}
+
+	if q.Domain != "" && !matchDomain(record.Value, q.Domain) {
+		return false
+	}
+	return true
+}
+
+// matchDomain checks that the host of the url is the domain or its subdomain
+func matchDomain(value string, domain string) bool {
+	u, err := url.Parse(value)
+	if err != nil {
+		return false
+	}
+
+	host := strings.ToLower(u.Hostname())
+	domain = strings.ToLower(domain)
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+// less compares records in order of the query
+func (q *ListQuery) less(a *Record, b *Record) bool {
+	if !a.CreatedAt.Equal(b.CreatedAt) {
+		return a.CreatedAt.Before(b.CreatedAt) != q.isDesc()
+	}
+	if q.isDesc() {
+		return a.Key > b.Key
+	}
+	return a.Key < b.Key
+}
+
+// after checks that the record follows the cursor in order of the query
+func (q *ListQuery) after(record *Record) bool {
+	if q.Cursor == nil {
+		return true
+	}
+	return q.less(&Record{Key: q.Cursor.Key, CreatedAt: q.Cursor.CreatedAt}, record)
+}
+
+// paginate sorts matched records and cuts the page of the query
+// for the repositories without query language
+func paginate(records []*Record, q *ListQuery) *Page {
+	sort.Slice(records, func(i, j int) bool {
+		return q.less(records[i], records[j])
+	})
+
+	page := &Page{Records: make([]*Record, 0, q.Limit), Total: len(records)}
+	for _, record := range records {
+		if !q.after(record) {
+			continue
+		}
+
+		if len(page.Records) == q.Limit {
+			last := page.Records[len(page.Records)-1]
+			page.Next = &Cursor{CreatedAt: last.CreatedAt, Key: last.Key}
+			break
+		}
+		page.Records = append(page.Records, record)
+	}
+	return page
+}
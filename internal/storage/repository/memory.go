@@ -1,96 +1,340 @@
 package repository
 
 import (
-	"errors"
+	"context"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type memoryRepository struct {
-	mu *sync.RWMutex
-	db map[string]*Record
+	mu        *sync.RWMutex
+	db        map[string]*Record
+	index     *index
+	revisions map[string][]*Revision
+	counter   uint64
+	clicksMu  *sync.RWMutex
+	clicks    map[string][]*Click
+	tasksMu   *sync.Mutex
+	tasks     map[string]*DeleteTask
 }
 
 func NewMemoryRepository() (StorageRepository, error) {
 	repo := &memoryRepository{
-		mu: &sync.RWMutex{},
-		db: make(map[string]*Record),
+		mu:        &sync.RWMutex{},
+		db:        make(map[string]*Record),
+		index:     newIndex(nil),
+		revisions: make(map[string][]*Revision),
+		clicksMu:  &sync.RWMutex{},
+		clicks:    make(map[string][]*Click),
+		tasksMu:   &sync.Mutex{},
+		tasks:     make(map[string]*DeleteTask),
 	}
 	return repo, nil
 }
 
-func (r *memoryRepository) GetByKey(key string) (*Record, error) {
+func (r *memoryRepository) GetByKey(_ context.Context, key string) (*Record, error) {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 
 	record, ok := r.db[key]
 	if !ok {
-		return record, errors.New("not found url")
+		return nil, ErrNotFound
 	}
 	return record, nil
 }
 
-func (r *memoryRepository) GetByValue(value string) (*Record, error) {
+// GetByKeys returns found records, unknown keys are skipped
+func (r *memoryRepository) GetByKeys(_ context.Context, keys []string) ([]*Record, error) {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 
-	for _, record := range r.db {
-		if record.Value == value {
-			return record, nil
+	result := make([]*Record, 0, len(keys))
+	for _, key := range keys {
+		if record, ok := r.db[key]; ok {
+			result = append(result, record)
 		}
 	}
-	return nil, nil
+	return result, nil
 }
 
-func (r *memoryRepository) GetAllByUserID(userID string) ([]*Record, error) {
+// GetByValue returns any record with the value,
+// records of all users are used when user id is empty
+func (r *memoryRepository) GetByValue(_ context.Context, value string, userID string) (*Record, error) {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 
-	result := make([]*Record, 0, 100)
-	for _, record := range r.db {
-		if record.UserID == userID {
-			result = append(result, record)
-		}
+	return r.index.findByValue(r.db, value, userID), nil
+}
+
+func (r *memoryRepository) GetAllByUserID(_ context.Context, userID string) ([]*Record, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	keys := r.index.keysByUser(userID)
+	result := make([]*Record, 0, len(keys))
+	for key := range keys {
+		result = append(result, r.db[key])
 	}
 	return result, nil
 }
 
-func (r *memoryRepository) Save(record *Record) error {
+func (r *memoryRepository) ListByUserID(_ context.Context, q *ListQuery) (*Page, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	keys := r.index.keysByUser(q.UserID)
+	records := make([]*Record, 0, len(keys))
+	for key := range keys {
+		if record := r.db[key]; q.match(record) {
+			records = append(records, record)
+		}
+	}
+	return paginate(records, q), nil
+}
+
+func (r *memoryRepository) Save(_ context.Context, record *Record) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
+	if err := checkUniqueKeys(r.db, record); err != nil {
+		return err
+	}
+
+	record.stamp(time.Now().UTC())
 	r.db[record.Key] = record
+	r.index.add(record)
 	return nil
 }
 
-func (r *memoryRepository) SaveBatchOfURL(records []*Record) error {
+func (r *memoryRepository) SaveBatchOfURL(_ context.Context, records []*Record) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
+	if err := checkUniqueKeys(r.db, records...); err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
 	for _, record := range records {
+		record.stamp(now)
 		r.db[record.Key] = record
+		r.index.add(record)
 	}
 	return nil
 }
 
-func (r *memoryRepository) DeleteByUserID(userID string, keys []string) error {
+// saveOrGet saves records which have no duplicates and returns a stored
+// record for every record and the saved ones, the caller must hold the lock
+func (r *memoryRepository) saveOrGet(records []*Record, dedupScope string) ([]*Record, []*Record, error) {
+	result, newRecords, err := r.index.splitBatch(r.db, records, dedupScope)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now().UTC()
+	for _, record := range newRecords {
+		record.stamp(now)
+		r.db[record.Key] = record
+		r.index.add(record)
+	}
+	return result, newRecords, nil
+}
+
+// SaveOrGet saves the record or returns already stored duplicate of it,
+// the flag reports whether the record was saved
+func (r *memoryRepository) SaveOrGet(_ context.Context, record *Record, dedupScope string) (*Record, bool, error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
+	result, newRecords, err := r.saveOrGet([]*Record{record}, dedupScope)
+	if err != nil {
+		return nil, false, err
+	}
+	return result[0], len(newRecords) > 0, nil
+}
+
+// SaveOrGetBatch saves new records of the batch and returns a stored
+// record for every record of the batch in the same order
+func (r *memoryRepository) SaveOrGetBatch(_ context.Context, records []*Record, dedupScope string) ([]*Record, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	result, _, err := r.saveOrGet(records, dedupScope)
+	return result, err
+}
+
+// UpdateValue changes the value of the record of the user
+// and keeps the revision of it
+func (r *memoryRepository) UpdateValue(
+	_ context.Context,
+	userID string,
+	key string,
+	value string,
+	dedupScope string,
+	now time.Time,
+) (*Record, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	record, _, err := changeValue(r.db, r.index, r.revisions, userID, key, value, dedupScope, now)
+	return record, err
+}
+
+func (r *memoryRepository) GetRevisions(_ context.Context, key string) ([]*Revision, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return copyRevisions(r.revisions[key]), nil
+}
+
+func (r *memoryRepository) DeleteByUserID(_ context.Context, userID string, keys []string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now().UTC()
 	for _, key := range keys {
 		record, ok := r.db[key]
 		if !ok {
 			continue
 		}
-		if !record.IsOwner(userID) {
+		if !record.IsOwnerAndExists(userID) {
+			continue
+		}
+		record = record.removedAt(now)
+		r.db[key] = record
+	}
+	return nil
+}
+
+// Restore brings back removed records and returns their keys
+func (r *memoryRepository) Restore(
+	_ context.Context,
+	userID string,
+	keys []string,
+	deletedAfter time.Time,
+	now time.Time,
+) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	restored := make([]string, 0, len(keys))
+	for _, key := range keys {
+		record, ok := r.db[key]
+		if !ok || !record.IsRestorable(userID, deletedAfter, now) {
 			continue
 		}
-		record.Removed = true
+		record = record.restoredAt(now)
 		r.db[key] = record
+		restored = append(restored, key)
+	}
+	return restored, nil
+}
+
+func (r *memoryRepository) DeleteExpired(_ context.Context, now time.Time) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	total := 0
+	for _, record := range r.db {
+		if record.Removed || !record.IsExpired(now) {
+			continue
+		}
+		record = record.removedAt(now)
+		r.db[record.Key] = record
+		total++
 	}
+	return total, nil
+}
+
+func (r *memoryRepository) Purge(_ context.Context, userID string, before time.Time) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.clicksMu.Lock()
+	defer r.clicksMu.Unlock()
+
+	total := 0
+	for key, record := range r.db {
+		if !record.IsPurgeable(userID, before) {
+			continue
+		}
+		delete(r.db, key)
+		r.index.remove(record)
+		delete(r.revisions, key)
+		delete(r.clicks, key)
+		total++
+	}
+	return total, nil
+}
+
+func (r *memoryRepository) NextCounter(_ context.Context) (uint64, error) {
+	return atomic.AddUint64(&r.counter, 1), nil
+}
+
+func (r *memoryRepository) SaveClicks(_ context.Context, clicks []*Click) error {
+	r.clicksMu.Lock()
+	defer r.clicksMu.Unlock()
+
+	for _, click := range clicks {
+		r.clicks[click.Key] = append(r.clicks[click.Key], click)
+	}
+	return nil
+}
+
+func (r *memoryRepository) GetClickStats(_ context.Context, key string, topReferrers int) (*ClickStats, error) {
+	r.clicksMu.RLock()
+	defer r.clicksMu.RUnlock()
+
+	return buildClickStats(r.clicks[key], topReferrers), nil
+}
+
+func (r *memoryRepository) SaveDeleteTask(_ context.Context, task *DeleteTask) error {
+	r.tasksMu.Lock()
+	defer r.tasksMu.Unlock()
+
+	r.tasks[task.ID] = task
+	return nil
+}
+
+func (r *memoryRepository) AckDeleteTask(_ context.Context, id string) error {
+	r.tasksMu.Lock()
+	defer r.tasksMu.Unlock()
+
+	delete(r.tasks, id)
+	return nil
+}
+
+// BuryDeleteTask keeps the failed task as a dead letter until it is acked
+func (r *memoryRepository) BuryDeleteTask(_ context.Context, task *DeleteTask) error {
+	r.tasksMu.Lock()
+	defer r.tasksMu.Unlock()
+
+	if stored, ok := r.tasks[task.ID]; ok {
+		r.tasks[task.ID] = stored.bury(task)
+	}
+	return nil
+}
+
+func (r *memoryRepository) GetDeleteTasks(_ context.Context) ([]*DeleteTask, error) {
+	r.tasksMu.Lock()
+	defer r.tasksMu.Unlock()
+
+	return sortDeleteTasks(r.tasks), nil
+}
+
+func (r *memoryRepository) Compact(_ context.Context) error {
 	return nil
 }
 
-func (r *memoryRepository) Status() error {
+func (r *memoryRepository) Stats() *Stats {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return &Stats{Backend: "memory", Records: len(r.db)}
+}
+
+func (r *memoryRepository) Status(_ context.Context) error {
 	return nil
 }
 
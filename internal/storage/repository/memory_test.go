@@ -0,0 +1,234 @@
+package repository
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryRepositoryIndex(t *testing.T) {
+	ctx := context.Background()
+
+	r, _ := NewMemoryRepository()
+
+	assert.Nil(t, r.Save(ctx, &Record{Key: "first", Value: "https://github.com/1", UserID: "user"}))
+	assert.Nil(t, r.SaveBatchOfURL(ctx, []*Record{
+		{Key: "second", Value: "https://github.com/2", UserID: "user"},
+		{Key: "third", Value: "https://github.com/3", UserID: "other"},
+	}))
+
+	record, err := r.GetByValue(ctx, "https://github.com/2", "")
+	assert.Nil(t, err)
+	assert.Equal(t, "second", record.Key)
+
+	record, err = r.GetByValue(ctx, "https://github.com/3", "user")
+	assert.Nil(t, err)
+	assert.Nil(t, record)
+
+	records, err := r.GetAllByUserID(ctx, "user")
+	assert.Nil(t, err)
+	assert.Len(t, records, 2)
+
+	assert.Nil(t, r.DeleteByUserID(ctx, "user", []string{"first"}))
+	total, err := r.Purge(ctx, "", time.Now())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, total)
+
+	record, err = r.GetByValue(ctx, "https://github.com/1", "")
+	assert.Nil(t, err)
+	assert.Nil(t, record)
+
+	records, err = r.GetAllByUserID(ctx, "user")
+	assert.Nil(t, err)
+	assert.Len(t, records, 1)
+	assert.Equal(t, "second", records[0].Key)
+}
+
+func TestMemoryRepositorySaveOrGetBatch(t *testing.T) {
+	ctx := context.Background()
+
+	r, _ := NewMemoryRepository()
+
+	assert.Nil(t, r.Save(ctx, &Record{Key: "first", Value: "https://github.com/1", UserID: "user"}))
+
+	records, err := r.SaveOrGetBatch(ctx, []*Record{
+		{Key: "second", Value: "https://github.com/2", UserID: "other"},
+		{Key: "third", Value: "https://github.com/1", UserID: "other"},
+		{Key: "fourth", Value: "https://github.com/2", UserID: "other"},
+	}, DedupGlobal)
+	assert.Nil(t, err)
+	assert.Len(t, records, 3)
+	assert.Equal(t, "second", records[0].Key)
+	assert.Equal(t, "first", records[1].Key)
+	assert.Equal(t, "second", records[2].Key)
+
+	records, err = r.SaveOrGetBatch(ctx, []*Record{
+		{Key: "fifth", Value: "https://github.com/1", UserID: "other"},
+	}, DedupUser)
+	assert.Nil(t, err)
+	assert.Equal(t, "fifth", records[0].Key)
+
+	_, err = r.SaveOrGetBatch(ctx, []*Record{
+		{Key: "sixth", Value: "https://github.com/3", UserID: "user"},
+		{Key: "first", Value: "https://github.com/4", UserID: "user"},
+	}, DedupNone)
+	assert.IsType(t, &NotUniqueKeyError{}, err)
+
+	record, err := r.GetByValue(ctx, "https://github.com/3", "")
+	assert.Nil(t, err)
+	assert.Nil(t, record)
+}
+
+func TestMemoryRepositoryRestore(t *testing.T) {
+	ctx := context.Background()
+
+	r, _ := NewMemoryRepository()
+
+	past := time.Now().Add(-time.Hour)
+	assert.Nil(t, r.SaveBatchOfURL(ctx, []*Record{
+		{Key: "first", Value: "https://github.com/1", UserID: "user"},
+		{Key: "second", Value: "https://github.com/2", UserID: "user"},
+		{Key: "third", Value: "https://github.com/3", UserID: "other"},
+		{Key: "expired", Value: "https://github.com/4", UserID: "user", ExpiresAt: &past},
+	}))
+
+	// records returned to readers are not changed by deletion and restore
+	active, err := r.GetByKey(ctx, "first")
+	assert.Nil(t, err)
+
+	assert.Nil(t, r.DeleteByUserID(ctx, "user", []string{"first", "second", "expired"}))
+	assert.Nil(t, r.DeleteByUserID(ctx, "other", []string{"third"}))
+	assert.False(t, active.Removed)
+
+	removed, err := r.GetByKey(ctx, "first")
+	assert.Nil(t, err)
+
+	now := time.Now()
+	keys := []string{"first", "third", "expired", "unknown"}
+
+	restored, err := r.Restore(ctx, "user", keys, now.Add(time.Minute), now)
+	assert.Nil(t, err)
+	assert.Empty(t, restored)
+
+	restored, err = r.Restore(ctx, "user", keys, now.Add(-time.Minute), now)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"first"}, restored)
+	assert.True(t, removed.Removed)
+
+	record, err := r.GetByKey(ctx, "first")
+	assert.Nil(t, err)
+	assert.False(t, record.Removed)
+	assert.Nil(t, record.DeletedAt)
+
+	record, err = r.GetByKey(ctx, "second")
+	assert.Nil(t, err)
+	assert.True(t, record.Removed)
+}
+
+func TestMemoryRepositoryListByUserID(t *testing.T) {
+	ctx := context.Background()
+
+	r, _ := NewMemoryRepository()
+
+	now := time.Now().UTC()
+	assert.Nil(t, r.SaveBatchOfURL(ctx, []*Record{
+		{Key: "c", Value: "https://github.com/1", UserID: "user", CreatedAt: now},
+		{Key: "a", Value: "https://gist.github.com/2", UserID: "user", CreatedAt: now.Add(time.Second)},
+		{Key: "b", Value: "https://example.com/github", UserID: "user", CreatedAt: now.Add(time.Second)},
+		{Key: "d", Value: "https://github.com/4", UserID: "other", CreatedAt: now},
+		{Key: "e", Value: "https://github.com/5", UserID: "user", CreatedAt: now.Add(time.Minute)},
+	}))
+	assert.Nil(t, r.DeleteByUserID(ctx, "user", []string{"e"}))
+
+	keys := func(page *Page) []string {
+		result := make([]string, 0, len(page.Records))
+		for _, record := range page.Records {
+			result = append(result, record.Key)
+		}
+		return result
+	}
+
+	q := &ListQuery{UserID: "user", Sort: SortCreatedAsc, Limit: 2}
+	page, err := r.ListByUserID(ctx, q)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, page.Total)
+	assert.Equal(t, []string{"c", "a"}, keys(page))
+	assert.Equal(t, &Cursor{CreatedAt: now.Add(time.Second), Key: "a"}, page.Next)
+
+	q.Cursor = page.Next
+	page, err = r.ListByUserID(ctx, q)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, page.Total)
+	assert.Equal(t, []string{"b"}, keys(page))
+	assert.Nil(t, page.Next)
+
+	page, err = r.ListByUserID(ctx, &ListQuery{UserID: "user", Sort: SortCreatedDesc, Limit: 10})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"b", "a", "c"}, keys(page))
+
+	page, err = r.ListByUserID(ctx, &ListQuery{UserID: "user", Domain: "GitHub.com", Limit: 10})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, page.Total)
+	assert.Equal(t, []string{"c", "a"}, keys(page))
+
+	page, err = r.ListByUserID(ctx, &ListQuery{UserID: "user", Search: "GIST", Limit: 10})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a"}, keys(page))
+
+	page, err = r.ListByUserID(ctx, &ListQuery{UserID: "user", Removed: true, Limit: 10})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"e"}, keys(page))
+}
+
+func TestMemoryRepositoryUpdateValue(t *testing.T) {
+	ctx := context.Background()
+
+	r, _ := NewMemoryRepository()
+
+	created := time.Now().UTC().Add(-time.Hour)
+	assert.Nil(t, r.SaveBatchOfURL(ctx, []*Record{
+		{Key: "first", Value: "https://github.com/1", UserID: "user", CreatedAt: created},
+		{Key: "second", Value: "https://github.com/2", UserID: "other"},
+	}))
+
+	now := time.Now().UTC()
+	_, err := r.UpdateValue(ctx, "other", "first", "https://github.com/3", DedupGlobal, now)
+	assert.ErrorIs(t, err, ErrForbidden)
+
+	_, err = r.UpdateValue(ctx, "user", "unknown", "https://github.com/3", DedupGlobal, now)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	_, err = r.UpdateValue(ctx, "user", "first", "https://github.com/2", DedupGlobal, now)
+	assert.IsType(t, &NotUniqueValueError{}, err)
+
+	// records returned to readers are not changed by updates
+	read, err := r.GetByKey(ctx, "first")
+	assert.Nil(t, err)
+
+	_, err = r.UpdateValue(ctx, "user", "first", "https://github.com/2", DedupUser, now)
+	assert.Nil(t, err)
+	assert.Equal(t, "https://github.com/1", read.Value)
+
+	record, err := r.UpdateValue(ctx, "user", "first", "https://github.com/3", DedupGlobal, now)
+	assert.Nil(t, err)
+	assert.Equal(t, "https://github.com/3", record.Value)
+	assert.Equal(t, now, record.UpdatedAt)
+
+	found, err := r.GetByValue(ctx, "https://github.com/1", "")
+	assert.Nil(t, err)
+	assert.Nil(t, found)
+
+	revisions, err := r.GetRevisions(ctx, "first")
+	assert.Nil(t, err)
+	assert.Equal(t, []*Revision{
+		{Key: "first", Version: 1, Value: "https://github.com/1", CreatedAt: created},
+		{Key: "first", Version: 2, Value: "https://github.com/2", CreatedAt: now},
+		{Key: "first", Version: 3, Value: "https://github.com/3", CreatedAt: now},
+	}, revisions)
+
+	revisions, err = r.GetRevisions(ctx, "second")
+	assert.Nil(t, err)
+	assert.Empty(t, revisions)
+}
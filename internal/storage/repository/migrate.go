@@ -0,0 +1,376 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationsLockID is a key of pg advisory lock which is held
+// while migrations are applied or rolled back
+const migrationsLockID = 5837261940
+
+// dedupIndexVersion is a migration which creates the index of urls for the
+// default scope of deduplication, other scopes are set by SetDedupScope
+const dedupIndexVersion = 10
+
+type dedupIndex struct {
+	name       string
+	definition string
+}
+
+// dedupIndexes are the indexes of urls by scope of deduplication
+var dedupIndexes = map[string]dedupIndex{
+	DedupGlobal: {pgValueIndexName, `CREATE UNIQUE INDEX ` + pgValueIndexName + ` ON urls (value);`},
+	DedupUser:   {pgUserValueIndexName, `CREATE UNIQUE INDEX ` + pgUserValueIndexName + ` ON urls (user_id, value);`},
+	DedupNone:   {pgNotUniqueValueIndexName, `CREATE INDEX ` + pgNotUniqueValueIndexName + ` ON urls (value);`},
+}
+
+const dedupScopesQuery = `SELECT indexname FROM pg_indexes
+	WHERE schemaname = current_schema() AND tablename = 'urls';`
+
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// findDedupScopes returns the scopes of deduplication whose indexes exist
+func findDedupScopes(ctx context.Context, q queryer) ([]string, error) {
+	rows, err := q.QueryContext(ctx, dedupScopesQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	names := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names[name] = true
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	scopes := make([]string, 0, 1)
+	for _, scope := range []string{DedupGlobal, DedupUser, DedupNone} {
+		if names[dedupIndexes[scope].name] {
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes, nil
+}
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	AppliedAt *time.Time
+}
+
+// loadMigrations reads embedded scripts named as <version>_<name>.<up|down>.sql
+// and returns migrations ordered by version
+func loadMigrations() ([]*Migration, error) {
+	entries, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		fileName := entry.Name()
+
+		parts := strings.SplitN(strings.TrimSuffix(fileName, ".sql"), "_", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("bad migration file name: %s", fileName)
+		}
+
+		version, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("bad migration version: %s", fileName)
+		}
+
+		name, direction := parts[1], path.Ext(parts[1])
+		name = strings.TrimSuffix(name, direction)
+
+		data, err := migrationFiles.ReadFile(path.Join("migrations", fileName))
+		if err != nil {
+			return nil, err
+		}
+
+		migration, ok := byVersion[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: name}
+			byVersion[version] = migration
+		}
+		if migration.Name != name {
+			return nil, fmt.Errorf("duplicate migration version: %d", version)
+		}
+
+		switch direction {
+		case ".up":
+			migration.Up = string(data)
+		case ".down":
+			migration.Down = string(data)
+		default:
+			return nil, fmt.Errorf("bad migration direction: %s", fileName)
+		}
+	}
+
+	migrations := make([]*Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		if migration.Up == "" || migration.Down == "" {
+			return nil, fmt.Errorf("migration %d has no up or down script", migration.Version)
+		}
+		migrations = append(migrations, migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+type Migrator struct {
+	conn       *sql.DB
+	migrations []*Migration
+}
+
+func NewMigrator(conn *sql.DB) (*Migrator, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{conn: conn, migrations: migrations}, nil
+}
+
+// Up applies all not applied migrations and returns the number of them
+func (m *Migrator) Up(ctx context.Context) (int, error) {
+	total := 0
+	err := m.withLock(ctx, func(conn *sql.Conn, applied map[int]time.Time) error {
+		for _, migration := range m.migrations {
+			if _, ok := applied[migration.Version]; ok {
+				continue
+			}
+
+			err := m.apply(ctx, conn, migration.Up,
+				`INSERT INTO schema_migrations (version, name, applied_at) VALUES ($1, $2, now());`,
+				migration.Version, migration.Name,
+			)
+			if err != nil {
+				return fmt.Errorf("apply migration %d_%s: %w", migration.Version, migration.Name, err)
+			}
+			total++
+		}
+		return nil
+	})
+	return total, err
+}
+
+// Down rolls back the last applied migrations and returns the number of them
+func (m *Migrator) Down(ctx context.Context, steps int) (int, error) {
+	total := 0
+	err := m.withLock(ctx, func(conn *sql.Conn, applied map[int]time.Time) error {
+		for i := len(m.migrations) - 1; i >= 0 && total < steps; i-- {
+			migration := m.migrations[i]
+			if _, ok := applied[migration.Version]; !ok {
+				continue
+			}
+
+			err := m.apply(ctx, conn, migration.Down,
+				`DELETE FROM schema_migrations WHERE version = $1 AND name = $2;`,
+				migration.Version, migration.Name,
+			)
+			if err != nil {
+				return fmt.Errorf("rollback migration %d_%s: %w", migration.Version, migration.Name, err)
+			}
+			total++
+		}
+		return nil
+	})
+	return total, err
+}
+
+// Status returns all known migrations with time of their applying
+func (m *Migrator) Status(ctx context.Context) ([]*MigrationStatus, error) {
+	result := make([]*MigrationStatus, 0, len(m.migrations))
+	err := m.withLock(ctx, func(_ *sql.Conn, applied map[int]time.Time) error {
+		for _, migration := range m.migrations {
+			status := &MigrationStatus{Version: migration.Version, Name: migration.Name}
+			if appliedAt, ok := applied[migration.Version]; ok {
+				status.AppliedAt = &appliedAt
+			}
+			result = append(result, status)
+		}
+		return nil
+	})
+	return result, err
+}
+
+// DedupScopes returns the scopes of deduplication whose indexes exist,
+// the schema is consistent when there is exactly one of them
+func (m *Migrator) DedupScopes(ctx context.Context) ([]string, error) {
+	var scopes []string
+	err := m.withLock(ctx, func(conn *sql.Conn, _ map[int]time.Time) error {
+		var err error
+		scopes, err = findDedupScopes(ctx, conn)
+		return err
+	})
+	return scopes, err
+}
+
+// SetDedupScope replaces the index of urls by the index of the scope
+// of deduplication and reports whether the schema was changed
+func (m *Migrator) SetDedupScope(ctx context.Context, dedupScope string) (bool, error) {
+	index, ok := dedupIndexes[dedupScope]
+	if !ok {
+		return false, fmt.Errorf("unknown dedup scope: %s", dedupScope)
+	}
+
+	changed := false
+	err := m.withLock(ctx, func(conn *sql.Conn, applied map[int]time.Time) error {
+		if _, ok := applied[dedupIndexVersion]; !ok {
+			return fmt.Errorf("migration %d is not applied, run migrate up first", dedupIndexVersion)
+		}
+
+		scopes, err := findDedupScopes(ctx, conn)
+		if err != nil {
+			return err
+		}
+		if len(scopes) == 1 && scopes[0] == dedupScope {
+			return nil
+		}
+
+		script := ""
+		for _, scope := range scopes {
+			script += `DROP INDEX IF EXISTS ` + dedupIndexes[scope].name + `;`
+		}
+
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		if _, err = tx.ExecContext(ctx, script+index.definition); err != nil {
+			var pgErr *pq.Error
+			if errors.As(err, &pgErr) && pgErr.Code == pgUniqueViolationCode {
+				return fmt.Errorf(
+					"duplicate urls block index %s of dedup scope %s: %s",
+					index.name, dedupScope, pgErr.Detail,
+				)
+			}
+			return err
+		}
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+
+		changed = true
+		return nil
+	})
+	return changed, err
+}
+
+// withLock holds advisory lock on a single connection, so concurrent
+// instances don't run migrations at the same time
+func (m *Migrator) withLock(
+	ctx context.Context,
+	fn func(conn *sql.Conn, applied map[int]time.Time) error,
+) error {
+	conn, err := m.conn.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err = conn.ExecContext(ctx, `SELECT pg_advisory_lock($1);`, migrationsLockID); err != nil {
+		return err
+	}
+	defer conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1);`, migrationsLockID)
+
+	_, err = conn.ExecContext(ctx,
+		`CREATE TABLE IF NOT EXISTS
+			schema_migrations(
+				version INTEGER NOT NULL,
+				name VARCHAR NOT NULL,
+				applied_at TIMESTAMPTZ NOT NULL,
+				PRIMARY KEY (version)
+			);`,
+	)
+	if err != nil {
+		return err
+	}
+
+	applied, err := m.applied(ctx, conn)
+	if err != nil {
+		return err
+	}
+	return fn(conn, applied)
+}
+
+func (m *Migrator) applied(ctx context.Context, conn *sql.Conn) (map[int]time.Time, error) {
+	rows, err := conn.QueryContext(ctx, `SELECT version, applied_at FROM schema_migrations;`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make(map[int]time.Time)
+	for rows.Next() {
+		var (
+			version   int
+			appliedAt time.Time
+		)
+		if err = rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		result[version] = appliedAt
+	}
+	return result, rows.Err()
+}
+
+// apply runs the script and updates schema_migrations in one transaction
+func (m *Migrator) apply(
+	ctx context.Context,
+	conn *sql.Conn,
+	script string,
+	query string,
+	args ...interface{},
+) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.ExecContext(ctx, script); err != nil {
+		var pgErr *pq.Error
+		if errors.As(err, &pgErr) && pgErr.Detail != "" {
+			return fmt.Errorf("%w: %s", err, pgErr.Detail)
+		}
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, query, args...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS
+    urls(
+        key VARCHAR NOT NULL,
+        value VARCHAR NOT NULL,
+        user_id VARCHAR NOT NULL,
+        correlation_id VARCHAR NULL,
+        removed BOOL DEFAULT 'f',
+        PRIMARY KEY (key)
+    );
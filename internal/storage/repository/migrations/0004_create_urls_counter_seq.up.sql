@@ -0,0 +1 @@
+CREATE SEQUENCE IF NOT EXISTS urls_counter_seq;
@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS
+    clicks(
+        id BIGSERIAL,
+        key VARCHAR NOT NULL,
+        created_at TIMESTAMPTZ NOT NULL,
+        referer VARCHAR NOT NULL,
+        user_agent VARCHAR NOT NULL,
+        ip VARCHAR NOT NULL,
+        language VARCHAR NOT NULL,
+        PRIMARY KEY (id)
+    );
+CREATE INDEX IF NOT EXISTS clicks_key_created_at_idx ON clicks (key, created_at);
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS
+    delete_tasks(
+        id VARCHAR NOT NULL,
+        user_id VARCHAR NOT NULL,
+        keys VARCHAR[] NOT NULL,
+        created_at TIMESTAMPTZ NOT NULL,
+        PRIMARY KEY (id)
+    );
+CREATE INDEX IF NOT EXISTS delete_tasks_created_at_idx ON delete_tasks (created_at);
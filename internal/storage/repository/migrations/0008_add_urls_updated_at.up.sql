@@ -0,0 +1,4 @@
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ NULL;
+UPDATE urls SET updated_at = COALESCE(deleted_at, created_at) WHERE updated_at IS NULL;
+ALTER TABLE urls ALTER COLUMN updated_at SET DEFAULT now();
+ALTER TABLE urls ALTER COLUMN updated_at SET NOT NULL;
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS
+    url_revisions(
+        key VARCHAR NOT NULL,
+        version INT NOT NULL,
+        value VARCHAR NOT NULL,
+        created_at TIMESTAMPTZ NOT NULL,
+        PRIMARY KEY (key, version)
+    );
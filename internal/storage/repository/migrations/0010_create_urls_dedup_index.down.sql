@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS urls_value_idx;
+DROP INDEX IF EXISTS urls_user_id_value_idx;
+DROP INDEX IF EXISTS urls_value_not_unique_idx;
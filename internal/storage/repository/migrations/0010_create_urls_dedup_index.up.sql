@@ -0,0 +1,8 @@
+ALTER TABLE urls DROP CONSTRAINT IF EXISTS urls_value_key;
+DO $$
+BEGIN
+    IF to_regclass('urls_user_id_value_idx') IS NULL
+        AND to_regclass('urls_value_not_unique_idx') IS NULL THEN
+        CREATE UNIQUE INDEX IF NOT EXISTS urls_value_idx ON urls (value);
+    END IF;
+END $$;
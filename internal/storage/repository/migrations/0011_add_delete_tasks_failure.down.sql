@@ -0,0 +1,3 @@
+ALTER TABLE delete_tasks DROP COLUMN IF EXISTS failed_at;
+ALTER TABLE delete_tasks DROP COLUMN IF EXISTS error;
+ALTER TABLE delete_tasks DROP COLUMN IF EXISTS attempts;
@@ -0,0 +1,3 @@
+ALTER TABLE delete_tasks ADD COLUMN IF NOT EXISTS attempts INT NOT NULL DEFAULT 0;
+ALTER TABLE delete_tasks ADD COLUMN IF NOT EXISTS error VARCHAR NULL;
+ALTER TABLE delete_tasks ADD COLUMN IF NOT EXISTS failed_at TIMESTAMPTZ NULL;
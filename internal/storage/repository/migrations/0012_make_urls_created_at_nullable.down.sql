@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS urls_user_id_created_at_idx;
+UPDATE urls SET created_at = now() WHERE created_at IS NULL;
+ALTER TABLE urls ALTER COLUMN created_at SET NOT NULL;
+CREATE INDEX IF NOT EXISTS urls_user_id_created_at_idx ON urls (user_id, created_at, key);
@@ -0,0 +1,6 @@
+ALTER TABLE urls ALTER COLUMN created_at DROP NOT NULL;
+UPDATE urls SET created_at = NULL
+    WHERE created_at = (SELECT applied_at FROM schema_migrations WHERE version = 7);
+DROP INDEX IF EXISTS urls_user_id_created_at_idx;
+CREATE INDEX IF NOT EXISTS urls_user_id_created_at_idx
+    ON urls (user_id, COALESCE(created_at, TIMESTAMPTZ '0001-01-01 00:00:00+00'), key);
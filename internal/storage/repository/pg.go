@@ -3,107 +3,303 @@ package repository
 import (
 	"context"
 	"database/sql"
+	"database/sql/driver"
 	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strings"
 	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
+	"go.opentelemetry.io/otel"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
+const (
+	pgUniqueViolationCode     = "23505"
+	pgPrimaryKeyName          = "urls_pkey"
+	pgValueIndexName          = "urls_value_idx"
+	pgUserValueIndexName      = "urls_user_id_value_idx"
+	pgNotUniqueValueIndexName = "urls_value_not_unique_idx"
+
+	// connection errors and shutdown of the server (57P01-57P03)
+	pgConnectionExceptionClass = "08"
+	pgShutdownCodePrefix       = "57P"
+
+	// pgBatchAttempts limits reruns of the batch statement when rows
+	// inserted by concurrent transactions were not visible to it
+	pgBatchAttempts = 3
+
+	// pgCreatedAt orders records of unknown creation time as the zero time,
+	// it matches the expression of urls_user_id_created_at_idx
+	pgCreatedAt = `COALESCE(created_at, TIMESTAMPTZ '0001-01-01 00:00:00+00')`
+)
+
+var tracer = otel.Tracer("github.com/bigbag/go-musthave-shortener/internal/storage/repository")
+
+// likeEscaper escapes wildcards of LIKE patterns
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+type PGOptions struct {
+	ConnectionTimeout time.Duration
+	DedupScope        string
+	AutoMigrate       bool
+}
+
 type pgRepository struct {
-	ctx         context.Context
 	conn        *sql.DB
 	connTimeout time.Duration
+	dedupScope  string
 }
 
 func NewPGRepository(
 	ctx context.Context,
 	databaseDSN string,
-	connTimeout time.Duration,
+	opts PGOptions,
 ) (StorageRepository, error) {
 	conn, err := sql.Open("postgres", databaseDSN)
 	if err != nil {
 		return nil, err
 	}
 
-	repo := &pgRepository{ctx: ctx, conn: conn, connTimeout: connTimeout * time.Second}
-	err = repo.init()
+	repo := &pgRepository{
+		conn:        conn,
+		connTimeout: opts.ConnectionTimeout * time.Second,
+		dedupScope:  opts.DedupScope,
+	}
+	if opts.AutoMigrate {
+		err = repo.migrate(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = repo.checkDedupIndex(ctx)
 	if err != nil {
 		return nil, err
 	}
 	return repo, nil
 }
 
-func (r *pgRepository) init() error {
-	ctx, cancel := context.WithTimeout(r.ctx, r.connTimeout)
-	defer cancel()
+// zeroTime scans nullable timestamps, NULL is scanned as the zero time
+type zeroTime struct {
+	t *time.Time
+}
 
-	_, err := r.conn.ExecContext(ctx,
-		`CREATE TABLE IF NOT EXISTS
-			urls(
-				key VARCHAR NOT NULL,
-				value VARCHAR NOT NULL,
-				user_id VARCHAR NOT NULL,
-				correlation_id VARCHAR NULL,
-				removed BOOL DEFAULT 'f',
-				PRIMARY KEY (key),
-				UNIQUE (value)
-			);`,
+func (z zeroTime) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*z.t = time.Time{}
+	case time.Time:
+		*z.t = v
+	default:
+		return fmt.Errorf("cannot scan %T into time", src)
+	}
+	return nil
+}
+
+// startSpan starts a span of a single sql statement
+func startSpan(ctx context.Context, name string, statement string) (context.Context, trace.Span) {
+	return tracer.Start(
+		ctx,
+		"pgRepository."+name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.DBSystemPostgreSQL,
+			semconv.DBStatementKey.String(statement),
+		),
+	)
+}
+
+// convertError converts known pg errors to repository errors
+func (r *pgRepository) convertError(err error) error {
+	if err == nil || errors.Is(err, ErrUnavailable) {
+		return err
+	}
+
+	var (
+		pgErr  *pq.Error
+		netErr net.Error
 	)
+
+	switch {
+	case errors.As(err, &pgErr):
+		if pgErr.Code == pgUniqueViolationCode && pgErr.Constraint == pgPrimaryKeyName {
+			return &NotUniqueKeyError{}
+		}
+		if pgErr.Code == pgUniqueViolationCode &&
+			(pgErr.Constraint == pgValueIndexName || pgErr.Constraint == pgUserValueIndexName) {
+			return &NotUniqueValueError{}
+		}
+		if pgErr.Code.Class() == pgConnectionExceptionClass ||
+			strings.HasPrefix(string(pgErr.Code), pgShutdownCodePrefix) {
+			return &UnavailableError{Err: err}
+		}
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		// timeout and cancel of the request are not lost connection,
+		// context.DeadlineExceeded also implements net.Error
+		return err
+	case errors.As(err, &netErr),
+		errors.Is(err, driver.ErrBadConn),
+		errors.Is(err, io.EOF):
+		return &UnavailableError{Err: err}
+	}
+	return err
+}
+
+// migrate applies all embedded migrations which are not applied yet
+func (r *pgRepository) migrate(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, r.connTimeout)
+	defer cancel()
+
+	m, err := NewMigrator(r.conn)
 	if err != nil {
 		return err
 	}
-	return nil
+
+	_, err = m.Up(ctx)
+	return err
+}
+
+// checkDedupIndex checks that the schema has the index of the scope
+// of deduplication only, the scope is changed by explicit migration
+func (r *pgRepository) checkDedupIndex(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, r.connTimeout)
+	defer cancel()
+
+	ctx, span := startSpan(ctx, "checkDedupIndex", dedupScopesQuery)
+	defer span.End()
+
+	scopes, err := findDedupScopes(ctx, r.conn)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case len(scopes) == 1 && scopes[0] == r.dedupScope:
+		return nil
+	case len(scopes) == 0:
+		return fmt.Errorf(
+			"index %s of dedup scope %s does not exist, apply migrations",
+			dedupIndexes[r.dedupScope].name, r.dedupScope,
+		)
+	default:
+		return fmt.Errorf(
+			"index %s of dedup scope %s does not match the schema with scope %s, run migrate dedup %s",
+			dedupIndexes[r.dedupScope].name, r.dedupScope, strings.Join(scopes, ","), r.dedupScope,
+		)
+	}
 }
 
-func (r *pgRepository) GetByKey(key string) (*Record, error) {
-	ctx, cancel := context.WithTimeout(r.ctx, r.connTimeout)
+func (r *pgRepository) GetByKey(ctx context.Context, key string) (*Record, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.connTimeout)
 	defer cancel()
 
 	record := &Record{}
 
-	sqlStatement := `SELECT key, value, user_id, removed FROM urls WHERE key=$1;`
+	sqlStatement := `SELECT key, value, user_id, removed, expires_at, deleted_at, created_at, updated_at
+				FROM urls WHERE key=$1;`
+	ctx, span := startSpan(ctx, "GetByKey", sqlStatement)
+	defer span.End()
+
 	row := r.conn.QueryRowContext(ctx, sqlStatement, key)
 	switch err := row.Scan(
 		&record.Key,
 		&record.Value,
 		&record.UserID,
 		&record.Removed,
+		&record.ExpiresAt,
+		&record.DeletedAt,
+		zeroTime{&record.CreatedAt},
+		&record.UpdatedAt,
 	); err {
 	case sql.ErrNoRows:
-		return nil, errors.New("not found url")
+		return nil, ErrNotFound
 	case nil:
 		return record, nil
 	default:
-		return record, err
+		return nil, r.convertError(err)
+	}
+}
+
+// GetByKeys returns found records, unknown keys are skipped
+func (r *pgRepository) GetByKeys(ctx context.Context, keys []string) ([]*Record, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.connTimeout)
+	defer cancel()
+
+	sqlStatement := `SELECT key, value, user_id, removed, expires_at, deleted_at, created_at, updated_at
+				FROM urls WHERE key = ANY($1);`
+	ctx, span := startSpan(ctx, "GetByKeys", sqlStatement)
+	defer span.End()
+
+	rows, err := r.conn.QueryContext(ctx, sqlStatement, pq.Array(keys))
+	if err != nil {
+		return nil, r.convertError(err)
 	}
+	defer rows.Close()
+
+	result := make([]*Record, 0, len(keys))
+	for rows.Next() {
+		record := &Record{}
+		err = rows.Scan(
+			&record.Key,
+			&record.Value,
+			&record.UserID,
+			&record.Removed,
+			&record.ExpiresAt,
+			&record.DeletedAt,
+			zeroTime{&record.CreatedAt},
+			&record.UpdatedAt,
+		)
+		if err != nil {
+			return nil, r.convertError(err)
+		}
+		result = append(result, record)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, r.convertError(err)
+	}
+	return result, nil
 }
 
-func (r *pgRepository) GetByValue(value string) (*Record, error) {
-	ctx, cancel := context.WithTimeout(r.ctx, r.connTimeout)
+func (r *pgRepository) GetByValue(ctx context.Context, value string, userID string) (*Record, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.connTimeout)
 	defer cancel()
 
 	record := &Record{}
 
-	sqlStatement := `SELECT key, value, user_id FROM urls WHERE value=$1;`
-	row := r.conn.QueryRowContext(ctx, sqlStatement, value)
+	sqlStatement := `SELECT key, value, user_id FROM urls
+		WHERE value=$1 AND ($2::VARCHAR = '' OR user_id = $2::VARCHAR)
+		LIMIT 1;`
+	ctx, span := startSpan(ctx, "GetByValue", sqlStatement)
+	defer span.End()
+
+	row := r.conn.QueryRowContext(ctx, sqlStatement, value, userID)
 	switch err := row.Scan(&record.Key, &record.Value, &record.UserID); err {
 	case sql.ErrNoRows:
 		return nil, nil
 	case nil:
 		return record, nil
 	default:
-		return record, err
+		return nil, r.convertError(err)
 	}
 }
 
-func (r *pgRepository) GetAllByUserID(userID string) ([]*Record, error) {
-	ctx, cancel := context.WithTimeout(r.ctx, r.connTimeout)
+func (r *pgRepository) GetAllByUserID(ctx context.Context, userID string) ([]*Record, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.connTimeout)
 	defer cancel()
 
-	sqlStatement := `SELECT key, value, user_id FROM urls WHERE user_id=$1;`
+	sqlStatement := `SELECT key, value, user_id, removed, deleted_at, created_at, updated_at
+				FROM urls WHERE user_id=$1;`
+	ctx, span := startSpan(ctx, "GetAllByUserID", sqlStatement)
+	defer span.End()
+
 	rows, err := r.conn.QueryContext(ctx, sqlStatement, userID)
 	if err != nil {
-		return nil, err
+		return nil, r.convertError(err)
 	}
 	defer rows.Close()
 
@@ -111,114 +307,817 @@ func (r *pgRepository) GetAllByUserID(userID string) ([]*Record, error) {
 	result := make([]*Record, 0, 100)
 	for rows.Next() {
 		record = &Record{}
-		err = rows.Scan(&record.Key, &record.Value, &record.UserID)
+		err = rows.Scan(
+			&record.Key,
+			&record.Value,
+			&record.UserID,
+			&record.Removed,
+			&record.DeletedAt,
+			zeroTime{&record.CreatedAt},
+			&record.UpdatedAt,
+		)
 		if err != nil {
-			return nil, err
+			return nil, r.convertError(err)
 		}
 		result = append(result, record)
 	}
 	err = rows.Err()
 	if err != nil {
-		return nil, err
+		return nil, r.convertError(err)
 	}
 	return result, nil
 }
 
-func (r *pgRepository) Save(record *Record) error {
-	ctx, cancel := context.WithTimeout(r.ctx, r.connTimeout)
+// listFilter builds conditions of the query, the cursor isn't a part
+// of them, so the total counts all pages
+func listFilter(q *ListQuery) (string, []interface{}) {
+	args := []interface{}{q.UserID, q.Removed}
+	conditions := []string{"user_id = $1", "removed = $2"}
+
+	if q.Search != "" {
+		args = append(args, "%"+likeEscaper.Replace(q.Search)+"%")
+		conditions = append(conditions, fmt.Sprintf("value ILIKE $%d", len(args)))
+	}
+
+	if q.Domain != "" {
+		args = append(args, `^[a-z][a-z0-9+.-]*://([^/?#@]*@)?([^/?#:]*\.)?`+
+			regexp.QuoteMeta(q.Domain)+`([:/?#]|$)`)
+		conditions = append(conditions, fmt.Sprintf("value ~* $%d", len(args)))
+	}
+	return strings.Join(conditions, " AND "), args
+}
+
+func (r *pgRepository) ListByUserID(ctx context.Context, q *ListQuery) (*Page, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.connTimeout)
 	defer cancel()
 
-	query := `INSERT INTO urls(key, value, user_id) 
-          			VALUES($1, $2, $3);`
-	_, err := r.conn.ExecContext(ctx, query, record.Key, record.Value, record.UserID)
+	filter, args := listFilter(q)
+	page := &Page{Records: make([]*Record, 0, q.Limit)}
+
+	query := `SELECT count(*) FROM urls WHERE ` + filter + `;`
+	countCtx, countSpan := startSpan(ctx, "ListByUserID.count", query)
+	err := r.conn.QueryRowContext(countCtx, query, args...).Scan(&page.Total)
+	countSpan.End()
 	if err != nil {
-		return err
+		return nil, r.convertError(err)
+	}
+
+	order, cmp := "ASC", ">"
+	if q.isDesc() {
+		order, cmp = "DESC", "<"
+	}
+
+	if q.Cursor != nil {
+		args = append(args, q.Cursor.CreatedAt, q.Cursor.Key)
+		filter += fmt.Sprintf(" AND (%s, key) %s ($%d, $%d)", pgCreatedAt, cmp, len(args)-1, len(args))
+	}
+	args = append(args, q.Limit+1)
+
+	query = fmt.Sprintf(`SELECT key, value, user_id, removed, expires_at, deleted_at, created_at, updated_at
+				FROM urls
+				WHERE %s
+				ORDER BY %s %s, key %s
+				LIMIT $%d;`, filter, pgCreatedAt, order, order, len(args))
+	pageCtx, pageSpan := startSpan(ctx, "ListByUserID.page", query)
+	defer pageSpan.End()
+
+	rows, err := r.conn.QueryContext(pageCtx, query, args...)
+	if err != nil {
+		return nil, r.convertError(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		record := &Record{}
+		err = rows.Scan(
+			&record.Key,
+			&record.Value,
+			&record.UserID,
+			&record.Removed,
+			&record.ExpiresAt,
+			&record.DeletedAt,
+			zeroTime{&record.CreatedAt},
+			&record.UpdatedAt,
+		)
+		if err != nil {
+			return nil, r.convertError(err)
+		}
+
+		if len(page.Records) == q.Limit {
+			last := page.Records[len(page.Records)-1]
+			page.Next = &Cursor{CreatedAt: last.CreatedAt, Key: last.Key}
+			break
+		}
+		page.Records = append(page.Records, record)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, r.convertError(err)
+	}
+	return page, nil
+}
+
+func (r *pgRepository) Save(ctx context.Context, record *Record) error {
+	ctx, cancel := context.WithTimeout(ctx, r.connTimeout)
+	defer cancel()
+
+	query := `INSERT INTO urls(key, value, user_id, expires_at, created_at, updated_at)
+          			VALUES($1, $2, $3, $4, $5, $6);`
+	ctx, span := startSpan(ctx, "Save", query)
+	defer span.End()
+
+	record.stamp(time.Now().UTC())
+	_, err := r.conn.ExecContext(
+		ctx, query, record.Key, record.Value, record.UserID, record.ExpiresAt,
+		record.CreatedAt, record.UpdatedAt,
+	)
+	if err != nil {
+		return r.convertError(err)
 	}
 
 	return nil
 }
 
-func (r *pgRepository) SaveBatchOfURL(records []*Record) error {
-	ctx, cancel := context.WithTimeout(r.ctx, r.connTimeout)
+func (r *pgRepository) SaveBatchOfURL(ctx context.Context, records []*Record) error {
+	ctx, cancel := context.WithTimeout(ctx, r.connTimeout)
 	defer cancel()
 
-	tx, err := r.conn.Begin()
+	query := `INSERT INTO urls(key, value, user_id, correlation_id, expires_at, created_at, updated_at)
+				VALUES($1, $2, $3, $4, $5, $6, $7);`
+	ctx, span := startSpan(ctx, "SaveBatchOfURL", query)
+	defer span.End()
+
+	tx, err := r.conn.BeginTx(ctx, nil)
 	if err != nil {
-		return err
+		return r.convertError(err)
 	}
 
 	defer tx.Rollback()
 
-	stmt, err := tx.PrepareContext(
-		ctx,
-		`INSERT INTO urls(key, value, user_id, correlation_id)
-				VALUES($1, $2, $3, $4);`,
-	)
+	stmt, err := tx.PrepareContext(ctx, query)
 	if err != nil {
-		return err
+		return r.convertError(err)
 	}
 
+	now := time.Now().UTC()
 	for _, record := range records {
+		record.stamp(now)
 		if _, err = stmt.ExecContext(
 			ctx, record.Key,
 			record.Value,
 			record.UserID,
 			record.CorrelationID,
+			record.ExpiresAt,
+			record.CreatedAt,
+			record.UpdatedAt,
 		); err != nil {
-			return err
+			return r.convertError(err)
 		}
 	}
 
 	defer stmt.Close()
 
 	if err = tx.Commit(); err != nil {
-		return err
+		return r.convertError(err)
 	}
 
 	return nil
 }
 
-func (r *pgRepository) DeleteByUserID(userID string, keys []string) error {
-	ctx, cancel := context.WithTimeout(r.ctx, r.connTimeout)
+// batchInsertQuery returns a query which inserts new records and
+// skips duplicates according to the scope of deduplication
+func batchInsertQuery(dedupScope string) string {
+	input := `SELECT * FROM unnest(
+			$1::VARCHAR[], $2::VARCHAR[], $3::VARCHAR[], $4::VARCHAR[], $5::TIMESTAMPTZ[],
+			$6::TIMESTAMPTZ[], $7::TIMESTAMPTZ[]
+		) WITH ORDINALITY AS t(key, value, user_id, correlation_id, expires_at, created_at, updated_at, ord)`
+
+	switch dedupScope {
+	case DedupGlobal:
+		return `WITH input AS (` + input + `),
+			inserted AS (
+				INSERT INTO urls(key, value, user_id, correlation_id, expires_at, created_at, updated_at)
+				SELECT DISTINCT ON (value) key, value, user_id, correlation_id, expires_at, created_at, updated_at
+				FROM input ORDER BY value, ord
+				ON CONFLICT (value) DO NOTHING
+				RETURNING key, value, user_id, correlation_id, removed, expires_at, deleted_at, created_at, updated_at
+			)
+			SELECT i.ord, n.key, n.value, n.user_id, n.correlation_id, n.removed, n.expires_at, n.deleted_at, n.created_at, n.updated_at, n.created
+			FROM input i
+			JOIN (
+				SELECT key, value, user_id, correlation_id, removed, expires_at, deleted_at, created_at, updated_at, true AS created FROM inserted
+				UNION ALL
+				SELECT key, value, user_id, correlation_id, removed, expires_at, deleted_at, created_at, updated_at, false AS created FROM urls
+				WHERE value IN (SELECT value FROM input)
+			) n ON n.value = i.value
+			ORDER BY i.ord;`
+	case DedupUser:
+		return `WITH input AS (` + input + `),
+			inserted AS (
+				INSERT INTO urls(key, value, user_id, correlation_id, expires_at, created_at, updated_at)
+				SELECT DISTINCT ON (user_id, value) key, value, user_id, correlation_id, expires_at, created_at, updated_at
+				FROM input ORDER BY user_id, value, ord
+				ON CONFLICT (user_id, value) DO NOTHING
+				RETURNING key, value, user_id, correlation_id, removed, expires_at, deleted_at, created_at, updated_at
+			)
+			SELECT i.ord, n.key, n.value, n.user_id, n.correlation_id, n.removed, n.expires_at, n.deleted_at, n.created_at, n.updated_at, n.created
+			FROM input i
+			JOIN (
+				SELECT key, value, user_id, correlation_id, removed, expires_at, deleted_at, created_at, updated_at, true AS created FROM inserted
+				UNION ALL
+				SELECT key, value, user_id, correlation_id, removed, expires_at, deleted_at, created_at, updated_at, false AS created FROM urls
+				WHERE (user_id, value) IN (SELECT user_id, value FROM input)
+			) n ON n.value = i.value AND n.user_id = i.user_id
+			ORDER BY i.ord;`
+	default:
+		return `WITH input AS (` + input + `),
+			inserted AS (
+				INSERT INTO urls(key, value, user_id, correlation_id, expires_at, created_at, updated_at)
+				SELECT key, value, user_id, correlation_id, expires_at, created_at, updated_at FROM input
+				RETURNING key, value, user_id, correlation_id, removed, expires_at, deleted_at, created_at, updated_at, true AS created
+			)
+			SELECT i.ord, n.key, n.value, n.user_id, n.correlation_id, n.removed, n.expires_at, n.deleted_at, n.created_at, n.updated_at, n.created
+			FROM input i
+			JOIN inserted n ON n.key = i.key
+			ORDER BY i.ord;`
+	}
+}
+
+// SaveOrGet inserts the record or returns already stored duplicate of it
+// in a single statement, the flag reports whether the record was inserted
+func (r *pgRepository) SaveOrGet(ctx context.Context, record *Record, dedupScope string) (*Record, bool, error) {
+	result, created, err := r.saveOrGet(ctx, []*Record{record}, dedupScope)
+	if err != nil {
+		return nil, false, r.convertError(err)
+	}
+	return result[0], created[0], nil
+}
+
+// SaveOrGetBatch inserts new records and returns existing ones for
+// duplicates in a single statement, the order of the batch is preserved
+func (r *pgRepository) SaveOrGetBatch(ctx context.Context, records []*Record, dedupScope string) ([]*Record, error) {
+	if len(records) == 0 {
+		return []*Record{}, nil
+	}
+
+	result, _, err := r.saveOrGet(ctx, records, dedupScope)
+	return result, r.convertError(err)
+}
+
+// saveOrGet returns a stored record for every record and flags
+// which report whether the record was inserted
+func (r *pgRepository) saveOrGet(ctx context.Context, records []*Record, dedupScope string) ([]*Record, []bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.connTimeout)
 	defer cancel()
 
-	tx, err := r.conn.Begin()
+	var (
+		keys           = make([]string, 0, len(records))
+		values         = make([]string, 0, len(records))
+		userIDs        = make([]string, 0, len(records))
+		correlationIDs = make([]string, 0, len(records))
+		expiresAt      = make([]sql.NullString, 0, len(records))
+		createdAt      = make([]string, 0, len(records))
+		updatedAt      = make([]string, 0, len(records))
+	)
+
+	now := time.Now().UTC()
+	for _, record := range records {
+		record.stamp(now)
+		createdAt = append(createdAt, record.CreatedAt.Format(time.RFC3339Nano))
+		updatedAt = append(updatedAt, record.UpdatedAt.Format(time.RFC3339Nano))
+
+		keys = append(keys, record.Key)
+		values = append(values, record.Value)
+		userIDs = append(userIDs, record.UserID)
+		correlationIDs = append(correlationIDs, record.CorrelationID)
+
+		deadline := sql.NullString{}
+		if record.ExpiresAt != nil {
+			deadline = sql.NullString{String: record.ExpiresAt.Format(time.RFC3339Nano), Valid: true}
+		}
+		expiresAt = append(expiresAt, deadline)
+	}
+
+	query := batchInsertQuery(dedupScope)
+	for attempt := 0; attempt < pgBatchAttempts; attempt++ {
+		result, created, err := r.queryBatch(
+			ctx, query, len(records),
+			pq.Array(keys), pq.Array(values), pq.Array(userIDs),
+			pq.Array(correlationIDs), pq.Array(expiresAt),
+			pq.Array(createdAt), pq.Array(updatedAt),
+		)
+		if err != nil {
+			return nil, nil, r.convertError(err)
+		}
+		if result != nil {
+			return result, created, nil
+		}
+	}
+	return nil, nil, errors.New("batch was conflicted with concurrent inserts")
+}
+
+// queryBatch returns nil result when some records of the batch were
+// neither inserted nor found, so the statement must be run again
+func (r *pgRepository) queryBatch(
+	ctx context.Context,
+	query string,
+	total int,
+	args ...interface{},
+) ([]*Record, []bool, error) {
+	ctx, span := startSpan(ctx, "SaveOrGetBatch", query)
+	defer span.End()
+
+	rows, err := r.conn.QueryContext(ctx, query, args...)
 	if err != nil {
-		return err
+		return nil, nil, r.convertError(err)
+	}
+	defer rows.Close()
+
+	var (
+		ord           int
+		isCreated     bool
+		correlationID sql.NullString
+	)
+
+	result := make([]*Record, 0, total)
+	created := make([]bool, 0, total)
+	for rows.Next() {
+		record := &Record{}
+		err = rows.Scan(
+			&ord,
+			&record.Key,
+			&record.Value,
+			&record.UserID,
+			&correlationID,
+			&record.Removed,
+			&record.ExpiresAt,
+			&record.DeletedAt,
+			zeroTime{&record.CreatedAt},
+			&record.UpdatedAt,
+			&isCreated,
+		)
+		if err != nil {
+			return nil, nil, r.convertError(err)
+		}
+		record.CorrelationID = correlationID.String
+
+		if ord != len(result)+1 {
+			continue
+		}
+		result = append(result, record)
+		created = append(created, isCreated)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, nil, r.convertError(err)
 	}
 
+	if len(result) != total {
+		return nil, nil, nil
+	}
+	return result, created, nil
+}
+
+// UpdateValue changes the value of the record of the user and keeps
+// the revision of it in one transaction, duplicates are rejected
+// by the unique index of the scope of deduplication
+func (r *pgRepository) UpdateValue(
+	ctx context.Context,
+	userID string,
+	key string,
+	value string,
+	_ string,
+	now time.Time,
+) (*Record, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.connTimeout)
+	defer cancel()
+
+	query := `SELECT key, value, user_id, removed, expires_at, deleted_at, created_at, updated_at
+				FROM urls WHERE key = $1 FOR UPDATE;`
+	ctx, span := startSpan(ctx, "UpdateValue", query)
+	defer span.End()
+
+	tx, err := r.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, r.convertError(err)
+	}
 	defer tx.Rollback()
-	stmt, err := tx.PrepareContext(
+
+	record := &Record{}
+	switch err = tx.QueryRowContext(ctx, query, key).Scan(
+		&record.Key,
+		&record.Value,
+		&record.UserID,
+		&record.Removed,
+		&record.ExpiresAt,
+		&record.DeletedAt,
+		zeroTime{&record.CreatedAt},
+		&record.UpdatedAt,
+	); {
+	case errors.Is(err, sql.ErrNoRows):
+		return nil, ErrNotFound
+	case err != nil:
+		return nil, r.convertError(err)
+	case record.Removed:
+		return nil, ErrNotFound
+	case !record.IsOwner(userID):
+		return nil, ErrForbidden
+	case record.Value == value:
+		return record, nil
+	}
+
+	if _, err = tx.ExecContext(
 		ctx,
-		`UPDATE urls 
-				SET removed = true 
-				WHERE user_id = $1 and key = $2;`,
-	)
+		`UPDATE urls SET value = $2, updated_at = $3 WHERE key = $1;`,
+		key, value, now,
+	); err != nil {
+		return nil, r.convertError(err)
+	}
+
+	if _, err = tx.ExecContext(
+		ctx,
+		`INSERT INTO url_revisions(key, version, value, created_at)
+			SELECT $1, 1, $2, $3
+			WHERE NOT EXISTS (SELECT 1 FROM url_revisions WHERE key = $1);`,
+		key, record.Value, record.CreatedAt,
+	); err != nil {
+		return nil, r.convertError(err)
+	}
+
+	if _, err = tx.ExecContext(
+		ctx,
+		`INSERT INTO url_revisions(key, version, value, created_at)
+			SELECT $1, max(version) + 1, $2, $3 FROM url_revisions WHERE key = $1;`,
+		key, value, now,
+	); err != nil {
+		return nil, r.convertError(err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, r.convertError(err)
+	}
+
+	record.Value = value
+	record.UpdatedAt = now
+	return record, nil
+}
+
+func (r *pgRepository) GetRevisions(ctx context.Context, key string) ([]*Revision, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.connTimeout)
+	defer cancel()
+
+	query := `SELECT key, version, value, created_at FROM url_revisions
+				WHERE key = $1
+				ORDER BY version;`
+	ctx, span := startSpan(ctx, "GetRevisions", query)
+	defer span.End()
+
+	rows, err := r.conn.QueryContext(ctx, query, key)
 	if err != nil {
-		return err
+		return nil, r.convertError(err)
 	}
+	defer rows.Close()
 
-	for _, key := range keys {
-		if _, err = stmt.ExecContext(
-			ctx, userID, key); err != nil {
-			return err
+	result := make([]*Revision, 0, 10)
+	for rows.Next() {
+		revision := &Revision{}
+		if err = rows.Scan(
+			&revision.Key,
+			&revision.Version,
+			&revision.Value,
+			&revision.CreatedAt,
+		); err != nil {
+			return nil, r.convertError(err)
+		}
+		result = append(result, revision)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, r.convertError(err)
+	}
+	return result, nil
+}
+
+func (r *pgRepository) DeleteByUserID(ctx context.Context, userID string, keys []string) error {
+	ctx, cancel := context.WithTimeout(ctx, r.connTimeout)
+	defer cancel()
+
+	query := `UPDATE urls
+				SET removed = true, deleted_at = now(), updated_at = now()
+				WHERE user_id = $1 AND key = ANY($2) AND removed = false;`
+	ctx, span := startSpan(ctx, "DeleteByUserID", query)
+	defer span.End()
+
+	_, err := r.conn.ExecContext(ctx, query, userID, pq.Array(keys))
+	return r.convertError(err)
+}
+
+// Restore brings back removed records and returns their keys
+func (r *pgRepository) Restore(
+	ctx context.Context,
+	userID string,
+	keys []string,
+	deletedAfter time.Time,
+	now time.Time,
+) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.connTimeout)
+	defer cancel()
+
+	query := `UPDATE urls
+				SET removed = false, deleted_at = NULL, updated_at = $4
+				WHERE user_id = $1 AND key = ANY($2) AND removed = true
+					AND deleted_at > $3
+					AND (expires_at IS NULL OR expires_at > $4)
+				RETURNING key;`
+	ctx, span := startSpan(ctx, "Restore", query)
+	defer span.End()
+
+	rows, err := r.conn.QueryContext(ctx, query, userID, pq.Array(keys), deletedAfter, now)
+	if err != nil {
+		return nil, r.convertError(err)
+	}
+	defer rows.Close()
+
+	restored := make([]string, 0, len(keys))
+	for rows.Next() {
+		var key string
+		if err = rows.Scan(&key); err != nil {
+			return nil, r.convertError(err)
 		}
+		restored = append(restored, key)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, r.convertError(err)
+	}
+	return restored, nil
+}
+
+func (r *pgRepository) DeleteExpired(ctx context.Context, now time.Time) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.connTimeout)
+	defer cancel()
+
+	query := `UPDATE urls
+				SET removed = true, deleted_at = $1, updated_at = $1
+				WHERE removed = false AND expires_at <= $1;`
+	ctx, span := startSpan(ctx, "DeleteExpired", query)
+	defer span.End()
+
+	result, err := r.conn.ExecContext(ctx, query, now)
+	if err != nil {
+		return 0, r.convertError(err)
+	}
+
+	total, err := result.RowsAffected()
+	return int(total), r.convertError(err)
+}
+
+func (r *pgRepository) Purge(ctx context.Context, userID string, before time.Time) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.connTimeout)
+	defer cancel()
+
+	var total int
+
+	query := `WITH purged AS (
+				DELETE FROM urls
+				WHERE removed = true
+					AND (deleted_at IS NULL OR deleted_at <= $1)
+					AND ($2::VARCHAR = '' OR user_id = $2::VARCHAR)
+				RETURNING key
+			), purged_clicks AS (
+				DELETE FROM clicks WHERE key IN (SELECT key FROM purged)
+			), purged_revisions AS (
+				DELETE FROM url_revisions WHERE key IN (SELECT key FROM purged)
+			)
+			SELECT count(*) FROM purged;`
+	ctx, span := startSpan(ctx, "Purge", query)
+	defer span.End()
+
+	row := r.conn.QueryRowContext(ctx, query, before, userID)
+	if err := row.Scan(&total); err != nil {
+		return 0, r.convertError(err)
+	}
+	return total, nil
+}
+
+func (r *pgRepository) NextCounter(ctx context.Context) (uint64, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.connTimeout)
+	defer cancel()
+
+	var value uint64
+
+	query := `SELECT nextval('urls_counter_seq');`
+	ctx, span := startSpan(ctx, "NextCounter", query)
+	defer span.End()
+
+	row := r.conn.QueryRowContext(ctx, query)
+	if err := row.Scan(&value); err != nil {
+		return 0, r.convertError(err)
+	}
+	return value, nil
+}
+
+func (r *pgRepository) SaveClicks(ctx context.Context, clicks []*Click) error {
+	ctx, cancel := context.WithTimeout(ctx, r.connTimeout)
+	defer cancel()
+
+	query := `INSERT INTO clicks(key, created_at, referer, user_agent, ip, language)
+				VALUES($1, $2, $3, $4, $5, $6);`
+	ctx, span := startSpan(ctx, "SaveClicks", query)
+	defer span.End()
+
+	tx, err := r.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return r.convertError(err)
+	}
+
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, query)
+	if err != nil {
+		return r.convertError(err)
 	}
 
 	defer stmt.Close()
 
-	if err = tx.Commit(); err != nil {
-		return err
+	for _, click := range clicks {
+		if _, err = stmt.ExecContext(
+			ctx,
+			click.Key,
+			click.Timestamp,
+			click.Referer,
+			click.UserAgent,
+			click.IP,
+			click.Language,
+		); err != nil {
+			return r.convertError(err)
+		}
+	}
+
+	return r.convertError(tx.Commit())
+}
+
+func (r *pgRepository) GetClickStats(ctx context.Context, key string, topReferrers int) (*ClickStats, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.connTimeout)
+	defer cancel()
+
+	stats := &ClickStats{
+		Daily:        make([]*DailyClicks, 0, 30),
+		TopReferrers: make([]*ReferrerClicks, 0, topReferrers),
+	}
+	if err := r.getDailyClicks(ctx, key, stats); err != nil {
+		return nil, err
+	}
+	if err := r.getTopReferrers(ctx, key, topReferrers, stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// getDailyClicks fills daily and total numbers of clicks,
+// every query of the stats has its own span
+func (r *pgRepository) getDailyClicks(ctx context.Context, key string, stats *ClickStats) error {
+	query := `SELECT to_char(created_at AT TIME ZONE 'UTC', 'YYYY-MM-DD') AS day, count(*)
+				FROM clicks
+				WHERE key = $1
+				GROUP BY day
+				ORDER BY day;`
+	ctx, span := startSpan(ctx, "GetClickStats.daily", query)
+	defer span.End()
+
+	rows, err := r.conn.QueryContext(ctx, query, key)
+	if err != nil {
+		return r.convertError(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		daily := &DailyClicks{}
+		if err = rows.Scan(&daily.Date, &daily.Count); err != nil {
+			return r.convertError(err)
+		}
+		stats.Total += daily.Count
+		stats.Daily = append(stats.Daily, daily)
+	}
+	return r.convertError(rows.Err())
+}
+
+func (r *pgRepository) getTopReferrers(
+	ctx context.Context,
+	key string,
+	topReferrers int,
+	stats *ClickStats,
+) error {
+	query := `SELECT referer, count(*) AS total
+				FROM clicks
+				WHERE key = $1 AND referer <> ''
+				GROUP BY referer
+				ORDER BY total DESC, referer
+				LIMIT $2;`
+	ctx, span := startSpan(ctx, "GetClickStats.referrers", query)
+	defer span.End()
+
+	rows, err := r.conn.QueryContext(ctx, query, key, topReferrers)
+	if err != nil {
+		return r.convertError(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		referrer := &ReferrerClicks{}
+		if err = rows.Scan(&referrer.Referer, &referrer.Count); err != nil {
+			return r.convertError(err)
+		}
+		stats.TopReferrers = append(stats.TopReferrers, referrer)
+	}
+	return r.convertError(rows.Err())
+}
+
+func (r *pgRepository) SaveDeleteTask(ctx context.Context, task *DeleteTask) error {
+	ctx, cancel := context.WithTimeout(ctx, r.connTimeout)
+	defer cancel()
+
+	query := `INSERT INTO delete_tasks(id, user_id, keys, created_at)
+				VALUES($1, $2, $3, $4);`
+	ctx, span := startSpan(ctx, "SaveDeleteTask", query)
+	defer span.End()
+
+	_, err := r.conn.ExecContext(
+		ctx, query, task.ID, task.UserID, pq.Array(task.Keys), task.CreatedAt,
+	)
+	return r.convertError(err)
+}
+
+func (r *pgRepository) AckDeleteTask(ctx context.Context, id string) error {
+	ctx, cancel := context.WithTimeout(ctx, r.connTimeout)
+	defer cancel()
+
+	query := `DELETE FROM delete_tasks WHERE id = $1;`
+	ctx, span := startSpan(ctx, "AckDeleteTask", query)
+	defer span.End()
+
+	_, err := r.conn.ExecContext(ctx, query, id)
+	return r.convertError(err)
+}
+
+func (r *pgRepository) BuryDeleteTask(ctx context.Context, task *DeleteTask) error {
+	ctx, cancel := context.WithTimeout(ctx, r.connTimeout)
+	defer cancel()
+
+	query := `UPDATE delete_tasks SET attempts = $2, error = $3, failed_at = $4
+				WHERE id = $1;`
+	ctx, span := startSpan(ctx, "BuryDeleteTask", query)
+	defer span.End()
+
+	_, err := r.conn.ExecContext(ctx, query, task.ID, task.Attempts, task.Error, task.FailedAt)
+	return r.convertError(err)
+}
+
+func (r *pgRepository) GetDeleteTasks(ctx context.Context) ([]*DeleteTask, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.connTimeout)
+	defer cancel()
+
+	query := `SELECT id, user_id, keys, created_at, attempts, error, failed_at FROM delete_tasks
+				ORDER BY created_at, id;`
+	ctx, span := startSpan(ctx, "GetDeleteTasks", query)
+	defer span.End()
+
+	rows, err := r.conn.QueryContext(ctx, query)
+	if err != nil {
+		return nil, r.convertError(err)
+	}
+	defer rows.Close()
+
+	result := make([]*DeleteTask, 0, 100)
+	for rows.Next() {
+		var (
+			task    = &DeleteTask{}
+			failure sql.NullString
+		)
+		if err = rows.Scan(
+			&task.ID, &task.UserID, pq.Array(&task.Keys), &task.CreatedAt,
+			&task.Attempts, &failure, &task.FailedAt,
+		); err != nil {
+			return nil, r.convertError(err)
+		}
+		task.Error = failure.String
+		result = append(result, task)
 	}
+	if err = rows.Err(); err != nil {
+		return nil, r.convertError(err)
+	}
+	return result, nil
+}
 
+func (r *pgRepository) Compact(_ context.Context) error {
 	return nil
 }
 
-func (r *pgRepository) Status() error {
-	ctx, cancel := context.WithTimeout(r.ctx, r.connTimeout)
+func (r *pgRepository) Stats() *Stats {
+	return &Stats{Backend: "pg"}
+}
+
+func (r *pgRepository) Status(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, r.connTimeout)
 	defer cancel()
 
-	return r.conn.PingContext(ctx)
+	return r.convertError(r.conn.PingContext(ctx))
 }
 
 func (r *pgRepository) Close() error {
@@ -0,0 +1,72 @@
+package repository
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPGRepositoryConvertError(t *testing.T) {
+	r := &pgRepository{}
+
+	tests := []struct {
+		description string
+		err         error
+		expected    error
+	}{
+		{
+			description: "primary key violation",
+			err:         &pq.Error{Code: pgUniqueViolationCode, Constraint: pgPrimaryKeyName},
+			expected:    ErrConflict,
+		},
+		{
+			description: "connection exception",
+			err:         &pq.Error{Code: "08006"},
+			expected:    ErrUnavailable,
+		},
+		{
+			description: "admin shutdown",
+			err:         &pq.Error{Code: "57P01"},
+			expected:    ErrUnavailable,
+		},
+		{
+			description: "refused connection",
+			err:         &net.OpError{Op: "dial", Err: errors.New("connection refused")},
+			expected:    ErrUnavailable,
+		},
+		{
+			description: "bad connection",
+			err:         driver.ErrBadConn,
+			expected:    ErrUnavailable,
+		},
+	}
+
+	for _, test := range tests {
+		assert.Truef(t, errors.Is(r.convertError(test.err), test.expected), test.description)
+	}
+
+	// timeout of the request is reported by the caller, not as lost connection
+	assert.False(t, errors.Is(r.convertError(context.DeadlineExceeded), ErrUnavailable))
+
+	err := &pq.Error{Code: "42601"}
+	assert.Equal(t, err, r.convertError(err))
+	assert.Nil(t, r.convertError(nil))
+}
+
+func TestPGRepositoryZeroTime(t *testing.T) {
+	createdAt := time.Now()
+	assert.Nil(t, zeroTime{&createdAt}.Scan(nil))
+	assert.True(t, createdAt.IsZero())
+
+	now := time.Now().UTC()
+	assert.Nil(t, zeroTime{&createdAt}.Scan(now))
+	assert.Equal(t, now, createdAt)
+
+	assert.NotNil(t, zeroTime{&createdAt}.Scan("2022-01-01"))
+}
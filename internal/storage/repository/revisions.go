@@ -0,0 +1,94 @@
+package repository
+
+import "time"
+
+// Revision is a target of the record since the time of the revision,
+// the first revision keeps the initial target
+type Revision struct {
+	Key       string    `json:"key"`
+	Version   int       `json:"version"`
+	Value     string    `json:"value"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// NotUniqueValueError reports that the new value of the record is
+// already used by another record within the scope of deduplication
+type NotUniqueValueError struct{}
+
+func (e *NotUniqueValueError) Error() string {
+	return "not unique value"
+}
+
+func (e *NotUniqueValueError) Is(target error) bool {
+	return target == ErrConflict
+}
+
+// changeValue replaces the record by a copy with the new value for the
+// repositories without query language and returns added revisions, so the
+// caller can persist them. Records returned to readers are never changed.
+// Caller must hold the write lock.
+func changeValue(
+	db map[string]*Record,
+	i *index,
+	revisions map[string][]*Revision,
+	userID string,
+	key string,
+	value string,
+	dedupScope string,
+	now time.Time,
+) (*Record, []*Revision, error) {
+	record, ok := db[key]
+	if !ok || record.Removed {
+		return nil, nil, ErrNotFound
+	}
+
+	if !record.IsOwner(userID) {
+		return nil, nil, ErrForbidden
+	}
+
+	if record.Value == value {
+		return record, nil, nil
+	}
+
+	if dedupScope != DedupNone && i.findByValue(db, value, dedupOwner(record, dedupScope)) != nil {
+		return nil, nil, &NotUniqueValueError{}
+	}
+
+	history := revisions[key]
+	added := make([]*Revision, 0, 2)
+	if len(history) == 0 {
+		added = append(added, &Revision{
+			Key:       key,
+			Version:   1,
+			Value:     record.Value,
+			CreatedAt: record.CreatedAt,
+		})
+	}
+	added = append(added, &Revision{
+		Key:       key,
+		Version:   len(history) + len(added) + 1,
+		Value:     value,
+		CreatedAt: now,
+	})
+	revisions[key] = append(history, added...)
+
+	updated := *record
+	updated.Value = value
+	updated.UpdatedAt = now
+
+	i.remove(record)
+	db[key] = &updated
+	i.add(&updated)
+	return &updated, added, nil
+}
+
+// copyRevisions returns revisions of the record in order of versions,
+// so callers can't change the history
+func copyRevisions(revisions []*Revision) []*Revision {
+	result := make([]*Revision, 0, len(revisions))
+	for _, revision := range revisions {
+		item := *revision
+		result = append(result, &item)
+	}
+	return result
+}
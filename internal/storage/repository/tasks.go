@@ -0,0 +1,48 @@
+package repository
+
+import (
+	"sort"
+	"time"
+)
+
+// DeleteTask is an accepted request of deletion of user records, it is
+// stored until workers process it, so it survives restarts of the service.
+// Tasks which failed after all retries are kept as dead letters.
+type DeleteTask struct {
+	ID        string     `json:"id"`
+	UserID    string     `json:"user_id,omitempty"`
+	Keys      []string   `json:"keys,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	Done      bool       `json:"done,omitempty"`
+	Attempts  int        `json:"attempts,omitempty"`
+	Error     string     `json:"error,omitempty"`
+	FailedAt  *time.Time `json:"failed_at,omitempty"`
+}
+
+func (t DeleteTask) IsDead() bool {
+	return t.FailedAt != nil
+}
+
+// bury returns a copy of the task with the failure of the dead task
+func (t DeleteTask) bury(dead *DeleteTask) *DeleteTask {
+	t.Attempts = dead.Attempts
+	t.Error = dead.Error
+	t.FailedAt = dead.FailedAt
+	return &t
+}
+
+// sortDeleteTasks returns pending tasks in order of creation
+// for the repositories without query language
+func sortDeleteTasks(tasks map[string]*DeleteTask) []*DeleteTask {
+	result := make([]*DeleteTask, 0, len(tasks))
+	for _, task := range tasks {
+		result = append(result, task)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].CreatedAt.Equal(result[j].CreatedAt) {
+			return result[i].ID < result[j].ID
+		}
+		return result[i].CreatedAt.Before(result[j].CreatedAt)
+	})
+	return result
+}
@@ -2,39 +2,99 @@ package storage
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/bigbag/go-musthave-shortener/internal/config"
 	"github.com/bigbag/go-musthave-shortener/internal/storage/repository"
+	"github.com/bigbag/go-musthave-shortener/internal/tracing"
 )
 
+var tracer = otel.Tracer("github.com/bigbag/go-musthave-shortener/internal/storage")
+
 type NotUniqueError struct{}
 
 func (e *NotUniqueError) Error() string {
 	return "not unique value"
 }
 
+func (e *NotUniqueError) Is(target error) bool {
+	return target == repository.ErrConflict
+}
+
 type StorageService struct {
-	cfg *config.Storage
-	r   repository.StorageRepository
+	cfg        *config.Storage
+	r          repository.StorageRepository
+	dedupScope string
 }
 
-func NewStorageService(ctx context.Context, cfg *config.Storage) (StorageService, error) {
+func NewStorageService(
+	ctx context.Context,
+	l logrus.FieldLogger,
+	cfg *config.Storage,
+	o repository.OperationObserver,
+) (StorageService, error) {
 	var (
 		r   repository.StorageRepository
 		err error
 	)
 
+	dedupScope := cfg.DedupScope
+	switch dedupScope {
+	case "":
+		dedupScope = repository.DedupGlobal
+	case repository.DedupGlobal, repository.DedupUser, repository.DedupNone:
+	default:
+		return StorageService{cfg: cfg}, fmt.Errorf("unknown dedup scope: %s", dedupScope)
+	}
+
 	if cfg.DatabaseDSN != "" {
-		r, err = repository.NewPGRepository(ctx, cfg.DatabaseDSN, cfg.ConnectionTimeout)
+		r, err = repository.NewPGRepository(
+			ctx,
+			cfg.DatabaseDSN,
+			repository.PGOptions{
+				ConnectionTimeout: cfg.ConnectionTimeout,
+				DedupScope:        dedupScope,
+				AutoMigrate:       cfg.AutoMigrate,
+			},
+		)
 	} else {
 		if cfg.FileStoragePath != "" {
-			r, err = repository.NewFileRepository(cfg.FileStoragePath)
+			r, err = repository.NewFileRepository(
+				cfg.FileStoragePath,
+				repository.FileOptions{
+					CompactionInterval: cfg.CompactionInterval,
+					CompactionMinSize:  cfg.CompactionMinSize,
+					CompactionRatio:    cfg.CompactionRatio,
+					SyncMode:           cfg.SyncMode,
+					SyncInterval:       cfg.SyncInterval,
+					RecoveryMode:       cfg.RecoveryMode,
+					Logger:             l,
+				},
+			)
 		} else {
 			r, err = repository.NewMemoryRepository()
 		}
 	}
 
-	service := StorageService{r: r, cfg: cfg}
+	if err == nil && o != nil {
+		r = repository.NewInstrumentedRepository(r, o)
+	}
+
+	if err == nil && cfg.CacheSize > 0 {
+		r, err = repository.NewCacheRepository(r, repository.CacheOptions{
+			Size:        cfg.CacheSize,
+			TTL:         cfg.CacheTTL,
+			NegativeTTL: cfg.CacheNegativeTTL,
+		})
+	}
+
+	service := StorageService{r: r, cfg: cfg, dedupScope: dedupScope}
 	if err != nil {
 		return service, err
 	}
@@ -42,60 +102,279 @@ func NewStorageService(ctx context.Context, cfg *config.Storage) (StorageService
 	return service, nil
 }
 
-func (s *StorageService) GetByKey(key string) (*repository.Record, error) {
-	return s.r.GetByKey(key)
+func (s *StorageService) GetByKey(ctx context.Context, key string) (*repository.Record, error) {
+	ctx, span := tracer.Start(ctx, "StorageService.GetByKey")
+	defer span.End()
+
+	record, err := s.r.GetByKey(ctx, key)
+	recordError(span, err)
+	return record, err
+}
+
+func (s *StorageService) GetByKeys(
+	ctx context.Context,
+	keys []string,
+) ([]*repository.Record, error) {
+	ctx, span := tracer.Start(ctx, "StorageService.GetByKeys")
+	defer span.End()
+
+	records, err := s.r.GetByKeys(ctx, keys)
+	recordError(span, err)
+	return records, err
 }
 
-func (s *StorageService) GetAllByUserID(userID string) ([]*repository.Record, error) {
-	return s.r.GetAllByUserID(userID)
+func (s *StorageService) GetAllByUserID(
+	ctx context.Context,
+	userID string,
+) ([]*repository.Record, error) {
+	ctx, span := tracer.Start(ctx, "StorageService.GetAllByUserID")
+	defer span.End()
+
+	records, err := s.r.GetAllByUserID(ctx, userID)
+	recordError(span, err)
+	return records, err
 }
 
-func (s *StorageService) Save(record *repository.Record) (*repository.Record, error) {
-	oldRecord, err := s.r.GetByValue(record.Value)
+// ListByUserID returns a page of records of the user
+func (s *StorageService) ListByUserID(
+	ctx context.Context,
+	q *repository.ListQuery,
+) (*repository.Page, error) {
+	ctx, span := tracer.Start(ctx, "StorageService.ListByUserID")
+	defer span.End()
+
+	page, err := s.r.ListByUserID(ctx, q)
+	recordError(span, err)
+	return page, err
+}
+
+// Save saves the record or returns already stored duplicate of it
+// within the scope of deduplication together with NotUniqueError
+func (s *StorageService) Save(
+	ctx context.Context,
+	record *repository.Record,
+) (*repository.Record, error) {
+	ctx, span := tracer.Start(ctx, "StorageService.Save")
+	defer span.End()
+
+	stored, created, err := s.r.SaveOrGet(ctx, record, s.dedupScope)
 	if err != nil {
-		return oldRecord, err
+		recordError(span, err)
+		return nil, err
 	}
 
-	if oldRecord != nil {
-		return oldRecord, &NotUniqueError{}
+	if !created {
+		return stored, &NotUniqueError{}
 	}
-
-	err = s.r.Save(record)
-	return record, err
+	return stored, nil
 }
 
+// SaveBatchOfRecord saves new records and returns a stored record for
+// every record of the batch in the same order
 func (s *StorageService) SaveBatchOfRecord(
+	ctx context.Context,
 	records []*repository.Record,
 ) ([]*repository.Record, error) {
-	var oldRecord *repository.Record
-
-	newRecords := make([]*repository.Record, 0, 100)
-	result := make([]*repository.Record, 0, 100)
-	for _, record := range records {
-		oldRecord, _ = s.r.GetByValue(record.Value)
-		if oldRecord == nil {
-			newRecords = append(newRecords, record)
-			result = append(result, record)
-		} else {
-			result = append(result, oldRecord)
-		}
+	ctx, span := tracer.Start(ctx, "StorageService.SaveBatchOfRecord")
+	defer span.End()
+
+	result, err := s.r.SaveOrGetBatch(ctx, records, s.dedupScope)
+	recordError(span, err)
+	return result, err
+}
+
+// UpdateValue changes the value of the record of the user or returns
+// already stored duplicate of the new value together with NotUniqueError
+func (s *StorageService) UpdateValue(
+	ctx context.Context,
+	userID string,
+	key string,
+	value string,
+) (*repository.Record, error) {
+	ctx, span := tracer.Start(ctx, "StorageService.UpdateValue")
+	defer span.End()
+
+	record, err := s.r.UpdateValue(ctx, userID, key, value, s.dedupScope, time.Now().UTC())
+	if !errors.Is(err, repository.ErrConflict) {
+		recordError(span, err)
+		return record, err
 	}
-	err := s.r.SaveBatchOfURL(newRecords)
-	if err != nil {
+
+	owner := ""
+	if s.dedupScope == repository.DedupUser {
+		owner = userID
+	}
+
+	stored, err := s.r.GetByValue(ctx, value, owner)
+	switch {
+	case err != nil:
+		recordError(span, err)
 		return nil, err
+	case stored == nil:
+		// the duplicate was purged after the update was rejected
+		return nil, &repository.NotUniqueValueError{}
 	}
+	return stored, &NotUniqueError{}
+}
+
+func (s *StorageService) GetRevisions(ctx context.Context, key string) ([]*repository.Revision, error) {
+	ctx, span := tracer.Start(ctx, "StorageService.GetRevisions")
+	defer span.End()
 
-	return result, nil
+	revisions, err := s.r.GetRevisions(ctx, key)
+	recordError(span, err)
+	return revisions, err
 }
 
-func (s *StorageService) DeleteByUserID(userID string, shortIDs []string) error {
-	return s.r.DeleteByUserID(userID, shortIDs)
+func (s *StorageService) DeleteByUserID(
+	ctx context.Context,
+	userID string,
+	shortIDs []string,
+) error {
+	ctx, span := tracer.Start(ctx, "StorageService.DeleteByUserID")
+	defer span.End()
+
+	err := s.r.DeleteByUserID(ctx, userID, shortIDs)
+	recordError(span, err)
+	return err
 }
 
-func (s *StorageService) Status() error {
-	return s.r.Status()
+// Restore brings back links removed within the grace period
+// and returns keys of the restored ones
+func (s *StorageService) Restore(
+	ctx context.Context,
+	userID string,
+	shortIDs []string,
+) ([]string, error) {
+	ctx, span := tracer.Start(ctx, "StorageService.Restore")
+	defer span.End()
+
+	now := time.Now().UTC()
+	restored, err := s.r.Restore(ctx, userID, shortIDs, now.Add(-s.cfg.RestoreGracePeriod), now)
+	recordError(span, err)
+	return restored, err
+}
+
+func (s *StorageService) DeleteExpired(ctx context.Context, now time.Time) (int, error) {
+	ctx, span := tracer.Start(ctx, "StorageService.DeleteExpired")
+	defer span.End()
+
+	total, err := s.r.DeleteExpired(ctx, now)
+	recordError(span, err)
+	return total, err
+}
+
+func (s *StorageService) Purge(
+	ctx context.Context,
+	userID string,
+	before time.Time,
+) (int, error) {
+	ctx, span := tracer.Start(ctx, "StorageService.Purge")
+	defer span.End()
+
+	total, err := s.r.Purge(ctx, userID, before)
+	recordError(span, err)
+	return total, err
+}
+
+func (s *StorageService) NextCounter(ctx context.Context) (uint64, error) {
+	ctx, span := tracer.Start(ctx, "StorageService.NextCounter")
+	defer span.End()
+
+	value, err := s.r.NextCounter(ctx)
+	recordError(span, err)
+	return value, err
+}
+
+func (s *StorageService) SaveClicks(ctx context.Context, clicks []*repository.Click) error {
+	ctx, span := tracer.Start(ctx, "StorageService.SaveClicks")
+	defer span.End()
+
+	err := s.r.SaveClicks(ctx, clicks)
+	recordError(span, err)
+	return err
+}
+
+func (s *StorageService) GetClickStats(
+	ctx context.Context,
+	key string,
+	topReferrers int,
+) (*repository.ClickStats, error) {
+	ctx, span := tracer.Start(ctx, "StorageService.GetClickStats")
+	defer span.End()
+
+	stats, err := s.r.GetClickStats(ctx, key, topReferrers)
+	recordError(span, err)
+	return stats, err
+}
+
+func (s *StorageService) SaveDeleteTask(ctx context.Context, task *repository.DeleteTask) error {
+	ctx, span := tracer.Start(ctx, "StorageService.SaveDeleteTask")
+	defer span.End()
+
+	err := s.r.SaveDeleteTask(ctx, task)
+	recordError(span, err)
+	return err
+}
+
+func (s *StorageService) AckDeleteTask(ctx context.Context, id string) error {
+	ctx, span := tracer.Start(ctx, "StorageService.AckDeleteTask")
+	defer span.End()
+
+	err := s.r.AckDeleteTask(ctx, id)
+	recordError(span, err)
+	return err
+}
+
+func (s *StorageService) BuryDeleteTask(ctx context.Context, task *repository.DeleteTask) error {
+	ctx, span := tracer.Start(ctx, "StorageService.BuryDeleteTask")
+	defer span.End()
+
+	err := s.r.BuryDeleteTask(ctx, task)
+	recordError(span, err)
+	return err
+}
+
+func (s *StorageService) GetDeleteTasks(ctx context.Context) ([]*repository.DeleteTask, error) {
+	ctx, span := tracer.Start(ctx, "StorageService.GetDeleteTasks")
+	defer span.End()
+
+	tasks, err := s.r.GetDeleteTasks(ctx)
+	recordError(span, err)
+	return tasks, err
+}
+
+func (s *StorageService) Compact(ctx context.Context) error {
+	ctx, span := tracer.Start(ctx, "StorageService.Compact")
+	defer span.End()
+
+	err := s.r.Compact(ctx)
+	recordError(span, err)
+	return err
+}
+
+func (s *StorageService) Stats() *repository.Stats {
+	return s.r.Stats()
+}
+
+func (s *StorageService) Status(ctx context.Context) error {
+	ctx, span := tracer.Start(ctx, "StorageService.Status")
+	defer span.End()
+
+	err := s.r.Status(ctx)
+	recordError(span, err)
+	return err
 }
 
 func (s *StorageService) Shutdown() error {
 	return s.r.Close()
 }
+
+// recordError marks the span as failed, missing records are expected
+// results of lookups, so they aren't recorded
+func recordError(span trace.Span, err error) {
+	if errors.Is(err, repository.ErrNotFound) {
+		return
+	}
+	tracing.RecordError(span, err)
+}
@@ -0,0 +1,259 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/bigbag/go-musthave-shortener/internal/config"
+	"github.com/bigbag/go-musthave-shortener/internal/storage/repository"
+)
+
+const (
+	benchmarkRecords   = 1000000
+	benchmarkBatchSize = 100
+)
+
+func newBenchmarkStorage(b *testing.B, cfg *config.Storage) StorageService {
+	ctx := context.Background()
+
+	l := logrus.New()
+	l.SetLevel(logrus.ErrorLevel)
+
+	s, err := NewStorageService(context.Background(), l, cfg, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	batch := make([]*repository.Record, 0, 10000)
+	for i := 0; i < benchmarkRecords; i++ {
+		batch = append(batch, &repository.Record{
+			Key:    fmt.Sprintf("key%d", i),
+			Value:  fmt.Sprintf("https://github.com/%d", i),
+			UserID: fmt.Sprintf("user%d", i%1000),
+		})
+		if len(batch) == cap(batch) {
+			if err = s.r.SaveBatchOfURL(ctx, batch); err != nil {
+				b.Fatal(err)
+			}
+			batch = batch[:0]
+		}
+	}
+
+	b.Cleanup(func() { s.Shutdown() })
+	return s
+}
+
+func newBenchmarkFileConfig(b *testing.B) *config.Storage {
+	return &config.Storage{
+		FileStoragePath: filepath.Join(b.TempDir(), "storage.json"),
+		SyncMode:        repository.SyncNone,
+		RecoveryMode:    repository.RecoveryStrict,
+	}
+}
+
+func benchmarkSave(b *testing.B, s StorageService) {
+	ctx := context.Background()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := s.Save(ctx, &repository.Record{
+			Key:    fmt.Sprintf("new%d", i),
+			Value:  fmt.Sprintf("https://github.com/new/%d", i),
+			UserID: "user",
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchmarkSaveBatch(b *testing.B, s StorageService) {
+	ctx := context.Background()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		records := make([]*repository.Record, 0, benchmarkBatchSize)
+		for j := 0; j < benchmarkBatchSize; j++ {
+			records = append(records, &repository.Record{
+				Key:    fmt.Sprintf("new%d_%d", i, j),
+				Value:  fmt.Sprintf("https://github.com/new/%d/%d", i, j),
+				UserID: "user",
+			})
+		}
+		b.StartTimer()
+
+		if _, err := s.SaveBatchOfRecord(ctx, records); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchmarkGetAllByUserID(b *testing.B, s StorageService) {
+	ctx := context.Background()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := s.GetAllByUserID(ctx, fmt.Sprintf("user%d", i%1000)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMemorySave(b *testing.B) {
+	benchmarkSave(b, newBenchmarkStorage(b, &config.Storage{}))
+}
+
+func BenchmarkMemorySaveBatch(b *testing.B) {
+	benchmarkSaveBatch(b, newBenchmarkStorage(b, &config.Storage{}))
+}
+
+func BenchmarkMemoryGetAllByUserID(b *testing.B) {
+	benchmarkGetAllByUserID(b, newBenchmarkStorage(b, &config.Storage{}))
+}
+
+func BenchmarkFileSave(b *testing.B) {
+	benchmarkSave(b, newBenchmarkStorage(b, newBenchmarkFileConfig(b)))
+}
+
+func BenchmarkFileSaveBatch(b *testing.B) {
+	benchmarkSaveBatch(b, newBenchmarkStorage(b, newBenchmarkFileConfig(b)))
+}
+
+func TestStorageServiceDedupScope(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		scope     string
+		sameUser  bool
+		otherUser bool
+	}{
+		{scope: repository.DedupGlobal, sameUser: true, otherUser: true},
+		{scope: repository.DedupUser, sameUser: true, otherUser: false},
+		{scope: repository.DedupNone, sameUser: false, otherUser: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.scope, func(t *testing.T) {
+			s, err := NewStorageService(
+				context.Background(), logrus.New(), &config.Storage{DedupScope: tt.scope}, nil,
+			)
+			assert.Nil(t, err)
+			defer s.Shutdown()
+
+			value := "https://github.com/"
+			_, err = s.Save(ctx, &repository.Record{Key: "first", Value: value, UserID: "user"})
+			assert.Nil(t, err)
+
+			record, err := s.Save(ctx, &repository.Record{Key: "second", Value: value, UserID: "user"})
+			if tt.sameUser {
+				assert.IsType(t, &NotUniqueError{}, err)
+				assert.Equal(t, "first", record.Key)
+			} else {
+				assert.Nil(t, err)
+			}
+
+			record, err = s.Save(ctx, &repository.Record{Key: "third", Value: value, UserID: "other"})
+			if tt.otherUser {
+				assert.IsType(t, &NotUniqueError{}, err)
+				assert.Equal(t, "first", record.Key)
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, "third", record.Key)
+			}
+
+			records, err := s.SaveBatchOfRecord(ctx, []*repository.Record{
+				{Key: "fourth", Value: value, UserID: "other"},
+			})
+			assert.Nil(t, err)
+			if tt.scope == repository.DedupNone {
+				assert.Equal(t, "fourth", records[0].Key)
+			} else {
+				assert.NotEqual(t, "fourth", records[0].Key)
+			}
+		})
+	}
+}
+
+func TestStorageServiceUnknownDedupScope(t *testing.T) {
+	_, err := NewStorageService(
+		context.Background(), logrus.New(), &config.Storage{DedupScope: "unknown"}, nil,
+	)
+	assert.NotNil(t, err)
+}
+
+func TestStorageServiceSaveRace(t *testing.T) {
+	ctx := context.Background()
+
+	const workers = 50
+
+	tests := []struct {
+		name string
+		cfg  *config.Storage
+	}{
+		{name: "memory", cfg: &config.Storage{}},
+		{name: "file", cfg: &config.Storage{
+			FileStoragePath: filepath.Join(t.TempDir(), "storage.json"),
+			SyncMode:        repository.SyncNone,
+			RecoveryMode:    repository.RecoveryStrict,
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewStorageService(context.Background(), logrus.New(), tt.cfg, nil)
+			assert.Nil(t, err)
+			defer s.Shutdown()
+
+			var (
+				wg      sync.WaitGroup
+				mu      sync.Mutex
+				created int
+				keys    = make(map[string]struct{})
+			)
+
+			start := make(chan struct{})
+			for i := 0; i < workers; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					<-start
+
+					record, err := s.Save(ctx, &repository.Record{
+						Key:    fmt.Sprintf("key%d", i),
+						Value:  "https://github.com/race",
+						UserID: fmt.Sprintf("user%d", i),
+					})
+
+					mu.Lock()
+					defer mu.Unlock()
+
+					switch err.(type) {
+					case nil:
+						created++
+					case *NotUniqueError:
+					default:
+						t.Error(err)
+						return
+					}
+					keys[record.Key] = struct{}{}
+				}(i)
+			}
+			close(start)
+			wg.Wait()
+
+			assert.Equal(t, 1, created)
+			assert.Len(t, keys, 1)
+
+			records, err := s.GetAllByUserID(ctx, "user0")
+			assert.Nil(t, err)
+			assert.LessOrEqual(t, len(records), 1)
+		})
+	}
+}
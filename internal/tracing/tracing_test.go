@@ -0,0 +1,96 @@
+package tracing
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+
+	"github.com/bigbag/go-musthave-shortener/internal/config"
+)
+
+const (
+	testTraceID  = "4bf92f3577b34da6a3ce929d0e0e4736"
+	testParentID = "00f067aa0ba902b7"
+)
+
+type testSpan struct {
+	Name        string
+	SpanContext struct {
+		TraceID string
+	}
+	Parent struct {
+		SpanID string
+	}
+}
+
+func readSpans(t *testing.T, path string) map[string]testSpan {
+	f, err := os.Open(path)
+	assert.Nil(t, err)
+	defer f.Close()
+
+	spans := make(map[string]testSpan)
+	decoder := json.NewDecoder(bufio.NewReader(f))
+	for decoder.More() {
+		var span testSpan
+		assert.Nil(t, decoder.Decode(&span))
+		spans[span.Name] = span
+	}
+	return spans
+}
+
+func TestFileExporterPropagation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traces.json")
+	p, err := New(context.Background(), "test", &config.Tracing{
+		Exporter:    ExporterFile,
+		FilePath:    path,
+		SampleRatio: 1,
+	})
+	assert.Nil(t, err)
+
+	app := fiber.New()
+	app.Use(Middleware())
+	app.Get("/links/:id", func(c *fiber.Ctx) error {
+		_, span := otel.Tracer("test").Start(c.UserContext(), "handler")
+		defer span.End()
+		return c.SendString("ok")
+	})
+
+	req := httptest.NewRequest("GET", "/links/abc", nil)
+	req.Header.Set("traceparent", "00-"+testTraceID+"-"+testParentID+"-01")
+	resp, err := app.Test(req)
+	assert.Nil(t, err)
+	assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+
+	assert.Nil(t, p.Shutdown(context.Background()))
+
+	spans := readSpans(t, path)
+	assert.Len(t, spans, 2)
+
+	server, ok := spans["GET /links/:id"]
+	assert.True(t, ok)
+	assert.Equal(t, testTraceID, server.SpanContext.TraceID)
+	assert.Equal(t, testParentID, server.Parent.SpanID)
+
+	handler, ok := spans["handler"]
+	assert.True(t, ok)
+	assert.Equal(t, testTraceID, handler.SpanContext.TraceID)
+}
+
+func TestDisabledTracing(t *testing.T) {
+	p, err := New(context.Background(), "test", &config.Tracing{Exporter: ExporterNone})
+	assert.Nil(t, err)
+	assert.Nil(t, p.Shutdown(context.Background()))
+}
+
+func TestUnknownExporter(t *testing.T) {
+	_, err := New(context.Background(), "test", &config.Tracing{Exporter: "unknown"})
+	assert.NotNil(t, err)
+}
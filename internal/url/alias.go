@@ -0,0 +1,42 @@
+package url
+
+import (
+	"regexp"
+	"strings"
+)
+
+const (
+	aliasMinLength = 3
+	aliasMaxLength = 64
+)
+
+var aliasPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// reservedAliases can't be used as short ids, otherwise they will shadow
+// service routes registered in NewURLHandler
+var reservedAliases = map[string]struct{}{
+	"api":     {},
+	"ping":    {},
+	"admin":   {},
+	"metrics": {},
+}
+
+func validateAlias(alias string) error {
+	if len(alias) < aliasMinLength || len(alias) > aliasMaxLength {
+		return &InvalidAliasError{Reason: "length must be between 3 and 64"}
+	}
+
+	if !aliasPattern.MatchString(alias) {
+		return &InvalidAliasError{Reason: "allowed only latin letters, digits, '-' and '_'"}
+	}
+
+	if isReserved(alias) {
+		return &InvalidAliasError{Reason: "alias is reserved"}
+	}
+	return nil
+}
+
+func isReserved(shortID string) bool {
+	_, ok := reservedAliases[strings.ToLower(shortID)]
+	return ok
+}
@@ -0,0 +1,134 @@
+package url
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/bigbag/go-musthave-shortener/internal/config"
+)
+
+// dropWarnInterval limits warnings about dropped clicks,
+// the number of them is exposed by Dropped
+const dropWarnInterval = 10 * time.Second
+
+// ClickCollector buffers clicks and saves them to the storage by batches
+// in background, so redirect doesn't wait for the storage
+type ClickCollector struct {
+	l             logrus.FieldLogger
+	r             URLRepository
+	mu            sync.RWMutex
+	stop          bool
+	clicks        chan *Click
+	batchSize     int
+	flushInterval time.Duration
+	done          chan struct{}
+	dropped       uint64
+	warnedAt      int64
+}
+
+func NewClickCollector(
+	l logrus.FieldLogger,
+	r URLRepository,
+	cfg *config.Analytics,
+) *ClickCollector {
+	c := &ClickCollector{
+		l:             l,
+		r:             r,
+		clicks:        make(chan *Click, cfg.BufferSize),
+		batchSize:     cfg.BatchSize,
+		flushInterval: cfg.FlushInterval,
+		done:          make(chan struct{}),
+	}
+
+	go c.loop()
+	return c
+}
+
+// Push adds click to the buffer, click is dropped when the buffer is full
+func (c *ClickCollector) Push(click *Click) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.stop {
+		return
+	}
+
+	select {
+	case c.clicks <- click:
+	default:
+		c.warnDropped(atomic.AddUint64(&c.dropped, 1))
+	}
+}
+
+// Dropped returns the number of clicks dropped because of the full buffer
+func (c *ClickCollector) Dropped() uint64 {
+	return atomic.LoadUint64(&c.dropped)
+}
+
+// warnDropped logs dropped clicks not more often than dropWarnInterval
+func (c *ClickCollector) warnDropped(dropped uint64) {
+	now := time.Now().UnixNano()
+	warnedAt := atomic.LoadInt64(&c.warnedAt)
+	if now-warnedAt < int64(dropWarnInterval) {
+		return
+	}
+	if !atomic.CompareAndSwapInt64(&c.warnedAt, warnedAt, now) {
+		return
+	}
+	c.l.Warn("collector: buffer is full, clicks are dropped, total: ", dropped)
+}
+
+func (c *ClickCollector) loop() {
+	defer close(c.done)
+
+	ticker := time.NewTicker(c.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*Click, 0, c.batchSize)
+	for {
+		select {
+		case click, ok := <-c.clicks:
+			if !ok {
+				c.flush(batch)
+				return
+			}
+
+			batch = append(batch, click)
+			if len(batch) >= c.batchSize {
+				c.flush(batch)
+				batch = make([]*Click, 0, c.batchSize)
+			}
+		case <-ticker.C:
+			c.flush(batch)
+			batch = make([]*Click, 0, c.batchSize)
+		}
+	}
+}
+
+func (c *ClickCollector) flush(batch []*Click) {
+	if len(batch) == 0 {
+		return
+	}
+
+	// clicks are saved after the redirect was sent, so they don't
+	// depend on the request context
+	if err := c.r.SaveClicks(context.Background(), batch); err != nil {
+		c.l.Info("collector: failed to save clicks ", err)
+	}
+}
+
+// Close stops accepting of new clicks and flushes buffered ones
+func (c *ClickCollector) Close() {
+	c.mu.Lock()
+	if !c.stop {
+		c.stop = true
+		close(c.clicks)
+	}
+	c.mu.Unlock()
+
+	<-c.done
+}
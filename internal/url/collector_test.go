@@ -0,0 +1,19 @@
+package url
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClickCollectorDropped(t *testing.T) {
+	c := &ClickCollector{l: logrus.New(), clicks: make(chan *Click, 1)}
+
+	c.Push(&Click{ShortID: "first"})
+	assert.Equal(t, uint64(0), c.Dropped())
+
+	c.Push(&Click{ShortID: "second"})
+	c.Push(&Click{ShortID: "third"})
+	assert.Equal(t, uint64(2), c.Dropped())
+}
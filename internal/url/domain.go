@@ -1,30 +1,148 @@
 package url
 
+import (
+	"context"
+	"time"
+
+	"github.com/bigbag/go-musthave-shortener/internal/storage/repository"
+)
+
 type NotUniqueURLError struct{}
 
 func (e *NotUniqueURLError) Error() string {
 	return "not unique url"
 }
 
+func (e *NotUniqueURLError) Is(target error) bool {
+	return target == repository.ErrConflict
+}
+
+type NotUniqueAliasError struct{}
+
+func (e *NotUniqueAliasError) Error() string {
+	return "alias already taken"
+}
+
+func (e *NotUniqueAliasError) Is(target error) bool {
+	return target == repository.ErrConflict
+}
+
+type InvalidAliasError struct {
+	Reason string
+}
+
+func (e *InvalidAliasError) Error() string {
+	return "invalid alias: " + e.Reason
+}
+
+type InvalidExpirationError struct {
+	Reason string
+}
+
+func (e *InvalidExpirationError) Error() string {
+	return "invalid expiration: " + e.Reason
+}
+
+type InvalidListRequestError struct {
+	Reason string
+}
+
+func (e *InvalidListRequestError) Error() string {
+	return "invalid list request: " + e.Reason
+}
+
+type NotFoundURLError struct{}
+
+func (e *NotFoundURLError) Error() string {
+	return "url not found"
+}
+
+func (e *NotFoundURLError) Is(target error) bool {
+	return target == repository.ErrNotFound
+}
+
+type NotFoundJobError struct{}
+
+func (e *NotFoundJobError) Error() string {
+	return "job not found"
+}
+
+func (e *NotFoundJobError) Is(target error) bool {
+	return target == repository.ErrNotFound
+}
+
+type NotFoundRevisionError struct{}
+
+func (e *NotFoundRevisionError) Error() string {
+	return "revision not found"
+}
+
+func (e *NotFoundRevisionError) Is(target error) bool {
+	return target == repository.ErrNotFound
+}
+
+type NotOwnerError struct{}
+
+func (e *NotOwnerError) Error() string {
+	return "url belongs to another user"
+}
+
+func (e *NotOwnerError) Is(target error) bool {
+	return target == repository.ErrForbidden
+}
+
 type URL struct {
 	ShortID       string
 	FullURL       string
 	ShortURL      string
 	CorrelationID string
+	UserID        string
 	Removed       bool
+	ExpiresAt     *time.Time
+	DeletedAt     *time.Time
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
+
+func (u URL) IsExpired(now time.Time) bool {
+	return u.ExpiresAt != nil && !u.ExpiresAt.After(now)
+}
+
+type UpdateRequest struct {
+	FullURL string `json:"url"`
+}
+
+type RollbackRequest struct {
+	Version int `json:"version"`
+}
+
+// Revision is a target of the link since the time of the revision,
+// the time of the initial target of links created by older versions is omitted
+type Revision struct {
+	Version   int        `json:"version"`
+	FullURL   string     `json:"original_url"`
+	CreatedAt *time.Time `json:"created_at,omitempty"`
 }
 
 type JSONRequest struct {
 	FullURL string `json:"url"`
+	Alias   string `json:"alias"`
+	Expiration
 }
 
 type BatchRequestItem struct {
 	FullURL       string `json:"original_url"`
 	CorrelationID string `json:"correlation_id"`
+	Alias         string `json:"alias"`
+	Expiration
 }
 
 type BatchRequest []BatchRequestItem
 
+type PurgeRequest struct {
+	UserID string `json:"user_id"`
+}
+
 type BatchResponseItem struct {
 	ShortURL      string `json:"short_url"`
 	CorrelationID string `json:"correlation_id"`
@@ -32,31 +150,119 @@ type BatchResponseItem struct {
 
 type BatchResponse []*BatchResponseItem
 
+// UserURL is a link of the user, timestamps unknown for
+// links created by older versions are omitted
 type UserURL struct {
-	FullURL  string `json:"original_url"`
-	ShortURL string `json:"short_url"`
+	FullURL   string     `json:"original_url"`
+	ShortURL  string     `json:"short_url"`
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+type Click struct {
+	ShortID   string
+	Timestamp time.Time
+	Referer   string
+	UserAgent string
+	IP        string
+	Language  string
+}
+
+type DailyStats struct {
+	Date   string `json:"date"`
+	Clicks int    `json:"clicks"`
+}
+
+type ReferrerStats struct {
+	Referer string `json:"referer"`
+	Clicks  int    `json:"clicks"`
+}
+
+type URLStats struct {
+	ShortID      string           `json:"short_id"`
+	Total        int              `json:"total"`
+	Daily        []*DailyStats    `json:"daily"`
+	TopReferrers []*ReferrerStats `json:"top_referrers"`
+}
+
+type DeadTask struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"user_id"`
+	ShortIDs  []string  `json:"short_ids"`
+	Attempts  int       `json:"attempts"`
+	Error     string    `json:"error"`
+	CreatedAt time.Time `json:"created_at"`
+	FailedAt  time.Time `json:"failed_at"`
+}
+
+type StorageStats struct {
+	Backend          string `json:"backend"`
+	Records          int    `json:"records"`
+	LogEntries       int    `json:"log_entries"`
+	LogSize          int64  `json:"log_size"`
+	ReplayDurationMs int64  `json:"replay_duration_ms"`
+	Compactions      int    `json:"compactions"`
+	CompactErrors    int    `json:"compact_errors"`
+	CacheEntries     int    `json:"cache_entries"`
+	CacheHits        uint64 `json:"cache_hits"`
+	CacheMisses      uint64 `json:"cache_misses"`
 }
 
 type URLRepository interface {
-	GetURL(shortID string) (*URL, error)
-	FindAllByUserID(userID string) ([]*URL, error)
-	CreateURL(fullURL string, userID string) (string, error)
-	CreateBatchOfURL(items BatchRequest, userID string) ([]*URL, error)
-	DeleteUserURLs(userID string, shortIDs []string) error
-	Status() error
+	GetURL(ctx context.Context, shortID string) (*URL, error)
+	GetURLs(ctx context.Context, shortIDs []string) ([]*URL, error)
+	FindAllByUserID(ctx context.Context, req *ListRequest) (*URLPage, error)
+	CreateURL(ctx context.Context, req *JSONRequest, userID string) (string, error)
+	CreateBatchOfURL(ctx context.Context, items BatchRequest, userID string) ([]*URL, error)
+	UpdateURL(ctx context.Context, shortID string, userID string, fullURL string) (*URL, error)
+	GetRevisions(ctx context.Context, shortID string) ([]*Revision, error)
+	DeleteUserURLs(ctx context.Context, userID string, shortIDs []string) error
+	RestoreUserURLs(ctx context.Context, userID string, shortIDs []string) ([]string, error)
+	DeleteExpiredURLs(ctx context.Context) (int, error)
+	PurgeURLs(ctx context.Context, userID string, before time.Time) (int, error)
+	SaveClicks(ctx context.Context, clicks []*Click) error
+	GetStats(ctx context.Context, shortID string) (*URLStats, error)
+	SaveDeleteTask(ctx context.Context, task *Task) error
+	AckDeleteTask(ctx context.Context, id string) error
+	BuryDeleteTask(ctx context.Context, task *DeadTask) error
+	GetDeleteTasks(ctx context.Context) ([]*Task, error)
+	GetDeadTasks(ctx context.Context) ([]*DeadTask, error)
+	CompactStorage(ctx context.Context) error
+	GetStorageStats() *StorageStats
+	Status(ctx context.Context) error
 	Close() error
 }
 
 type URLService interface {
-	FetchURL(shortID string) (*URL, error)
-	FetchUserURLs(baseURL string, userID string) ([]*UserURL, error)
-	BuildURL(baseURL string, fullURL string, userID string) (string, error)
+	FetchURL(ctx context.Context, shortID string) (*URL, error)
+	FetchUserURLs(ctx context.Context, baseURL string, req *ListRequest) (*UserURLPage, error)
+	BuildURL(ctx context.Context, baseURL string, req *JSONRequest, userID string) (string, error)
 	BuildBatchOfURL(
+		ctx context.Context,
 		baseURL string,
 		items BatchRequest,
 		userID string,
 	) (BatchResponse, error)
-	DeleteUserURLs(userID string, shortIDs []string) error
-	Status() error
+	UpdateUserURL(ctx context.Context, baseURL string, shortID string, userID string, fullURL string) (string, error)
+	FetchRevisions(ctx context.Context, shortID string, userID string) ([]*Revision, error)
+	RollbackUserURL(ctx context.Context, baseURL string, shortID string, userID string, version int) (string, error)
+	DeleteUserURLs(ctx context.Context, userID string, shortIDs []string) (string, error)
+	FetchJob(ctx context.Context, jobID string, userID string) (*Job, error)
+	RestoreUserURLs(ctx context.Context, userID string, shortIDs []string) ([]string, error)
+	PurgeURLs(ctx context.Context, userID string) (int, error)
+	TrackClick(click *Click)
+	FetchURLStats(ctx context.Context, shortID string, userID string) (*URLStats, error)
+	CompactStorage(ctx context.Context) (*StorageStats, error)
+	FetchStorageStats() *StorageStats
+	FetchDeadTasks() []*DeadTask
+	Status(ctx context.Context) error
 	Shutdown() error
 }
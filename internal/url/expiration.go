@@ -0,0 +1,36 @@
+package url
+
+import "time"
+
+// Expiration describes optional lifetime of short link,
+// absolute expiry and ttl in seconds can't be used together
+type Expiration struct {
+	ExpiresAt *time.Time `json:"expires_at"`
+	TTL       int64      `json:"ttl"`
+}
+
+func (e Expiration) deadline(now time.Time) (*time.Time, error) {
+	if e.ExpiresAt != nil && e.TTL != 0 {
+		return nil, &InvalidExpirationError{Reason: "expires_at and ttl can't be used together"}
+	}
+
+	if e.TTL < 0 {
+		return nil, &InvalidExpirationError{Reason: "ttl must be positive"}
+	}
+
+	if e.TTL > 0 {
+		expiresAt := now.Add(time.Duration(e.TTL) * time.Second).UTC()
+		return &expiresAt, nil
+	}
+
+	if e.ExpiresAt == nil {
+		return nil, nil
+	}
+
+	if !e.ExpiresAt.After(now) {
+		return nil, &InvalidExpirationError{Reason: "expires_at must be in the future"}
+	}
+
+	expiresAt := e.ExpiresAt.UTC()
+	return &expiresAt, nil
+}
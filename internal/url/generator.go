@@ -0,0 +1,141 @@
+package url
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/bigbag/go-musthave-shortener/internal/config"
+	"github.com/bigbag/go-musthave-shortener/internal/storage"
+)
+
+const (
+	base62Alphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+)
+
+// ShortIDGenerator makes candidates for short id, attempt is a number of
+// previous candidates for the same url which were already taken
+type ShortIDGenerator interface {
+	Generate(ctx context.Context, fullURL string, attempt int) (string, error)
+}
+
+func NewShortIDGenerator(
+	cfg *config.ShortID,
+	s storage.StorageService,
+) (ShortIDGenerator, error) {
+	var alphabet string
+
+	switch cfg.Alphabet {
+	case "base62":
+		alphabet = base62Alphabet
+	case "base58":
+		alphabet = base58Alphabet
+	default:
+		return nil, fmt.Errorf("unknown short id alphabet: %s", cfg.Alphabet)
+	}
+
+	if cfg.Length < aliasMinLength || cfg.Length > aliasMaxLength {
+		return nil, fmt.Errorf("short id length must be between %d and %d", aliasMinLength, aliasMaxLength)
+	}
+
+	switch cfg.Generator {
+	case "random":
+		return &randomGenerator{alphabet: alphabet, length: cfg.Length}, nil
+	case "counter":
+		return &counterGenerator{s: s, alphabet: alphabet, length: cfg.Length}, nil
+	case "hash":
+		return &hashGenerator{alphabet: alphabet, length: cfg.Length}, nil
+	default:
+		return nil, fmt.Errorf("unknown short id generator: %s", cfg.Generator)
+	}
+}
+
+// randomGenerator makes random short id with fixed length
+type randomGenerator struct {
+	alphabet string
+	length   int
+}
+
+func (g *randomGenerator) Generate(_ context.Context, _ string, _ int) (string, error) {
+	max := big.NewInt(int64(len(g.alphabet)))
+
+	result := make([]byte, g.length)
+	for i := range result {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		result[i] = g.alphabet[n.Int64()]
+	}
+	return string(result), nil
+}
+
+// counterGenerator makes short id with fixed length from monotonically
+// increasing counter stored in the storage
+type counterGenerator struct {
+	s        storage.StorageService
+	alphabet string
+	length   int
+}
+
+func (g *counterGenerator) Generate(ctx context.Context, _ string, _ int) (string, error) {
+	value, err := g.s.NextCounter(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	result := encode(new(big.Int).SetUint64(value), g.alphabet)
+	if len(result) > g.length {
+		return "", fmt.Errorf("counter %d exceeds short id length %d", value, g.length)
+	}
+	return strings.Repeat(g.alphabet[:1], g.length-len(result)) + result, nil
+}
+
+// hashGenerator makes deterministic short id from hash of url,
+// next attempts use hash of url with attempt number as salt
+type hashGenerator struct {
+	alphabet string
+	length   int
+}
+
+func (g *hashGenerator) Generate(_ context.Context, fullURL string, attempt int) (string, error) {
+	data := fullURL
+	if attempt > 0 {
+		data = fullURL + "#" + strconv.Itoa(attempt)
+	}
+
+	sum := sha256.Sum256([]byte(data))
+	result := encode(new(big.Int).SetBytes(sum[:]), g.alphabet)
+	if len(result) > g.length {
+		result = result[:g.length]
+	}
+	return result, nil
+}
+
+func encode(value *big.Int, alphabet string) string {
+	if value.Sign() == 0 {
+		return string(alphabet[0])
+	}
+
+	var (
+		base   = big.NewInt(int64(len(alphabet)))
+		mod    = new(big.Int)
+		result = make([]byte, 0, 16)
+	)
+
+	value = new(big.Int).Set(value)
+	for value.Sign() > 0 {
+		value.DivMod(value, base, mod)
+		result = append(result, alphabet[mod.Int64()])
+	}
+
+	for i, j := 0, len(result)-1; i < j; i, j = i+1, j-1 {
+		result[i], result[j] = result[j], result[i]
+	}
+	return string(result)
+}
@@ -0,0 +1,100 @@
+package url
+
+import (
+	"context"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/bigbag/go-musthave-shortener/internal/config"
+	"github.com/bigbag/go-musthave-shortener/internal/storage"
+)
+
+func TestRandomGenerator(t *testing.T) {
+	ctx := context.Background()
+
+	g, err := NewShortIDGenerator(
+		&config.ShortID{Generator: "random", Alphabet: "base58", Length: 10}, storage.StorageService{},
+	)
+	assert.Nil(t, err)
+
+	shortID, err := g.Generate(ctx, "https://github.com", 0)
+	assert.Nil(t, err)
+	assert.Len(t, shortID, 10)
+	for _, c := range shortID {
+		assert.True(t, strings.ContainsRune(base58Alphabet, c))
+	}
+}
+
+func TestHashGenerator(t *testing.T) {
+	ctx := context.Background()
+
+	g, err := NewShortIDGenerator(
+		&config.ShortID{Generator: "hash", Alphabet: "base62", Length: 8}, storage.StorageService{},
+	)
+	assert.Nil(t, err)
+
+	first, _ := g.Generate(ctx, "https://github.com", 0)
+	second, _ := g.Generate(ctx, "https://github.com", 0)
+	retry, _ := g.Generate(ctx, "https://github.com", 1)
+
+	assert.Len(t, first, 8)
+	assert.Equal(t, first, second)
+	assert.NotEqual(t, first, retry)
+}
+
+func TestCounterGenerator(t *testing.T) {
+	ctx := context.Background()
+	cfg := &config.ShortID{Generator: "counter", Alphabet: "base58", Length: 6}
+	fileName := filepath.Join(t.TempDir(), "storage.json")
+
+	s, err := storage.NewStorageService(ctx, logrus.New(), &config.Storage{FileStoragePath: fileName}, nil)
+	assert.Nil(t, err)
+
+	g, err := NewShortIDGenerator(cfg, s)
+	assert.Nil(t, err)
+
+	first, err := g.Generate(ctx, "https://github.com", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, "111112", first)
+
+	second, err := g.Generate(ctx, "https://github.com", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, "111113", second)
+	assert.Nil(t, s.Shutdown())
+
+	data, err := os.ReadFile(fileName + ".counter")
+	assert.Nil(t, err)
+	assert.Equal(t, "1000", strings.TrimSpace(string(data)))
+
+	s, err = storage.NewStorageService(ctx, logrus.New(), &config.Storage{FileStoragePath: fileName}, nil)
+	assert.Nil(t, err)
+	defer s.Shutdown()
+
+	g, err = NewShortIDGenerator(cfg, s)
+	assert.Nil(t, err)
+
+	third, err := g.Generate(ctx, "https://github.com", 0)
+	assert.Nil(t, err)
+	// values of the reserved block are skipped after restart
+	assert.Equal(t, "1111JG", third)
+}
+
+func TestUnknownGenerator(t *testing.T) {
+	_, err := NewShortIDGenerator(
+		&config.ShortID{Generator: "uuid", Alphabet: "base62", Length: 8}, storage.StorageService{},
+	)
+	assert.NotNil(t, err)
+}
+
+func TestEncode(t *testing.T) {
+	tests := map[uint64]string{0: "0", 61: "z", 62: "10", 3843: "zz"}
+	for value, expected := range tests {
+		assert.Equal(t, expected, encode(new(big.Int).SetUint64(value), base62Alphabet))
+	}
+}
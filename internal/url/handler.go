@@ -1,31 +1,68 @@
 package url
 
 import (
+	"errors"
+	"strconv"
+	"time"
+
 	"github.com/bigbag/go-musthave-shortener/internal/config"
+	"github.com/bigbag/go-musthave-shortener/internal/metrics"
+	"github.com/bigbag/go-musthave-shortener/internal/middleware/admin"
+	"github.com/bigbag/go-musthave-shortener/internal/storage/repository"
 	"github.com/bigbag/go-musthave-shortener/internal/utils"
 	"github.com/gofiber/fiber/v2"
 	"github.com/sirupsen/logrus"
 )
 
+const (
+	headerTotalCount = "X-Total-Count"
+	headerNextCursor = "X-Next-Cursor"
+)
+
 type URLHandler struct {
 	urlService URLService
 	log        logrus.FieldLogger
 	cfg        *config.Config
+	m          *metrics.Metrics
 }
 
-func NewURLHandler(urlRoute fiber.Router, us URLService, cfg *config.Config, l logrus.FieldLogger) {
-	handler := &URLHandler{urlService: us, log: l, cfg: cfg}
+func NewURLHandler(
+	urlRoute fiber.Router,
+	us URLService,
+	cfg *config.Config,
+	l logrus.FieldLogger,
+	m *metrics.Metrics,
+) {
+	handler := &URLHandler{urlService: us, log: l, cfg: cfg, m: m}
 
 	urlRoute.Get("/ping", handler.getStatus)
 
 	urlRoute.Post("/", handler.createShortURL)
 	urlRoute.Post("/api/shorten", handler.createShortURLJson)
 	urlRoute.Post("/api/shorten/batch", handler.createBatchOfShortURL)
+	urlRoute.Post("/api/user/urls/restore", handler.restoreUserURLs)
 
 	urlRoute.Get("/:shortID", handler.changeLocation)
 	urlRoute.Get("/api/user/urls", handler.getUserURLs)
+	urlRoute.Get("/api/user/urls/:shortID/stats", handler.getURLStats)
+	urlRoute.Get("/api/user/urls/:shortID/revisions", handler.getRevisions)
+	urlRoute.Get("/api/user/jobs/:jobID", handler.getJob)
+
+	urlRoute.Patch("/api/user/urls/:shortID", handler.updateUserURL)
+	urlRoute.Post("/api/user/urls/:shortID/rollback", handler.rollbackUserURL)
 
 	urlRoute.Delete("/api/user/urls", handler.deleteUserURLs)
+
+	adminRoute := urlRoute.Group("/api/admin", admin.New(admin.Config{
+		Token: cfg.AdminToken,
+		Unauthorized: func(c *fiber.Ctx) error {
+			return utils.SendJSONError(c, fiber.StatusUnauthorized, "unauthorized")
+		},
+	}))
+	adminRoute.Post("/purge", handler.purgeURLs)
+	adminRoute.Get("/storage/stats", handler.getStorageStats)
+	adminRoute.Post("/storage/compact", handler.compactStorage)
+	adminRoute.Get("/tasks/dead", handler.getDeadTasks)
 }
 
 func (h *URLHandler) getBaseURL(c *fiber.Ctx) string {
@@ -36,7 +73,10 @@ func (h *URLHandler) getBaseURL(c *fiber.Ctx) string {
 
 }
 func (h *URLHandler) getStatus(c *fiber.Ctx) error {
-	err := h.urlService.Status()
+	ctx, span := tracer.Start(c.UserContext(), "URLHandler.getStatus")
+	defer span.End()
+
+	err := h.urlService.Status(ctx)
 	if err != nil {
 		return utils.SendJSONError(
 			c, fiber.StatusInternalServerError, "PG connection error",
@@ -46,6 +86,9 @@ func (h *URLHandler) getStatus(c *fiber.Ctx) error {
 }
 
 func (h *URLHandler) createShortURLJson(c *fiber.Ctx) error {
+	ctx, span := tracer.Start(c.UserContext(), "URLHandler.createShortURLJson")
+	defer span.End()
+
 	req := new(JSONRequest)
 	if err := c.BodyParser(req); err != nil {
 		return utils.SendJSONError(
@@ -54,20 +97,26 @@ func (h *URLHandler) createShortURLJson(c *fiber.Ctx) error {
 	}
 
 	userID := c.Locals(h.cfg.UserContextKey).(string)
-	shortURL, err := h.urlService.BuildURL(h.getBaseURL(c), req.FullURL, userID)
+	shortURL, err := h.urlService.BuildURL(ctx, h.getBaseURL(c), req, userID)
 	result := &fiber.Map{"result": shortURL}
 
 	switch err.(type) {
 	case *NotUniqueURLError:
 		return c.Status(fiber.StatusConflict).JSON(result)
+	case *InvalidAliasError, *InvalidExpirationError:
+		return utils.SendJSONError(c, fiber.StatusBadRequest, err.Error())
 	case nil:
+		h.m.AddCreatedLinks("api", 1)
 		return c.Status(fiber.StatusCreated).JSON(result)
 	default:
-		return utils.SendJSONError(c, fiber.StatusInternalServerError, err.Error())
+		return err
 	}
 }
 
 func (h *URLHandler) createShortURL(c *fiber.Ctx) error {
+	ctx, span := tracer.Start(c.UserContext(), "URLHandler.createShortURL")
+	defer span.End()
+
 	fullURL := string(c.Body())
 	if fullURL == "" {
 		return utils.SendJSONError(
@@ -76,19 +125,25 @@ func (h *URLHandler) createShortURL(c *fiber.Ctx) error {
 	}
 
 	userID := c.Locals(h.cfg.UserContextKey).(string)
-	shortURL, err := h.urlService.BuildURL(h.getBaseURL(c), fullURL, userID)
+	shortURL, err := h.urlService.BuildURL(
+		ctx, h.getBaseURL(c), &JSONRequest{FullURL: fullURL}, userID,
+	)
 
 	switch err.(type) {
 	case *NotUniqueURLError:
 		return c.Status(fiber.StatusConflict).SendString(shortURL)
 	case nil:
+		h.m.AddCreatedLinks("text", 1)
 		return c.Status(fiber.StatusCreated).SendString(shortURL)
 	default:
-		return utils.SendJSONError(c, fiber.StatusInternalServerError, err.Error())
+		return err
 	}
 }
 
 func (h *URLHandler) createBatchOfShortURL(c *fiber.Ctx) error {
+	ctx, span := tracer.Start(c.UserContext(), "URLHandler.createBatchOfShortURL")
+	defer span.End()
+
 	var items BatchRequest
 
 	if err := c.BodyParser(&items); err != nil {
@@ -98,15 +153,25 @@ func (h *URLHandler) createBatchOfShortURL(c *fiber.Ctx) error {
 	}
 
 	userID := c.Locals(h.cfg.UserContextKey).(string)
-	result, err := h.urlService.BuildBatchOfURL(h.getBaseURL(c), items, userID)
-	if err != nil {
-		return utils.SendJSONError(c, fiber.StatusInternalServerError, err.Error())
-	}
+	result, err := h.urlService.BuildBatchOfURL(
+		ctx, h.getBaseURL(c), items, userID,
+	)
 
-	return c.Status(fiber.StatusCreated).JSON(result)
+	switch err.(type) {
+	case *InvalidAliasError, *InvalidExpirationError:
+		return utils.SendJSONError(c, fiber.StatusBadRequest, err.Error())
+	case nil:
+		h.m.AddCreatedLinks("batch", len(result))
+		return c.Status(fiber.StatusCreated).JSON(result)
+	default:
+		return err
+	}
 }
 
 func (h *URLHandler) changeLocation(c *fiber.Ctx) error {
+	ctx, span := tracer.Start(c.UserContext(), "URLHandler.changeLocation")
+	defer span.End()
+
 	shortID := c.Params("shortID")
 	if shortID == "" {
 		return utils.SendJSONError(
@@ -114,39 +179,170 @@ func (h *URLHandler) changeLocation(c *fiber.Ctx) error {
 		)
 	}
 
-	url, err := h.urlService.FetchURL(shortID)
+	url, err := h.urlService.FetchURL(ctx, shortID)
 	if err != nil {
-		if url == nil {
-			return utils.SendJSONError(c, fiber.StatusNotFound, "url not found")
+		if errors.Is(err, repository.ErrNotFound) {
+			h.m.IncRedirect("not_found")
 		}
-		return utils.SendJSONError(c, fiber.StatusInternalServerError, err.Error())
+		return err
 	}
 
 	if url.Removed {
+		h.m.IncRedirect("removed")
 		return utils.SendJSONError(c, fiber.StatusGone, "url was removed")
 	}
 
+	if url.IsExpired(time.Now()) {
+		h.m.IncRedirect("expired")
+		return utils.SendJSONError(c, fiber.StatusGone, "url was expired")
+	}
+
+	h.urlService.TrackClick(&Click{
+		ShortID:   url.ShortID,
+		Timestamp: time.Now().UTC(),
+		Referer:   c.Get(fiber.HeaderReferer),
+		UserAgent: c.Get(fiber.HeaderUserAgent),
+		IP:        c.IP(),
+		Language:  c.Get(fiber.HeaderAcceptLanguage),
+	})
+
+	h.m.IncRedirect("redirect")
 	c.Location(url.FullURL)
 	return c.Status(fiber.StatusTemporaryRedirect).SendString("")
 
 }
 
 func (h *URLHandler) getUserURLs(c *fiber.Ctx) error {
+	ctx, span := tracer.Start(c.UserContext(), "URLHandler.getUserURLs")
+	defer span.End()
+
+	req := &ListRequest{
+		UserID: c.Locals(h.cfg.UserContextKey).(string),
+		Search: c.Query("q"),
+		Domain: c.Query("domain"),
+		Sort:   c.Query("sort"),
+		Cursor: c.Query("cursor"),
+	}
+
+	var err error
+	if value := c.Query("deleted"); value != "" {
+		if req.Removed, err = strconv.ParseBool(value); err != nil {
+			return utils.SendJSONError(
+				c, fiber.StatusBadRequest, "Please specify a valid deleted flag",
+			)
+		}
+	}
+
+	if value := c.Query("limit"); value != "" {
+		if req.Limit, err = strconv.Atoi(value); err != nil {
+			return utils.SendJSONError(
+				c, fiber.StatusBadRequest, "Please specify a valid limit",
+			)
+		}
+	}
+
+	result, err := h.urlService.FetchUserURLs(ctx, h.getBaseURL(c), req)
+	switch err.(type) {
+	case nil:
+	case *InvalidListRequestError:
+		return utils.SendJSONError(c, fiber.StatusBadRequest, err.Error())
+	default:
+		return err
+	}
+
+	c.Set(headerTotalCount, strconv.Itoa(result.Total))
+	if result.NextCursor != "" {
+		c.Set(headerNextCursor, result.NextCursor)
+	}
+
+	if len(result.URLs) == 0 {
+		return utils.SendJSONError(c, fiber.StatusNoContent, "URLs not found")
+	}
+
+	return c.Status(fiber.StatusOK).JSON(result.URLs)
+}
+
+func (h *URLHandler) getURLStats(c *fiber.Ctx) error {
+	ctx, span := tracer.Start(c.UserContext(), "URLHandler.getURLStats")
+	defer span.End()
+
+	shortID := c.Params("shortID")
 	userID := c.Locals(h.cfg.UserContextKey).(string)
 
-	result, err := h.urlService.FetchUserURLs(h.getBaseURL(c), userID)
+	result, err := h.urlService.FetchURLStats(ctx, shortID, userID)
 	if err != nil {
-		return utils.SendJSONError(c, fiber.StatusInternalServerError, err.Error())
+		return err
 	}
 
-	if len(result) == 0 {
-		return utils.SendJSONError(c, fiber.StatusNoContent, "URLs not found")
+	return c.Status(fiber.StatusOK).JSON(result)
+}
+
+func (h *URLHandler) updateUserURL(c *fiber.Ctx) error {
+	ctx, span := tracer.Start(c.UserContext(), "URLHandler.updateUserURL")
+	defer span.End()
+
+	req := new(UpdateRequest)
+	if err := c.BodyParser(req); err != nil || req.FullURL == "" {
+		return utils.SendJSONError(
+			c, fiber.StatusBadRequest, "Please specify a valid full url",
+		)
+	}
+
+	userID := c.Locals(h.cfg.UserContextKey).(string)
+	shortURL, err := h.urlService.UpdateUserURL(
+		ctx, h.getBaseURL(c), c.Params("shortID"), userID, req.FullURL,
+	)
+	return h.sendUpdateResult(c, shortURL, err)
+}
+
+func (h *URLHandler) rollbackUserURL(c *fiber.Ctx) error {
+	ctx, span := tracer.Start(c.UserContext(), "URLHandler.rollbackUserURL")
+	defer span.End()
+
+	req := new(RollbackRequest)
+	if err := c.BodyParser(req); err != nil || req.Version <= 0 {
+		return utils.SendJSONError(
+			c, fiber.StatusBadRequest, "Please specify a valid rollback request",
+		)
+	}
+
+	userID := c.Locals(h.cfg.UserContextKey).(string)
+	shortURL, err := h.urlService.RollbackUserURL(
+		ctx, h.getBaseURL(c), c.Params("shortID"), userID, req.Version,
+	)
+	return h.sendUpdateResult(c, shortURL, err)
+}
+
+func (h *URLHandler) sendUpdateResult(c *fiber.Ctx, shortURL string, err error) error {
+	result := &fiber.Map{"result": shortURL}
+
+	switch err.(type) {
+	case *NotUniqueURLError:
+		return c.Status(fiber.StatusConflict).JSON(result)
+	case nil:
+		return c.Status(fiber.StatusOK).JSON(result)
+	default:
+		return err
+	}
+}
+
+func (h *URLHandler) getRevisions(c *fiber.Ctx) error {
+	ctx, span := tracer.Start(c.UserContext(), "URLHandler.getRevisions")
+	defer span.End()
+
+	userID := c.Locals(h.cfg.UserContextKey).(string)
+	result, err := h.urlService.FetchRevisions(ctx, c.Params("shortID"), userID)
+	if err != nil {
+		return err
 	}
 
 	return c.Status(fiber.StatusOK).JSON(result)
 }
 
 func (h *URLHandler) deleteUserURLs(c *fiber.Ctx) error {
+	ctx, span := tracer.Start(c.UserContext(), "URLHandler.deleteUserURLs")
+	defer span.End()
+
 	var shortIDs []string
 
 	if err := c.BodyParser(&shortIDs); err != nil {
@@ -162,9 +358,91 @@ func (h *URLHandler) deleteUserURLs(c *fiber.Ctx) error {
 	}
 
 	userID := c.Locals(h.cfg.UserContextKey).(string)
-	if err := h.urlService.DeleteUserURLs(userID, shortIDs); err != nil {
-		return utils.SendJSONError(c, fiber.StatusInternalServerError, err.Error())
+	jobID, err := h.urlService.DeleteUserURLs(ctx, userID, shortIDs)
+	if err != nil {
+		return err
+	}
+
+	return c.Status(fiber.StatusAccepted).JSON(&fiber.Map{"job_id": jobID})
+}
+
+func (h *URLHandler) restoreUserURLs(c *fiber.Ctx) error {
+	ctx, span := tracer.Start(c.UserContext(), "URLHandler.restoreUserURLs")
+	defer span.End()
+
+	var shortIDs []string
+
+	if err := c.BodyParser(&shortIDs); err != nil || len(shortIDs) == 0 {
+		return utils.SendJSONError(
+			c, fiber.StatusBadRequest, "Please specify a valid restore request",
+		)
+	}
+
+	userID := c.Locals(h.cfg.UserContextKey).(string)
+	restored, err := h.urlService.RestoreUserURLs(ctx, userID, shortIDs)
+	if err != nil {
+		return err
+	}
+
+	return c.Status(fiber.StatusOK).JSON(&fiber.Map{"result": restored})
+}
+
+func (h *URLHandler) getJob(c *fiber.Ctx) error {
+	ctx, span := tracer.Start(c.UserContext(), "URLHandler.getJob")
+	defer span.End()
+
+	userID := c.Locals(h.cfg.UserContextKey).(string)
+	result, err := h.urlService.FetchJob(ctx, c.Params("jobID"), userID)
+	if err != nil {
+		return err
+	}
+
+	return c.Status(fiber.StatusOK).JSON(result)
+}
+
+func (h *URLHandler) purgeURLs(c *fiber.Ctx) error {
+	ctx, span := tracer.Start(c.UserContext(), "URLHandler.purgeURLs")
+	defer span.End()
+
+	req := new(PurgeRequest)
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(req); err != nil {
+			return utils.SendJSONError(
+				c, fiber.StatusBadRequest, "Please specify a valid purge request",
+			)
+		}
+	}
+
+	total, err := h.urlService.PurgeURLs(ctx, req.UserID)
+	if err != nil {
+		return err
 	}
 
-	return c.Status(fiber.StatusAccepted).SendString("")
+	return c.Status(fiber.StatusOK).JSON(&fiber.Map{"result": total})
+}
+
+func (h *URLHandler) getStorageStats(c *fiber.Ctx) error {
+	_, span := tracer.Start(c.UserContext(), "URLHandler.getStorageStats")
+	defer span.End()
+
+	return c.Status(fiber.StatusOK).JSON(h.urlService.FetchStorageStats())
+}
+
+func (h *URLHandler) getDeadTasks(c *fiber.Ctx) error {
+	_, span := tracer.Start(c.UserContext(), "URLHandler.getDeadTasks")
+	defer span.End()
+
+	return c.Status(fiber.StatusOK).JSON(h.urlService.FetchDeadTasks())
+}
+
+func (h *URLHandler) compactStorage(c *fiber.Ctx) error {
+	ctx, span := tracer.Start(c.UserContext(), "URLHandler.compactStorage")
+	defer span.End()
+
+	result, err := h.urlService.CompactStorage(ctx)
+	if err != nil {
+		return err
+	}
+
+	return c.Status(fiber.StatusOK).JSON(result)
 }
@@ -0,0 +1,152 @@
+package url
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	JobQueued  = "queued"
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+
+	// JobInterrupted is a status of the task left because of the stop,
+	// the task is replayed on the next start when the queue is persistent
+	JobInterrupted = "interrupted"
+
+	KeyDeleted  = "deleted"
+	KeyNotOwner = "not_owner"
+	KeyNotFound = "not_found"
+)
+
+// Job is a status of the delete task, which is reported to the user
+type Job struct {
+	ID        string            `json:"id"`
+	UserID    string            `json:"-"`
+	Status    string            `json:"status"`
+	Outcomes  map[string]string `json:"outcomes,omitempty"`
+	Error     string            `json:"error,omitempty"`
+	CreatedAt time.Time         `json:"created_at"`
+	UpdatedAt time.Time         `json:"updated_at"`
+}
+
+func (j *Job) isFinished() bool {
+	return j.Status == JobDone || j.Status == JobFailed || j.Status == JobInterrupted
+}
+
+// job reports the dead task as a failed job
+func (d *DeadTask) job() *Job {
+	return &Job{
+		ID:        d.ID,
+		UserID:    d.UserID,
+		Status:    JobFailed,
+		Error:     d.Error,
+		CreatedAt: d.CreatedAt,
+		UpdatedAt: d.FailedAt,
+	}
+}
+
+// jobRegistry keeps statuses of delete tasks, finished jobs are
+// dropped after the retention window
+type jobRegistry struct {
+	mu        *sync.Mutex
+	jobs      map[string]*Job
+	finished  []*Job
+	retention time.Duration
+}
+
+func newJobRegistry(retention time.Duration) *jobRegistry {
+	return &jobRegistry{
+		mu:        &sync.Mutex{},
+		jobs:      make(map[string]*Job),
+		retention: retention,
+	}
+}
+
+func (r *jobRegistry) add(t *Task) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.expire(time.Now())
+	r.jobs[t.ID] = &Job{
+		ID:        t.ID,
+		UserID:    t.UserID,
+		Status:    JobQueued,
+		CreatedAt: t.CreatedAt,
+		UpdatedAt: t.CreatedAt,
+	}
+}
+
+func (r *jobRegistry) update(id string, update func(job *Job)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	job, ok := r.jobs[id]
+	if !ok || job.isFinished() {
+		return
+	}
+
+	update(job)
+	job.UpdatedAt = time.Now().UTC()
+	if job.isFinished() {
+		r.finished = append(r.finished, job)
+	}
+}
+
+func (r *jobRegistry) run(tasks []*Task) {
+	for _, t := range tasks {
+		r.update(t.ID, func(job *Job) {
+			job.Status = JobRunning
+		})
+	}
+}
+
+func (r *jobRegistry) done(id string, outcomes map[string]string) {
+	r.update(id, func(job *Job) {
+		job.Status = JobDone
+		job.Outcomes = outcomes
+	})
+}
+
+func (r *jobRegistry) fail(id string, err error) {
+	r.update(id, func(job *Job) {
+		job.Status = JobFailed
+		job.Error = err.Error()
+	})
+}
+
+// interrupt finishes jobs of tasks left because of cancellation,
+// jobs of processed and buried tasks are already finished
+func (r *jobRegistry) interrupt(tasks []*Task, err error) {
+	for _, t := range tasks {
+		r.update(t.ID, func(job *Job) {
+			job.Status = JobInterrupted
+			job.Error = err.Error()
+		})
+	}
+}
+
+// get returns a copy of the job, so callers can't change the registry
+func (r *jobRegistry) get(id string) (*Job, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.expire(time.Now())
+	job, ok := r.jobs[id]
+	if !ok {
+		return nil, false
+	}
+
+	result := *job
+	return &result, true
+}
+
+// expire drops jobs finished before the retention window,
+// caller must hold the lock
+func (r *jobRegistry) expire(now time.Time) {
+	for len(r.finished) > 0 && now.Sub(r.finished[0].UpdatedAt) > r.retention {
+		delete(r.jobs, r.finished[0].ID)
+		r.finished = r.finished[1:]
+	}
+}
@@ -0,0 +1,39 @@
+package url
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJobRegistryRetention(t *testing.T) {
+	r := newJobRegistry(time.Minute)
+	r.add(&Task{ID: "done", UserID: "user", CreatedAt: time.Now()})
+	r.add(&Task{ID: "failed", UserID: "user", CreatedAt: time.Now()})
+	r.add(&Task{ID: "queued", UserID: "user", CreatedAt: time.Now()})
+
+	r.run([]*Task{{ID: "done"}, {ID: "failed"}})
+	job, ok := r.get("done")
+	assert.True(t, ok)
+	assert.Equal(t, JobRunning, job.Status)
+
+	r.done("done", map[string]string{"a": KeyDeleted})
+	r.fail("failed", errors.New("connection refused"))
+
+	// finished jobs can't be changed
+	r.fail("done", errors.New("connection refused"))
+	job, _ = r.get("done")
+	assert.Equal(t, JobDone, job.Status)
+
+	r.expire(time.Now().Add(2 * time.Minute))
+
+	_, ok = r.get("done")
+	assert.False(t, ok)
+	_, ok = r.get("failed")
+	assert.False(t, ok)
+	job, ok = r.get("queued")
+	assert.True(t, ok)
+	assert.Equal(t, JobQueued, job.Status)
+}
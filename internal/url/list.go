@@ -0,0 +1,97 @@
+package url
+
+import (
+	"encoding/base64"
+	"encoding/json"
+
+	"github.com/bigbag/go-musthave-shortener/internal/storage/repository"
+)
+
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+// ListRequest describes a page of urls of the user, the cursor is
+// an opaque token returned with the previous page
+type ListRequest struct {
+	UserID  string
+	Removed bool
+	Search  string
+	Domain  string
+	Sort    string
+	Cursor  string
+	Limit   int
+}
+
+type URLPage struct {
+	URLs       []*URL
+	Total      int
+	NextCursor string
+}
+
+type UserURLPage struct {
+	URLs       []*UserURL
+	Total      int
+	NextCursor string
+}
+
+func (r *ListRequest) query() (*repository.ListQuery, error) {
+	q := &repository.ListQuery{
+		UserID:  r.UserID,
+		Removed: r.Removed,
+		Search:  r.Search,
+		Domain:  r.Domain,
+		Sort:    r.Sort,
+		Limit:   r.Limit,
+	}
+
+	switch q.Sort {
+	case "":
+		q.Sort = repository.SortCreatedAsc
+	case repository.SortCreatedAsc, repository.SortCreatedDesc:
+	default:
+		return nil, &InvalidListRequestError{Reason: "unknown sort " + q.Sort}
+	}
+
+	switch {
+	case q.Limit == 0:
+		q.Limit = defaultListLimit
+	case q.Limit < 0 || q.Limit > maxListLimit:
+		return nil, &InvalidListRequestError{Reason: "limit must be between 1 and 1000"}
+	}
+
+	if r.Cursor != "" {
+		cursor, err := decodeCursor(r.Cursor)
+		if err != nil {
+			return nil, &InvalidListRequestError{Reason: "malformed cursor"}
+		}
+		q.Cursor = cursor
+	}
+	return q, nil
+}
+
+func encodeCursor(cursor *repository.Cursor) string {
+	if cursor == nil {
+		return ""
+	}
+
+	data, err := json.Marshal(cursor)
+	if err != nil {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(value string) (*repository.Cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+
+	cursor := &repository.Cursor{}
+	if err = json.Unmarshal(data, cursor); err != nil {
+		return nil, err
+	}
+	return cursor, nil
+}
@@ -0,0 +1,83 @@
+package url
+
+import (
+	"context"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Reaper periodically marks expired urls as removed and purges
+// urls which were removed earlier than the retention period
+type Reaper struct {
+	l         logrus.FieldLogger
+	r         URLRepository
+	interval  time.Duration
+	retention time.Duration
+	cancel    context.CancelFunc
+	done      chan struct{}
+}
+
+func NewReaper(
+	ctx context.Context,
+	l logrus.FieldLogger,
+	r URLRepository,
+	interval time.Duration,
+	retention time.Duration,
+) *Reaper {
+	ctx, cancel := context.WithCancel(ctx)
+	reaper := &Reaper{
+		l:         l,
+		r:         r,
+		interval:  interval,
+		retention: retention,
+		cancel:    cancel,
+		done:      make(chan struct{}),
+	}
+
+	go reaper.loop(ctx)
+	return reaper
+}
+
+func (r *Reaper) loop(ctx context.Context) {
+	defer close(r.done)
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.reap(ctx)
+		}
+	}
+}
+
+func (r *Reaper) reap(ctx context.Context) {
+	total, err := r.r.DeleteExpiredURLs(ctx)
+	if err != nil {
+		r.l.Info("reaper: failed to delete expired urls ", err)
+		return
+	}
+
+	if total > 0 {
+		r.l.Info("reaper: deleted expired urls ", total)
+	}
+
+	total, err = r.r.PurgeURLs(ctx, "", time.Now().Add(-r.retention))
+	if err != nil {
+		r.l.Info("reaper: failed to purge removed urls ", err)
+		return
+	}
+
+	if total > 0 {
+		r.l.Info("reaper: purged removed urls ", total)
+	}
+}
+
+func (r *Reaper) Close() {
+	r.cancel()
+	<-r.done
+}
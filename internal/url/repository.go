@@ -1,121 +1,549 @@
 package url
 
 import (
-	"github.com/google/uuid"
-	"strings"
+	"context"
+	"errors"
+	"time"
 
 	"github.com/bigbag/go-musthave-shortener/internal/storage"
 	"github.com/bigbag/go-musthave-shortener/internal/storage/repository"
 )
 
+const (
+	maxShortIDAttempts = 10
+	topReferrersLimit  = 10
+)
+
 type urlRepository struct {
 	s storage.StorageService
+	g ShortIDGenerator
 }
 
-func NewURLRepository(s storage.StorageService) URLRepository {
-	return &urlRepository{s: s}
+func NewURLRepository(s storage.StorageService, g ShortIDGenerator) URLRepository {
+	return &urlRepository{s: s, g: g}
 }
 
-func (r *urlRepository) makeShortID() string {
-	return strings.Replace(uuid.New().String(), "-", "", -1)
+// errShortIDExhausted is returned when all candidates of short id are taken
+var errShortIDExhausted = errors.New("failed to generate unique short id")
+
+// makeShortIDs returns short ids of the urls which are neither stored
+// nor taken by other records of the batch. Candidates of every round
+// are checked by a single query, urls with stored candidates
+// get next ones in the following round
+func (r *urlRepository) makeShortIDs(
+	ctx context.Context,
+	fullURLs []string,
+	taken map[string]struct{},
+) ([]string, error) {
+	shortIDs := make([]string, len(fullURLs))
+	attempts := make([]int, len(fullURLs))
+	pending := make([]int, 0, len(fullURLs))
+	for i := range fullURLs {
+		pending = append(pending, i)
+	}
+
+	for len(pending) > 0 {
+		candidates := make(map[string]int, len(pending))
+		keys := make([]string, 0, len(pending))
+		for _, i := range pending {
+			shortID, err := r.makeCandidate(ctx, fullURLs[i], &attempts[i], taken, candidates)
+			if err != nil {
+				return nil, err
+			}
+			candidates[shortID] = i
+			keys = append(keys, shortID)
+		}
+
+		records, err := r.s.GetByKeys(ctx, keys)
+		if err != nil {
+			return nil, err
+		}
+		stored := make(map[string]struct{}, len(records))
+		for _, record := range records {
+			stored[record.Key] = struct{}{}
+		}
+
+		pending = pending[:0]
+		for _, shortID := range keys {
+			i := candidates[shortID]
+			if _, ok := stored[shortID]; ok {
+				pending = append(pending, i)
+				continue
+			}
+			shortIDs[i] = shortID
+			taken[shortID] = struct{}{}
+		}
+	}
+	return shortIDs, nil
 }
 
-func (r *urlRepository) GetURL(shortID string) (*URL, error) {
-	record, err := r.s.GetByKey(shortID)
+// makeCandidate returns next candidate of short id for the url
+// which isn't reserved, taken or proposed for other url of the round
+func (r *urlRepository) makeCandidate(
+	ctx context.Context,
+	fullURL string,
+	attempt *int,
+	taken map[string]struct{},
+	candidates map[string]int,
+) (string, error) {
+	for ; *attempt < maxShortIDAttempts; *attempt++ {
+		shortID, err := r.g.Generate(ctx, fullURL, *attempt)
+		if err != nil {
+			return "", err
+		}
+
+		if _, ok := taken[shortID]; ok || isReserved(shortID) {
+			continue
+		}
+		if _, ok := candidates[shortID]; ok {
+			continue
+		}
+		*attempt++
+		return shortID, nil
+	}
+	return "", errShortIDExhausted
+}
+
+func (r *urlRepository) GetURL(ctx context.Context, shortID string) (*URL, error) {
+	record, err := r.s.GetByKey(ctx, shortID)
+	if errors.Is(err, repository.ErrNotFound) {
+		return nil, &NotFoundURLError{}
+	}
 	if err != nil {
 		return nil, err
 	}
 	return &URL{
-		ShortID: record.Key,
-		FullURL: record.Value,
-		Removed: record.Removed,
+		ShortID:   record.Key,
+		FullURL:   record.Value,
+		UserID:    record.UserID,
+		Removed:   record.Removed,
+		ExpiresAt: record.ExpiresAt,
+		DeletedAt: record.DeletedAt,
+		CreatedAt: record.CreatedAt,
+		UpdatedAt: record.UpdatedAt,
 	}, nil
 }
 
-func (r *urlRepository) CreateURL(fullURL string, userID string) (string, error) {
-	record, err := r.s.Save(
-		&repository.Record{
-			Key:     r.makeShortID(),
-			Value:   fullURL,
-			UserID:  userID,
-			Removed: false,
-		},
-	)
-
-	switch err.(type) {
-	case *storage.NotUniqueError:
-		return record.Key, &NotUniqueURLError{}
-	case nil:
-		return record.Key, nil
-	default:
+// GetURLs returns found urls, unknown short ids are skipped
+func (r *urlRepository) GetURLs(ctx context.Context, shortIDs []string) ([]*URL, error) {
+	records, err := r.s.GetByKeys(ctx, shortIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*URL, 0, len(records))
+	for _, record := range records {
+		result = append(result, &URL{
+			ShortID:   record.Key,
+			FullURL:   record.Value,
+			UserID:    record.UserID,
+			Removed:   record.Removed,
+			ExpiresAt: record.ExpiresAt,
+		})
+	}
+	return result, nil
+}
+
+func (r *urlRepository) makeKey(
+	ctx context.Context,
+	alias string,
+	fullURL string,
+) (string, error) {
+	if alias != "" {
+		return alias, validateAlias(alias)
+	}
+
+	shortIDs, err := r.makeShortIDs(ctx, []string{fullURL}, make(map[string]struct{}))
+	if err != nil {
 		return "", err
 	}
+	return shortIDs[0], nil
+}
+
+func (r *urlRepository) CreateURL(
+	ctx context.Context,
+	req *JSONRequest,
+	userID string,
+) (string, error) {
+	expiresAt, err := req.deadline(time.Now())
+	if err != nil {
+		return "", err
+	}
+
+	// generated short id can be taken by concurrent request after the check,
+	// then the record is saved with another one
+	for attempt := 0; attempt < maxShortIDAttempts; attempt++ {
+		key, err := r.makeKey(ctx, req.Alias, req.FullURL)
+		if err != nil {
+			return "", err
+		}
+
+		record, err := r.s.Save(
+			ctx,
+			&repository.Record{
+				Key:       key,
+				Value:     req.FullURL,
+				UserID:    userID,
+				Removed:   false,
+				ExpiresAt: expiresAt,
+				CreatedAt: time.Now().UTC(),
+			},
+		)
 
+		switch err.(type) {
+		case *storage.NotUniqueError:
+			return record.Key, &NotUniqueURLError{}
+		case *repository.NotUniqueKeyError:
+			if req.Alias != "" {
+				return "", &NotUniqueAliasError{}
+			}
+		case nil:
+			return record.Key, nil
+		default:
+			return "", err
+		}
+	}
+	return "", errShortIDExhausted
 }
 
-func (r *urlRepository) CreateBatchOfURL(
+// makeBatchRecords makes records of the batch with short ids unique inside
+// of the batch and reports whether any alias was supplied
+func (r *urlRepository) makeBatchRecords(
+	ctx context.Context,
 	items BatchRequest,
 	userID string,
-) ([]*URL, error) {
-	var (
-		record *repository.Record
-		url    *URL
-	)
-
-	recordsForSave := make([]*repository.Record, 0, 100)
-	for _, item := range items {
-		record = &repository.Record{
-			Key:           r.makeShortID(),
+	now time.Time,
+) ([]*repository.Record, bool, error) {
+	hasAlias := false
+	taken := make(map[string]struct{}, len(items))
+	records := make([]*repository.Record, 0, len(items))
+	generated := make([]int, 0, len(items))
+	fullURLs := make([]string, 0, len(items))
+	for i, item := range items {
+		expiresAt, err := item.deadline(now)
+		if err != nil {
+			return nil, false, err
+		}
+
+		if item.Alias != "" {
+			if err := validateAlias(item.Alias); err != nil {
+				return nil, false, err
+			}
+			if _, ok := taken[item.Alias]; ok {
+				return nil, false, &NotUniqueAliasError{}
+			}
+			taken[item.Alias] = struct{}{}
+			hasAlias = true
+		} else {
+			generated = append(generated, i)
+			fullURLs = append(fullURLs, item.FullURL)
+		}
+
+		records = append(records, &repository.Record{
+			Key:           item.Alias,
 			Value:         item.FullURL,
 			UserID:        userID,
 			Removed:       false,
 			CorrelationID: item.CorrelationID,
+			ExpiresAt:     expiresAt,
+			CreatedAt:     now.UTC(),
+		})
+	}
+
+	shortIDs, err := r.makeShortIDs(ctx, fullURLs, taken)
+	if err != nil {
+		return nil, false, err
+	}
+	for j, i := range generated {
+		records[i].Key = shortIDs[j]
+	}
+	return records, hasAlias, nil
+}
+
+func (r *urlRepository) CreateBatchOfURL(
+	ctx context.Context,
+	items BatchRequest,
+	userID string,
+) ([]*URL, error) {
+	now := time.Now()
+	for attempt := 0; attempt < maxShortIDAttempts; attempt++ {
+		recordsForSave, hasAlias, err := r.makeBatchRecords(ctx, items, userID, now)
+		if err != nil {
+			return nil, err
+		}
+
+		records, err := r.s.SaveBatchOfRecord(ctx, recordsForSave)
+		switch err.(type) {
+		case *repository.NotUniqueKeyError:
+			// generated short ids are checked before saving,
+			// so stored alias is the likely reason of conflict
+			if hasAlias {
+				return nil, &NotUniqueAliasError{}
+			}
+			continue
+		case nil:
+		default:
+			return nil, err
 		}
-		recordsForSave = append(recordsForSave, record)
 
+		result := make([]*URL, 0, len(records))
+		for i, record := range records {
+			result = append(result, &URL{
+				ShortID:       record.Key,
+				FullURL:       record.Value,
+				CorrelationID: items[i].CorrelationID,
+				Removed:       record.Removed,
+			})
+		}
+		return result, nil
 	}
+	return nil, errShortIDExhausted
+}
 
-	records, err := r.s.SaveBatchOfRecord(recordsForSave)
+// FindAllByUserID returns a page of active urls of the user or removed ones,
+// which are kept in the trash until purge
+func (r *urlRepository) FindAllByUserID(ctx context.Context, req *ListRequest) (*URLPage, error) {
+	q, err := req.query()
 	if err != nil {
 		return nil, err
 	}
 
-	result := make([]*URL, 0, 100)
-	for _, record := range records {
-		url = &URL{
-			ShortID:       record.Key,
-			FullURL:       record.Value,
-			CorrelationID: record.CorrelationID,
-			Removed:       record.Removed,
-		}
-		result = append(result, url)
+	page, err := r.s.ListByUserID(ctx, q)
+	if err != nil {
+		return nil, err
 	}
 
+	result := &URLPage{
+		URLs:       make([]*URL, 0, len(page.Records)),
+		Total:      page.Total,
+		NextCursor: encodeCursor(page.Next),
+	}
+	for _, record := range page.Records {
+		result.URLs = append(result.URLs, &URL{
+			ShortID:   record.Key,
+			FullURL:   record.Value,
+			UserID:    record.UserID,
+			Removed:   record.Removed,
+			ExpiresAt: record.ExpiresAt,
+			DeletedAt: record.DeletedAt,
+			CreatedAt: record.CreatedAt,
+			UpdatedAt: record.UpdatedAt,
+		})
+	}
 	return result, nil
 }
 
-func (r *urlRepository) FindAllByUserID(userID string) ([]*URL, error) {
-	records, err := r.s.GetAllByUserID(userID)
+// UpdateURL changes the target of the url of the user, the url which
+// already has the new target is returned together with NotUniqueURLError
+func (r *urlRepository) UpdateURL(
+	ctx context.Context,
+	shortID string,
+	userID string,
+	fullURL string,
+) (*URL, error) {
+	record, err := r.s.UpdateValue(ctx, userID, shortID, fullURL)
+
+	var notUniqueErr *storage.NotUniqueError
+	switch {
+	case err == nil:
+	case errors.As(err, &notUniqueErr):
+		return &URL{ShortID: record.Key, FullURL: record.Value, UserID: record.UserID}, &NotUniqueURLError{}
+	case errors.Is(err, repository.ErrNotFound):
+		return nil, &NotFoundURLError{}
+	case errors.Is(err, repository.ErrForbidden):
+		return nil, &NotOwnerError{}
+	default:
+		return nil, err
+	}
+
+	return &URL{
+		ShortID:   record.Key,
+		FullURL:   record.Value,
+		UserID:    record.UserID,
+		ExpiresAt: record.ExpiresAt,
+		CreatedAt: record.CreatedAt,
+		UpdatedAt: record.UpdatedAt,
+	}, nil
+}
+
+func (r *urlRepository) GetRevisions(ctx context.Context, shortID string) ([]*Revision, error) {
+	revisions, err := r.s.GetRevisions(ctx, shortID)
 	if err != nil {
 		return nil, err
 	}
 
-	var url *URL
+	result := make([]*Revision, 0, len(revisions))
+	for _, revision := range revisions {
+		result = append(result, &Revision{
+			Version:   revision.Version,
+			FullURL:   revision.Value,
+			CreatedAt: optionalTime(revision.CreatedAt),
+		})
+	}
+	return result, nil
+}
 
-	result := make([]*URL, 0, 100)
-	for _, record := range records {
-		url = &URL{ShortID: record.Key, FullURL: record.Value}
-		result = append(result, url)
+func (r *urlRepository) DeleteUserURLs(
+	ctx context.Context,
+	userID string,
+	shortIDs []string,
+) error {
+	return r.s.DeleteByUserID(ctx, userID, shortIDs)
+}
+
+func (r *urlRepository) RestoreUserURLs(
+	ctx context.Context,
+	userID string,
+	shortIDs []string,
+) ([]string, error) {
+	return r.s.Restore(ctx, userID, shortIDs)
+}
+
+func (r *urlRepository) DeleteExpiredURLs(ctx context.Context) (int, error) {
+	return r.s.DeleteExpired(ctx, time.Now())
+}
+
+func (r *urlRepository) PurgeURLs(
+	ctx context.Context,
+	userID string,
+	before time.Time,
+) (int, error) {
+	return r.s.Purge(ctx, userID, before)
+}
+
+func (r *urlRepository) SaveClicks(ctx context.Context, clicks []*Click) error {
+	records := make([]*repository.Click, 0, len(clicks))
+	for _, click := range clicks {
+		records = append(records, &repository.Click{
+			Key:       click.ShortID,
+			Timestamp: click.Timestamp,
+			Referer:   click.Referer,
+			UserAgent: click.UserAgent,
+			IP:        click.IP,
+			Language:  click.Language,
+		})
+	}
+	return r.s.SaveClicks(ctx, records)
+}
+
+func (r *urlRepository) SaveDeleteTask(ctx context.Context, task *Task) error {
+	return r.s.SaveDeleteTask(ctx, &repository.DeleteTask{
+		ID:        task.ID,
+		UserID:    task.UserID,
+		Keys:      task.ShortIDs,
+		CreatedAt: task.CreatedAt,
+	})
+}
+
+func (r *urlRepository) AckDeleteTask(ctx context.Context, id string) error {
+	return r.s.AckDeleteTask(ctx, id)
+}
+
+func (r *urlRepository) BuryDeleteTask(ctx context.Context, task *DeadTask) error {
+	failedAt := task.FailedAt
+	return r.s.BuryDeleteTask(ctx, &repository.DeleteTask{
+		ID:       task.ID,
+		Attempts: task.Attempts,
+		Error:    task.Error,
+		FailedAt: &failedAt,
+	})
+}
+
+// GetDeleteTasks returns pending tasks, dead tasks are skipped
+func (r *urlRepository) GetDeleteTasks(ctx context.Context) ([]*Task, error) {
+	tasks, err := r.s.GetDeleteTasks(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*Task, 0, len(tasks))
+	for _, task := range tasks {
+		if task.IsDead() {
+			continue
+		}
+		result = append(result, &Task{
+			ID:        task.ID,
+			UserID:    task.UserID,
+			ShortIDs:  task.Keys,
+			CreatedAt: task.CreatedAt,
+		})
 	}
 	return result, nil
 }
 
-func (r *urlRepository) DeleteUserURLs(userID string, shortIDs []string) error {
-	return r.s.DeleteByUserID(userID, shortIDs)
+// GetDeadTasks returns tasks which failed after all retries
+func (r *urlRepository) GetDeadTasks(ctx context.Context) ([]*DeadTask, error) {
+	tasks, err := r.s.GetDeleteTasks(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*DeadTask, 0)
+	for _, task := range tasks {
+		if !task.IsDead() {
+			continue
+		}
+		result = append(result, &DeadTask{
+			ID:        task.ID,
+			UserID:    task.UserID,
+			ShortIDs:  task.Keys,
+			Attempts:  task.Attempts,
+			Error:     task.Error,
+			CreatedAt: task.CreatedAt,
+			FailedAt:  *task.FailedAt,
+		})
+	}
+	return result, nil
+}
+
+func (r *urlRepository) GetStats(ctx context.Context, shortID string) (*URLStats, error) {
+	stats, err := r.s.GetClickStats(ctx, shortID, topReferrersLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &URLStats{
+		ShortID:      shortID,
+		Total:        stats.Total,
+		Daily:        make([]*DailyStats, 0, len(stats.Daily)),
+		TopReferrers: make([]*ReferrerStats, 0, len(stats.TopReferrers)),
+	}
+	for _, daily := range stats.Daily {
+		result.Daily = append(
+			result.Daily, &DailyStats{Date: daily.Date, Clicks: daily.Count},
+		)
+	}
+	for _, referrer := range stats.TopReferrers {
+		result.TopReferrers = append(
+			result.TopReferrers,
+			&ReferrerStats{Referer: referrer.Referer, Clicks: referrer.Count},
+		)
+	}
+	return result, nil
+}
+
+func (r *urlRepository) CompactStorage(ctx context.Context) error {
+	return r.s.Compact(ctx)
+}
+
+func (r *urlRepository) GetStorageStats() *StorageStats {
+	stats := r.s.Stats()
+	return &StorageStats{
+		Backend:          stats.Backend,
+		Records:          stats.Records,
+		LogEntries:       stats.LogEntries,
+		LogSize:          stats.LogSize,
+		ReplayDurationMs: stats.ReplayDuration.Milliseconds(),
+		Compactions:      stats.Compactions,
+		CompactErrors:    stats.CompactErrors,
+		CacheEntries:     stats.CacheEntries,
+		CacheHits:        stats.CacheHits,
+		CacheMisses:      stats.CacheMisses,
+	}
 }
 
-func (r *urlRepository) Status() error {
-	return r.s.Status()
+func (r *urlRepository) Status(ctx context.Context) error {
+	return r.s.Status(ctx)
 }
 
 func (r *urlRepository) Close() error {
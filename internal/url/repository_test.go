@@ -0,0 +1,61 @@
+package url
+
+import (
+	"context"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/bigbag/go-musthave-shortener/internal/config"
+	"github.com/bigbag/go-musthave-shortener/internal/storage"
+	"github.com/bigbag/go-musthave-shortener/internal/storage/repository"
+)
+
+func TestCreateBatchOfURLWithRepeatedURL(t *testing.T) {
+	ctx := context.Background()
+
+	for _, dedupScope := range []string{repository.DedupNone, repository.DedupUser} {
+		s, err := storage.NewStorageService(ctx, logrus.New(), &config.Storage{DedupScope: dedupScope}, nil)
+		assert.Nil(t, err)
+
+		g, err := NewShortIDGenerator(&config.ShortID{Generator: "hash", Alphabet: "base62", Length: 8}, s)
+		assert.Nil(t, err)
+		r := NewURLRepository(s, g)
+
+		shortID, err := r.CreateURL(ctx, &JSONRequest{FullURL: "https://github.com/"}, "other")
+		assert.Nil(t, err)
+
+		urls, err := r.CreateBatchOfURL(ctx, BatchRequest{
+			{FullURL: "https://github.com/", CorrelationID: "1"},
+			{FullURL: "https://github.com/", CorrelationID: "2"},
+		}, "user")
+		assert.Nilf(t, err, dedupScope)
+		assert.Len(t, urls, 2)
+		assert.NotEqual(t, shortID, urls[0].ShortID)
+		assert.NotEqual(t, shortID, urls[1].ShortID)
+	}
+}
+
+func TestCreateURLWithTakenAlias(t *testing.T) {
+	ctx := context.Background()
+
+	s, err := storage.NewStorageService(ctx, logrus.New(), &config.Storage{DedupScope: repository.DedupNone}, nil)
+	assert.Nil(t, err)
+
+	g, err := NewShortIDGenerator(&config.ShortID{Generator: "random", Alphabet: "base62", Length: 8}, s)
+	assert.Nil(t, err)
+	r := NewURLRepository(s, g)
+
+	_, err = r.CreateURL(ctx, &JSONRequest{FullURL: "https://github.com/", Alias: "github"}, "user")
+	assert.Nil(t, err)
+
+	_, err = r.CreateURL(ctx, &JSONRequest{FullURL: "https://github.com/1", Alias: "github"}, "user")
+	assert.IsType(t, &NotUniqueAliasError{}, err)
+
+	_, err = r.CreateBatchOfURL(ctx, BatchRequest{
+		{FullURL: "https://github.com/2", Alias: "docs"},
+		{FullURL: "https://github.com/3", Alias: "docs"},
+	}, "user")
+	assert.IsType(t, &NotUniqueAliasError{}, err)
+}
@@ -1,39 +1,64 @@
 package url
 
 import (
+	"context"
 	"fmt"
 	"time"
 
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+
+	"github.com/bigbag/go-musthave-shortener/internal/tracing"
 )
 
+var tracer = otel.Tracer("github.com/bigbag/go-musthave-shortener/internal/url")
+
 type urlService struct {
 	l             logrus.FieldLogger
 	r             URLRepository
 	p             *TaskPool
+	c             *ClickCollector
 	deleteTimeout time.Duration
 }
 
-func NewURLService(l logrus.FieldLogger, r URLRepository, p *TaskPool) URLService {
-	return &urlService{l: l, r: r, p: p}
+func NewURLService(
+	l logrus.FieldLogger,
+	r URLRepository,
+	p *TaskPool,
+	c *ClickCollector,
+) URLService {
+	return &urlService{l: l, r: r, p: p, c: c}
 }
 
 func (s *urlService) BuildURL(
+	ctx context.Context,
 	baseURL string,
-	fullURL string,
+	req *JSONRequest,
 	userID string,
 ) (string, error) {
-	shortID, err := s.r.CreateURL(fullURL, userID)
+	ctx, span := tracer.Start(ctx, "urlService.BuildURL")
+	defer span.End()
+
+	shortID, err := s.r.CreateURL(ctx, req, userID)
+	tracing.RecordError(span, err)
+	if shortID == "" {
+		return "", err
+	}
 	return fmt.Sprintf("%s/%s", baseURL, shortID), err
 }
 
 func (s *urlService) BuildBatchOfURL(
+	ctx context.Context,
 	baseURL string,
 	items BatchRequest,
 	userID string,
 ) (BatchResponse, error) {
-	urls, err := s.r.CreateBatchOfURL(items, userID)
+	ctx, span := tracer.Start(ctx, "urlService.BuildBatchOfURL")
+	defer span.End()
+
+	urls, err := s.r.CreateBatchOfURL(ctx, items, userID)
 	if err != nil {
+		tracing.RecordError(span, err)
 		return nil, err
 	}
 
@@ -54,35 +79,238 @@ func (s *urlService) BuildBatchOfURL(
 	return result, nil
 }
 
-func (s *urlService) FetchURL(shortID string) (*URL, error) {
-	return s.r.GetURL(shortID)
+func (s *urlService) FetchURL(ctx context.Context, shortID string) (*URL, error) {
+	ctx, span := tracer.Start(ctx, "urlService.FetchURL")
+	defer span.End()
+
+	url, err := s.r.GetURL(ctx, shortID)
+	tracing.RecordError(span, err)
+	return url, err
 }
 
 func (s *urlService) FetchUserURLs(
+	ctx context.Context,
 	baseURL string,
-	userID string,
-) ([]*UserURL, error) {
-	urls, err := s.r.FindAllByUserID(userID)
+	req *ListRequest,
+) (*UserURLPage, error) {
+	ctx, span := tracer.Start(ctx, "urlService.FetchUserURLs")
+	defer span.End()
+
+	page, err := s.r.FindAllByUserID(ctx, req)
 	if err != nil {
+		tracing.RecordError(span, err)
 		return nil, err
 	}
 
 	var shortURL string
 
-	result := make([]*UserURL, 0, 100)
-	for _, url := range urls {
+	result := &UserURLPage{
+		URLs:       make([]*UserURL, 0, len(page.URLs)),
+		Total:      page.Total,
+		NextCursor: page.NextCursor,
+	}
+	for _, url := range page.URLs {
 		shortURL = fmt.Sprintf("%s/%s", baseURL, url.ShortID)
-		result = append(result, &UserURL{ShortURL: shortURL, FullURL: url.FullURL})
+		result.URLs = append(result.URLs, &UserURL{
+			ShortURL:  shortURL,
+			FullURL:   url.FullURL,
+			CreatedAt: optionalTime(url.CreatedAt),
+			UpdatedAt: optionalTime(url.UpdatedAt),
+			DeletedAt: url.DeletedAt,
+		})
 	}
 	return result, nil
 }
 
-func (s *urlService) DeleteUserURLs(userID string, shortIDs []string) error {
-	return s.p.Push(userID, shortIDs)
+// UpdateUserURL changes the target of the url of the user and returns
+// the short url, the short url of the duplicate is returned together
+// with NotUniqueURLError
+func (s *urlService) UpdateUserURL(
+	ctx context.Context,
+	baseURL string,
+	shortID string,
+	userID string,
+	fullURL string,
+) (string, error) {
+	ctx, span := tracer.Start(ctx, "urlService.UpdateUserURL")
+	defer span.End()
+
+	url, err := s.r.UpdateURL(ctx, shortID, userID, fullURL)
+	tracing.RecordError(span, err)
+	if url == nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s/%s", baseURL, url.ShortID), err
 }
 
-func (s *urlService) Status() error {
-	return s.r.Status()
+// FetchRevisions returns the history of targets of the url of the user,
+// urls which were never changed have the only revision
+func (s *urlService) FetchRevisions(
+	ctx context.Context,
+	shortID string,
+	userID string,
+) ([]*Revision, error) {
+	ctx, span := tracer.Start(ctx, "urlService.FetchRevisions")
+	defer span.End()
+
+	url, err := s.r.GetURL(ctx, shortID)
+	if err != nil {
+		tracing.RecordError(span, err)
+		return nil, err
+	}
+
+	if url.UserID != userID {
+		return nil, &NotOwnerError{}
+	}
+
+	revisions, err := s.r.GetRevisions(ctx, shortID)
+	if err != nil {
+		tracing.RecordError(span, err)
+		return nil, err
+	}
+
+	if len(revisions) == 0 {
+		revisions = append(revisions, &Revision{
+			Version:   1,
+			FullURL:   url.FullURL,
+			CreatedAt: optionalTime(url.CreatedAt),
+		})
+	}
+	return revisions, nil
+}
+
+// RollbackUserURL changes the target of the url of the user back to the
+// target of the revision, the rollback is kept as a new revision
+func (s *urlService) RollbackUserURL(
+	ctx context.Context,
+	baseURL string,
+	shortID string,
+	userID string,
+	version int,
+) (string, error) {
+	ctx, span := tracer.Start(ctx, "urlService.RollbackUserURL")
+	defer span.End()
+
+	revisions, err := s.FetchRevisions(ctx, shortID, userID)
+	if err != nil {
+		return "", err
+	}
+
+	for _, revision := range revisions {
+		if revision.Version == version {
+			return s.UpdateUserURL(ctx, baseURL, shortID, userID, revision.FullURL)
+		}
+	}
+	return "", &NotFoundRevisionError{}
+}
+
+// DeleteUserURLs queues deletion and returns id of the job
+func (s *urlService) DeleteUserURLs(
+	ctx context.Context,
+	userID string,
+	shortIDs []string,
+) (string, error) {
+	ctx, span := tracer.Start(ctx, "urlService.DeleteUserURLs")
+	defer span.End()
+
+	jobID, err := s.p.Push(ctx, userID, shortIDs)
+	tracing.RecordError(span, err)
+	return jobID, err
+}
+
+// FetchJob returns the status of the deletion, jobs of other users
+// are reported as unknown
+func (s *urlService) FetchJob(ctx context.Context, jobID string, userID string) (*Job, error) {
+	_, span := tracer.Start(ctx, "urlService.FetchJob")
+	defer span.End()
+
+	job, ok := s.p.Job(jobID)
+	if !ok || job.UserID != userID {
+		return nil, &NotFoundJobError{}
+	}
+	return job, nil
+}
+
+// RestoreUserURLs brings back urls of the user removed within
+// the grace period and returns ids of the restored ones
+func (s *urlService) RestoreUserURLs(
+	ctx context.Context,
+	userID string,
+	shortIDs []string,
+) ([]string, error) {
+	ctx, span := tracer.Start(ctx, "urlService.RestoreUserURLs")
+	defer span.End()
+
+	restored, err := s.r.RestoreUserURLs(ctx, userID, shortIDs)
+	tracing.RecordError(span, err)
+	return restored, err
+}
+
+// PurgeURLs removes soft deleted urls of the user (or all users when user id
+// is empty) without waiting for the retention period
+func (s *urlService) PurgeURLs(ctx context.Context, userID string) (int, error) {
+	ctx, span := tracer.Start(ctx, "urlService.PurgeURLs")
+	defer span.End()
+
+	total, err := s.r.PurgeURLs(ctx, userID, time.Now())
+	tracing.RecordError(span, err)
+	return total, err
+}
+
+func (s *urlService) TrackClick(click *Click) {
+	s.c.Push(click)
+}
+
+func (s *urlService) FetchURLStats(
+	ctx context.Context,
+	shortID string,
+	userID string,
+) (*URLStats, error) {
+	ctx, span := tracer.Start(ctx, "urlService.FetchURLStats")
+	defer span.End()
+
+	url, err := s.r.GetURL(ctx, shortID)
+	if err != nil {
+		tracing.RecordError(span, err)
+		return nil, err
+	}
+
+	if url.UserID != userID {
+		return nil, &NotOwnerError{}
+	}
+
+	stats, err := s.r.GetStats(ctx, shortID)
+	tracing.RecordError(span, err)
+	return stats, err
+}
+
+func (s *urlService) CompactStorage(ctx context.Context) (*StorageStats, error) {
+	ctx, span := tracer.Start(ctx, "urlService.CompactStorage")
+	defer span.End()
+
+	if err := s.r.CompactStorage(ctx); err != nil {
+		tracing.RecordError(span, err)
+		return nil, err
+	}
+	return s.r.GetStorageStats(), nil
+}
+
+func (s *urlService) FetchStorageStats() *StorageStats {
+	return s.r.GetStorageStats()
+}
+
+// FetchDeadTasks returns deletions which failed after all retries
+func (s *urlService) FetchDeadTasks() []*DeadTask {
+	return s.p.DeadTasks()
+}
+
+func (s *urlService) Status(ctx context.Context) error {
+	ctx, span := tracer.Start(ctx, "urlService.Status")
+	defer span.End()
+
+	err := s.r.Status(ctx)
+	tracing.RecordError(span, err)
+	return err
 }
 
 func (s *urlService) Shutdown() error {
@@ -3,24 +3,33 @@ package url
 import (
 	"context"
 	"errors"
+	"fmt"
 	"runtime"
 	"sync"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
-	"golang.org/x/sync/errgroup"
+
+	"github.com/bigbag/go-musthave-shortener/internal/config"
+	"github.com/bigbag/go-musthave-shortener/internal/metrics"
 )
 
 type Task struct {
-	ShortIDs []string
-	UserID   string
+	ID        string
+	ShortIDs  []string
+	UserID    string
+	CreatedAt time.Time
 }
 type Queue struct {
-	arr  []*Task
-	mu   sync.Mutex
-	cond *sync.Cond
-	stop bool
+	arr   []*Task
+	mu    sync.Mutex
+	cond  *sync.Cond
+	stop  bool
+	abort bool
 }
 
+// close stops accepting of new tasks, workers take the rest of the queue
 func (q *Queue) close() {
 	q.cond.L.Lock()
 	q.stop = true
@@ -28,77 +37,252 @@ func (q *Queue) close() {
 	q.cond.L.Unlock()
 }
 
-func (q *Queue) PopWait() (*Task, bool) {
+// cancel makes workers leave the queue even if tasks remain
+func (q *Queue) cancel() {
 	q.cond.L.Lock()
+	q.stop = true
+	q.abort = true
+	q.cond.Broadcast()
+	q.cond.L.Unlock()
+}
+
+// PopBatch waits for the first task and coalesces it with following tasks
+// until the batch has maxKeys short ids or the interval is over. Tasks are
+// not split, so a single task may exceed the limit.
+func (q *Queue) PopBatch(maxKeys int, interval time.Duration) ([]*Task, bool) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
 
 	for len(q.arr) == 0 && !q.stop {
 		q.cond.Wait()
 	}
 
-	if q.stop {
-		q.cond.L.Unlock()
+	if q.abort || len(q.arr) == 0 {
 		return nil, false
 	}
 
-	t := q.arr[0]
-	q.arr = q.arr[1:]
+	var (
+		batch []*Task
+		keys  int
+		timer *time.Timer
+	)
+	deadline := time.Now().Add(interval)
 
-	q.cond.L.Unlock()
+	for {
+		for len(q.arr) > 0 && (len(batch) == 0 || keys+len(q.arr[0].ShortIDs) <= maxKeys) {
+			batch = append(batch, q.arr[0])
+			keys += len(q.arr[0].ShortIDs)
+			q.arr = q.arr[1:]
+		}
+
+		// the next task doesn't fit or there is nothing to wait for
+		if len(q.arr) > 0 || keys >= maxKeys || q.stop {
+			break
+		}
+
+		now := time.Now()
+		if !now.Before(deadline) {
+			break
+		}
+		if timer == nil {
+			timer = time.AfterFunc(deadline.Sub(now), func() {
+				q.cond.L.Lock()
+				q.cond.Broadcast()
+				q.cond.L.Unlock()
+			})
+			defer timer.Stop()
+		}
+		q.cond.Wait()
+
+		if q.abort {
+			return nil, false
+		}
+	}
 
-	return t, true
+	return batch, true
 }
 
 type TaskPool struct {
 	l          logrus.FieldLogger
 	r          URLRepository
+	cfg        *config.DeleteQueue
 	workerPool []*TaskWorker
 	wg         *sync.WaitGroup
 	queue      *Queue
 	total      chan int
+	m          *metrics.Metrics
+	cancel     context.CancelFunc
+	done       chan struct{}
+	deadMu     *sync.Mutex
+	dead       []*DeadTask
+	jobs       *jobRegistry
 }
 
-func NewTaskPool(ctx context.Context, l logrus.FieldLogger, r URLRepository) *TaskPool {
-	p := &TaskPool{l: l, r: r}
-	p.workerPool = make([]*TaskWorker, 0, runtime.NumCPU())
+// NewTaskPool starts workers of deletion, tasks which were accepted but
+// not processed before the last stop are replayed from the storage
+// and dead tasks are restored when the queue is persistent
+func NewTaskPool(
+	ctx context.Context,
+	l logrus.FieldLogger,
+	r URLRepository,
+	m *metrics.Metrics,
+	cfg *config.DeleteQueue,
+) (*TaskPool, error) {
+	p := &TaskPool{
+		l:      l,
+		r:      r,
+		m:      m,
+		cfg:    cfg,
+		deadMu: &sync.Mutex{},
+		jobs:   newJobRegistry(cfg.JobRetention),
+	}
+	workers := cfg.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	p.workerPool = make([]*TaskWorker, 0, workers)
 	p.queue = p.newQueue()
+	p.total = make(chan int)
+	p.done = make(chan struct{})
 
-	for i := 0; i < runtime.NumCPU(); i++ {
+	if cfg.Persistent {
+		tasks, err := r.GetDeleteTasks(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if len(tasks) > 0 {
+			p.l.Info("worker: replay pending tasks ", len(tasks))
+		}
+		for _, t := range tasks {
+			p.jobs.add(t)
+		}
+		p.queue.arr = append(p.queue.arr, tasks...)
+
+		if p.dead, err = r.GetDeadTasks(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	for i := 0; i < workers; i++ {
 		p.workerPool = append(p.workerPool, p.newWorker(i))
 	}
 
-	ctx, cancel := context.WithCancel(ctx)
-	g, _ := errgroup.WithContext(ctx)
+	ctx, p.cancel = context.WithCancel(ctx)
 	p.wg = &sync.WaitGroup{}
 
 	for _, w := range p.workerPool {
 		p.wg.Add(1)
-		worker := w
-		f := func() error {
-			return worker.loop(ctx)
-		}
-		g.Go(f)
+		go p.supervise(ctx, w)
 	}
 
-	go func() {
-		if err := g.Wait(); err != nil {
-			p.l.Info("worker: pool error ", err)
-		}
-	}()
 	go func() {
 		p.wg.Wait()
 		close(p.total)
-		cancel()
+		p.cancel()
 	}()
 
-	p.total = make(chan int)
 	go func() {
-		total := 0
 		for c := range p.total {
-			total = total + c
+			p.m.AddDeletions(c)
 		}
+		close(p.done)
 	}()
 
-	return p
+	return p, nil
+}
+
+// supervise restarts the worker after a failure until the queue is drained
+func (p *TaskPool) supervise(ctx context.Context, w *TaskWorker) {
+	defer p.wg.Done()
+
+	for restarts := 0; ; restarts++ {
+		err := w.run(ctx)
+		if err == nil {
+			return
+		}
+
+		p.l.Error("worker: ", w.id, " failed, restart: ", err)
+		if err := sleep(ctx, p.backoff(restarts)); err != nil {
+			return
+		}
+	}
+}
+
+// backoff returns exponential delay of the attempt
+func (p *TaskPool) backoff(attempt int) time.Duration {
+	d := p.cfg.RetryBackoff
+	for i := 0; i < attempt && d < p.cfg.RetryMaxBackoff; i++ {
+		d *= 2
+	}
+	if d > p.cfg.RetryMaxBackoff {
+		d = p.cfg.RetryMaxBackoff
+	}
+	return d
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// bury moves the task to the dead-letter list, the oldest tasks are dropped
+// when the list is full. Persistent dead tasks are kept in the storage
+// instead of replay and dropped ones are acked.
+func (p *TaskPool) bury(ctx context.Context, t *Task, attempts int, err error) {
+	p.l.Error("worker: task ", t.ID, " is dead after ", attempts, " attempts: ", err)
+	p.jobs.fail(t.ID, err)
+
+	dead := &DeadTask{
+		ID:        t.ID,
+		UserID:    t.UserID,
+		ShortIDs:  t.ShortIDs,
+		Attempts:  attempts,
+		Error:     err.Error(),
+		CreatedAt: t.CreatedAt,
+		FailedAt:  time.Now().UTC(),
+	}
+	if p.cfg.Persistent {
+		if err := p.r.BuryDeleteTask(ctx, dead); err != nil {
+			p.l.Warn("worker: failed to bury task ", t.ID, ", it is replayed on the next start: ", err)
+		}
+	}
+
+	var dropped []*DeadTask
+
+	p.deadMu.Lock()
+	p.dead = append(p.dead, dead)
+	if len(p.dead) > p.cfg.DeadLetterSize {
+		dropped = append(dropped, p.dead[:len(p.dead)-p.cfg.DeadLetterSize]...)
+		p.dead = p.dead[len(p.dead)-p.cfg.DeadLetterSize:]
+	}
+	p.deadMu.Unlock()
+
+	if !p.cfg.Persistent {
+		return
+	}
+	for _, d := range dropped {
+		if err := p.r.AckDeleteTask(ctx, d.ID); err != nil {
+			p.l.Warn("worker: failed to ack dropped dead task ", d.ID, ": ", err)
+		}
+	}
+}
+
+// DeadTasks returns tasks which failed after all retries
+func (p *TaskPool) DeadTasks() []*DeadTask {
+	p.deadMu.Lock()
+	defer p.deadMu.Unlock()
+
+	result := make([]*DeadTask, len(p.dead))
+	copy(result, p.dead)
+	return result
 }
 
 func (p *TaskPool) newQueue() *Queue {
@@ -113,22 +297,91 @@ func (p *TaskPool) newWorker(id int) *TaskWorker {
 	return &TaskWorker{id, p}
 }
 
-func (p *TaskPool) Push(userID string, shortIDs []string) error {
-	if p.queue.stop {
-		return errors.New("worker: queue was stopped")
+// Push stores the task before it is queued when the queue is persistent,
+// so the task is accepted only if it survives a crash. It returns id
+// of the job, which reports the status of the task.
+func (p *TaskPool) Push(ctx context.Context, userID string, shortIDs []string) (string, error) {
+	t := &Task{
+		ID:        uuid.NewString(),
+		UserID:    userID,
+		ShortIDs:  shortIDs,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	if p.cfg.Persistent {
+		if p.isStopped() {
+			return "", errors.New("worker: queue was stopped")
+		}
+		// the task is replayed on the next start if the queue
+		// is stopped while the task is stored
+		if err := p.r.SaveDeleteTask(ctx, t); err != nil {
+			return "", err
+		}
 	}
 
 	p.queue.cond.L.Lock()
 	defer p.queue.cond.L.Unlock()
 
-	t := Task{UserID: userID, ShortIDs: shortIDs}
-	p.queue.arr = append(p.queue.arr, &t)
+	if p.queue.stop && !p.cfg.Persistent {
+		return "", errors.New("worker: queue was stopped")
+	}
+
+	p.jobs.add(t)
+	p.queue.arr = append(p.queue.arr, t)
 	p.queue.cond.Signal()
-	return nil
+	return t.ID, nil
+}
+
+// Job returns the status of the task, dead tasks restored from the storage
+// or failed before the retention window are reported by the dead-letter list
+func (p *TaskPool) Job(id string) (*Job, bool) {
+	if job, ok := p.jobs.get(id); ok {
+		return job, true
+	}
+
+	p.deadMu.Lock()
+	defer p.deadMu.Unlock()
+
+	for _, d := range p.dead {
+		if d.ID == id {
+			return d.job(), true
+		}
+	}
+	return nil, false
+}
+
+func (p *TaskPool) isStopped() bool {
+	p.queue.cond.L.Lock()
+	defer p.queue.cond.L.Unlock()
+	return p.queue.stop
 }
 
+// Len returns number of tasks waiting in the queue
+func (p *TaskPool) Len() int {
+	p.queue.cond.L.Lock()
+	defer p.queue.cond.L.Unlock()
+	return len(p.queue.arr)
+}
+
+// Close stops accepting of new tasks and waits until workers drain the
+// queue, workers are cancelled when the drain timeout is over. Tasks left
+// in a persistent queue are replayed on the next start.
 func (p *TaskPool) Close() {
 	p.queue.close()
+
+	timer := time.NewTimer(p.cfg.DrainTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-p.done:
+		return
+	case <-timer.C:
+	}
+
+	p.l.Warn("worker: drain timeout is over, tasks left: ", p.Len())
+	p.queue.cancel()
+	p.cancel()
+	<-p.done
 }
 
 type TaskWorker struct {
@@ -136,26 +389,152 @@ type TaskWorker struct {
 	pool *TaskPool
 }
 
-func (w *TaskWorker) loop(ctx context.Context) error {
+// run converts a panic of the worker to an error, so the worker is restarted
+func (w *TaskWorker) run(ctx context.Context) (err error) {
 	defer func() {
-		w.pool.wg.Done()
-		w.pool.queue.close()
-
-		<-ctx.Done()
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
 	}()
 
+	w.loop(ctx)
+	return nil
+}
+
+func (w *TaskWorker) loop(ctx context.Context) {
 	for {
-		t, ok := w.pool.queue.PopWait()
+		batch, ok := w.pool.queue.PopBatch(w.pool.cfg.BatchSize, w.pool.cfg.FlushInterval)
 		if !ok {
-			return nil
+			return
+		}
+
+		w.pool.l.Info("worker: new batch ", w.id, " tasks: ", len(batch))
+		w.pool.jobs.run(batch)
+
+		processed := batch
+		total, err := w.flush(ctx, batch)
+		if err != nil {
+			w.pool.l.Warn("worker: failed to flush batch, retry tasks one by one: ", err)
+			processed, total = w.retry(ctx, batch, err)
+		}
+		w.report(ctx, processed)
+		if ctx.Err() != nil {
+			w.pool.jobs.interrupt(batch, ctx.Err())
+		}
+
+		if w.pool.cfg.Persistent {
+			for _, t := range processed {
+				if err := w.pool.r.AckDeleteTask(ctx, t.ID); err != nil {
+					w.pool.l.Warn("worker: failed to ack task ", t.ID, ": ", err)
+				}
+			}
+		}
+
+		w.pool.total <- total
+	}
+}
+
+// flush deletes short ids of the batch with a single call
+// of the repository per user
+func (w *TaskWorker) flush(ctx context.Context, batch []*Task) (int, error) {
+	users := make([]string, 0, len(batch))
+	keys := make(map[string][]string, len(batch))
+	for _, t := range batch {
+		if _, ok := keys[t.UserID]; !ok {
+			users = append(users, t.UserID)
+		}
+		keys[t.UserID] = append(keys[t.UserID], t.ShortIDs...)
+	}
+
+	total := 0
+	for _, userID := range users {
+		if err := w.delete(ctx, userID, keys[userID]); err != nil {
+			return total, err
+		}
+		total += len(keys[userID])
+	}
+	return total, nil
+}
+
+// report completes jobs of processed tasks with outcomes of every short id
+func (w *TaskWorker) report(ctx context.Context, batch []*Task) {
+	shortIDs := make([]string, 0, len(batch))
+	for _, t := range batch {
+		shortIDs = append(shortIDs, t.ShortIDs...)
+	}
+
+	urls, err := w.pool.r.GetURLs(ctx, shortIDs)
+	if err != nil {
+		w.pool.l.Warn("worker: failed to get outcomes of batch: ", err)
+	}
+
+	owners := make(map[string]string, len(urls))
+	for _, url := range urls {
+		owners[url.ShortID] = url.UserID
+	}
+
+	for _, t := range batch {
+		if err != nil {
+			w.pool.jobs.done(t.ID, nil)
+			continue
+		}
+
+		outcomes := make(map[string]string, len(t.ShortIDs))
+		for _, shortID := range t.ShortIDs {
+			owner, ok := owners[shortID]
+			switch {
+			case !ok:
+				outcomes[shortID] = KeyNotFound
+			case owner != t.UserID:
+				outcomes[shortID] = KeyNotOwner
+			default:
+				outcomes[shortID] = KeyDeleted
+			}
+		}
+		w.pool.jobs.done(t.ID, outcomes)
+	}
+}
+
+// delete converts a panic of the repository to an error,
+// so the task is retried like after any other failure
+func (w *TaskWorker) delete(ctx context.Context, userID string, shortIDs []string) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+
+	return w.pool.r.DeleteUserURLs(ctx, userID, shortIDs)
+}
+
+// retry processes tasks of the failed batch separately with backoff,
+// so a broken task doesn't block others. It returns processed tasks,
+// tasks which are left because of cancellation stay in the storage.
+func (w *TaskWorker) retry(ctx context.Context, batch []*Task, cause error) ([]*Task, int) {
+	processed := make([]*Task, 0, len(batch))
+	total := 0
+
+	for _, t := range batch {
+		err := cause
+		for attempt := 0; attempt < w.pool.cfg.MaxRetries; attempt++ {
+			if err = sleep(ctx, w.pool.backoff(attempt)); err != nil {
+				return processed, total
+			}
+			if err = w.delete(ctx, t.UserID, t.ShortIDs); err == nil {
+				break
+			}
 		}
 
-		w.pool.l.Info("worker: new task ", w.id)
-		if err := w.pool.r.DeleteUserURLs(t.UserID, t.ShortIDs); err != nil {
-			w.pool.l.Info("worker: run to out from loop ")
-			return err
+		if err != nil {
+			if ctx.Err() != nil {
+				return processed, total
+			}
+			w.pool.bury(ctx, t, w.pool.cfg.MaxRetries+1, err)
+			continue
 		}
 
-		w.pool.total <- len(t.ShortIDs)
+		processed = append(processed, t)
+		total += len(t.ShortIDs)
 	}
+	return processed, total
 }
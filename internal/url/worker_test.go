@@ -0,0 +1,357 @@
+package url
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/bigbag/go-musthave-shortener/internal/config"
+	"github.com/bigbag/go-musthave-shortener/internal/metrics"
+	"github.com/bigbag/go-musthave-shortener/internal/storage"
+)
+
+func newTestURLRepository(t *testing.T, fileName string) URLRepository {
+	s, err := storage.NewStorageService(
+		context.Background(), logrus.New(), &config.Storage{FileStoragePath: fileName}, nil,
+	)
+	assert.Nil(t, err)
+
+	g, err := NewShortIDGenerator(
+		&config.ShortID{Generator: "random", Alphabet: "base62", Length: 8}, s,
+	)
+	assert.Nil(t, err)
+	return NewURLRepository(s, g)
+}
+
+func TestTaskPoolDrainOnClose(t *testing.T) {
+	ctx := context.Background()
+	r := newTestURLRepository(t, filepath.Join(t.TempDir(), "storage.json"))
+	defer r.Close()
+
+	shortID, err := r.CreateURL(ctx, &JSONRequest{FullURL: "https://github.com/"}, "user")
+	assert.Nil(t, err)
+
+	p, err := NewTaskPool(ctx, logrus.New(), r, metrics.New("test"), &config.DeleteQueue{
+		Persistent: true, DrainTimeout: time.Second, Workers: 2, BatchSize: 100,
+	})
+	assert.Nil(t, err)
+
+	_, err = p.Push(ctx, "user", []string{shortID})
+	assert.Nil(t, err)
+	p.Close()
+
+	url, err := r.GetURL(ctx, shortID)
+	assert.Nil(t, err)
+	assert.True(t, url.Removed)
+
+	tasks, err := r.GetDeleteTasks(ctx)
+	assert.Nil(t, err)
+	assert.Empty(t, tasks)
+
+	_, err = p.Push(ctx, "user", []string{shortID})
+	assert.NotNil(t, err)
+}
+
+func TestTaskPoolReplay(t *testing.T) {
+	ctx := context.Background()
+	fileName := filepath.Join(t.TempDir(), "storage.json")
+
+	r := newTestURLRepository(t, fileName)
+	shortID, err := r.CreateURL(ctx, &JSONRequest{FullURL: "https://github.com/"}, "user")
+	assert.Nil(t, err)
+
+	// the task was accepted, but the service crashed before processing
+	assert.Nil(t, r.SaveDeleteTask(ctx, &Task{
+		ID: "task", UserID: "user", ShortIDs: []string{shortID}, CreatedAt: time.Now(),
+	}))
+	assert.Nil(t, r.Close())
+
+	r = newTestURLRepository(t, fileName)
+	defer r.Close()
+
+	p, err := NewTaskPool(ctx, logrus.New(), r, metrics.New("test"), &config.DeleteQueue{
+		Persistent: true, DrainTimeout: time.Second, Workers: 2, BatchSize: 100,
+	})
+	assert.Nil(t, err)
+	p.Close()
+
+	url, err := r.GetURL(ctx, shortID)
+	assert.Nil(t, err)
+	assert.True(t, url.Removed)
+
+	tasks, err := r.GetDeleteTasks(ctx)
+	assert.Nil(t, err)
+	assert.Empty(t, tasks)
+}
+
+func newTestQueue(tasks ...*Task) *Queue {
+	q := &Queue{arr: tasks}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+func TestQueuePopBatch(t *testing.T) {
+	q := newTestQueue(
+		&Task{ID: "1", UserID: "first", ShortIDs: []string{"a", "b"}},
+		&Task{ID: "2", UserID: "second", ShortIDs: []string{"c"}},
+		&Task{ID: "3", UserID: "first", ShortIDs: []string{"d", "e"}},
+	)
+
+	batch, ok := q.PopBatch(3, time.Second)
+	assert.True(t, ok)
+	assert.Len(t, batch, 2)
+	assert.Equal(t, "1", batch[0].ID)
+	assert.Equal(t, "2", batch[1].ID)
+
+	// a single task is never split
+	batch, ok = q.PopBatch(1, time.Second)
+	assert.True(t, ok)
+	assert.Len(t, batch, 1)
+	assert.Equal(t, "3", batch[0].ID)
+}
+
+func TestQueuePopBatchWaitsInterval(t *testing.T) {
+	q := newTestQueue(&Task{ID: "1", UserID: "first", ShortIDs: []string{"a"}})
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		q.cond.L.Lock()
+		q.arr = append(q.arr, &Task{ID: "2", UserID: "first", ShortIDs: []string{"b"}})
+		q.cond.Signal()
+		q.cond.L.Unlock()
+	}()
+
+	batch, ok := q.PopBatch(2, time.Second)
+	assert.True(t, ok)
+	assert.Len(t, batch, 2)
+
+	q.close()
+	_, ok = q.PopBatch(2, time.Second)
+	assert.False(t, ok)
+}
+
+// flakyURLRepository fails or panics the given number of times
+type flakyURLRepository struct {
+	URLRepository
+
+	mu        sync.Mutex
+	fails     int
+	panics    int
+	ackPanics int
+}
+
+func (r *flakyURLRepository) AckDeleteTask(ctx context.Context, id string) error {
+	r.mu.Lock()
+	if r.ackPanics > 0 {
+		r.ackPanics--
+		r.mu.Unlock()
+		panic("broken storage")
+	}
+	r.mu.Unlock()
+
+	return r.URLRepository.AckDeleteTask(ctx, id)
+}
+
+func (r *flakyURLRepository) DeleteUserURLs(ctx context.Context, userID string, shortIDs []string) error {
+	r.mu.Lock()
+	switch {
+	case r.panics > 0:
+		r.panics--
+		r.mu.Unlock()
+		panic("broken storage")
+	case r.fails > 0:
+		r.fails--
+		r.mu.Unlock()
+		return errors.New("connection refused")
+	}
+	r.mu.Unlock()
+
+	return r.URLRepository.DeleteUserURLs(ctx, userID, shortIDs)
+}
+
+func newTestTaskPool(t *testing.T, r URLRepository) *TaskPool {
+	p, err := NewTaskPool(context.Background(), logrus.New(), r, metrics.New("test"), &config.DeleteQueue{
+		Persistent:      true,
+		DrainTimeout:    time.Second,
+		Workers:         1,
+		BatchSize:       100,
+		MaxRetries:      2,
+		RetryBackoff:    time.Millisecond,
+		RetryMaxBackoff: 5 * time.Millisecond,
+		DeadLetterSize:  10,
+		JobRetention:    time.Minute,
+	})
+	assert.Nil(t, err)
+	return p
+}
+
+func TestTaskPoolRetry(t *testing.T) {
+	ctx := context.Background()
+	base := newTestURLRepository(t, filepath.Join(t.TempDir(), "storage.json"))
+	defer base.Close()
+
+	shortID, err := base.CreateURL(ctx, &JSONRequest{FullURL: "https://github.com/"}, "user")
+	assert.Nil(t, err)
+
+	// the batch fails and the first retry panics
+	r := &flakyURLRepository{URLRepository: base, fails: 1, panics: 1}
+	p := newTestTaskPool(t, r)
+	_, err = p.Push(ctx, "user", []string{shortID})
+	assert.Nil(t, err)
+	p.Close()
+
+	url, err := r.GetURL(ctx, shortID)
+	assert.Nil(t, err)
+	assert.True(t, url.Removed)
+	assert.Empty(t, p.DeadTasks())
+}
+
+func TestTaskPoolDeadLetter(t *testing.T) {
+	ctx := context.Background()
+	base := newTestURLRepository(t, filepath.Join(t.TempDir(), "storage.json"))
+	defer base.Close()
+
+	first, err := base.CreateURL(ctx, &JSONRequest{FullURL: "https://github.com/1"}, "user")
+	assert.Nil(t, err)
+	second, err := base.CreateURL(ctx, &JSONRequest{FullURL: "https://github.com/2"}, "user")
+	assert.Nil(t, err)
+
+	// the batch and both retries of the first task fail
+	r := &flakyURLRepository{URLRepository: base, fails: 3}
+	p := newTestTaskPool(t, r)
+	_, err = p.Push(ctx, "user", []string{first})
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool { return len(p.DeadTasks()) == 1 }, time.Second, time.Millisecond)
+
+	// the pool is still alive
+	_, err = p.Push(ctx, "user", []string{second})
+	assert.Nil(t, err)
+	p.Close()
+
+	dead := p.DeadTasks()
+	assert.Equal(t, []string{first}, dead[0].ShortIDs)
+
+	job, ok := p.Job(dead[0].ID)
+	assert.True(t, ok)
+	assert.Equal(t, JobFailed, job.Status)
+	assert.Equal(t, "connection refused", job.Error)
+	assert.Equal(t, 3, dead[0].Attempts)
+	assert.Equal(t, "connection refused", dead[0].Error)
+
+	url, err := r.GetURL(ctx, second)
+	assert.Nil(t, err)
+	assert.True(t, url.Removed)
+
+	// the dead task isn't replayed, it is restored as a dead letter on the next start
+	tasks, err := r.GetDeleteTasks(ctx)
+	assert.Nil(t, err)
+	assert.Empty(t, tasks)
+
+	p = newTestTaskPool(t, r)
+	defer p.Close()
+	assert.Equal(t, dead, p.DeadTasks())
+
+	job, ok = p.Job(dead[0].ID)
+	assert.True(t, ok)
+	assert.Equal(t, JobFailed, job.Status)
+	assert.Equal(t, "user", job.UserID)
+	assert.Equal(t, "connection refused", job.Error)
+}
+
+func TestTaskPoolInterruptedJob(t *testing.T) {
+	ctx := context.Background()
+	base := newTestURLRepository(t, filepath.Join(t.TempDir(), "storage.json"))
+	defer base.Close()
+
+	shortID, err := base.CreateURL(ctx, &JSONRequest{FullURL: "https://github.com/"}, "user")
+	assert.Nil(t, err)
+
+	// the batch fails and the retry waits longer than the drain timeout
+	r := &flakyURLRepository{URLRepository: base, fails: 1}
+	p, err := NewTaskPool(ctx, logrus.New(), r, metrics.New("test"), &config.DeleteQueue{
+		Persistent:      true,
+		DrainTimeout:    10 * time.Millisecond,
+		Workers:         1,
+		BatchSize:       100,
+		MaxRetries:      2,
+		RetryBackoff:    time.Minute,
+		RetryMaxBackoff: time.Minute,
+		DeadLetterSize:  10,
+		JobRetention:    time.Minute,
+	})
+	assert.Nil(t, err)
+
+	jobID, err := p.Push(ctx, "user", []string{shortID})
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool {
+		job, _ := p.Job(jobID)
+		return job.Status == JobRunning
+	}, time.Second, time.Millisecond)
+	p.Close()
+
+	job, ok := p.Job(jobID)
+	assert.True(t, ok)
+	assert.Equal(t, JobInterrupted, job.Status)
+
+	// the task is replayed with the same job on the next start
+	p = newTestTaskPool(t, base)
+	p.Close()
+
+	job, ok = p.Job(jobID)
+	assert.True(t, ok)
+	assert.Equal(t, JobDone, job.Status)
+}
+
+func TestTaskPoolRestartsWorker(t *testing.T) {
+	ctx := context.Background()
+	base := newTestURLRepository(t, filepath.Join(t.TempDir(), "storage.json"))
+	defer base.Close()
+
+	shortID, err := base.CreateURL(ctx, &JSONRequest{FullURL: "https://github.com/"}, "user")
+	assert.Nil(t, err)
+
+	r := &flakyURLRepository{URLRepository: base, ackPanics: 1}
+	p := newTestTaskPool(t, r)
+	_, err = p.Push(ctx, "user", []string{"unknown"})
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool { return p.Len() == 0 }, time.Second, time.Millisecond)
+
+	_, err = p.Push(ctx, "user", []string{shortID})
+	assert.Nil(t, err)
+	p.Close()
+
+	url, err := r.GetURL(ctx, shortID)
+	assert.Nil(t, err)
+	assert.True(t, url.Removed)
+}
+
+func TestTaskPoolJobOutcomes(t *testing.T) {
+	ctx := context.Background()
+	r := newTestURLRepository(t, filepath.Join(t.TempDir(), "storage.json"))
+	defer r.Close()
+
+	own, err := r.CreateURL(ctx, &JSONRequest{FullURL: "https://github.com/1"}, "user")
+	assert.Nil(t, err)
+	other, err := r.CreateURL(ctx, &JSONRequest{FullURL: "https://github.com/2"}, "other")
+	assert.Nil(t, err)
+
+	p := newTestTaskPool(t, r)
+	jobID, err := p.Push(ctx, "user", []string{own, other, "unknown"})
+	assert.Nil(t, err)
+	p.Close()
+
+	job, ok := p.Job(jobID)
+	assert.True(t, ok)
+	assert.Equal(t, JobDone, job.Status)
+	assert.Equal(t, map[string]string{
+		own:       KeyDeleted,
+		other:     KeyNotOwner,
+		"unknown": KeyNotFound,
+	}, job.Outcomes)
+}